@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/logger"
+	"otel-with-golang/metrics"
+)
+
+const (
+	// baselineWeight is the weight of the newest sample in the moving
+	// average; lower values make the baseline react more slowly.
+	baselineWeight = 0.1
+	// maxAnomalyExamples bounds how many trace IDs are kept per route.
+	maxAnomalyExamples = 5
+)
+
+// latencyDetector keeps a rolling latency baseline per route and flags
+// requests that take longer than factor times that baseline. It is a
+// lightweight in-process signal to complement anomaly detection done in
+// the backend.
+type latencyDetector struct {
+	factor    float64
+	warmup    int
+	anomalies metric.Int64Counter
+
+	mu        sync.Mutex
+	baselines map[string]*latencyBaseline
+}
+
+type latencyBaseline struct {
+	mean     float64 // milliseconds
+	samples  int
+	examples []string // trace IDs of recent anomalies
+}
+
+func newLatencyDetector() (*latencyDetector, error) {
+	anomalies, err := metrics.LatencyAnomalies.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	return &latencyDetector{
+		factor:    envFloat("LATENCY_ANOMALY_FACTOR", 3),
+		warmup:    int(envInt("LATENCY_ANOMALY_WARMUP", 20)),
+		anomalies: anomalies,
+		baselines: make(map[string]*latencyBaseline),
+	}, nil
+}
+
+// observe folds a sample into the route baseline. When the sample is an
+// anomaly it returns the baseline it was compared against and the trace
+// IDs of recent anomalies on the route, including this one.
+func (d *latencyDetector) observe(route string, latency float64, traceID string) (float64, []string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	baseline, ok := d.baselines[route]
+	if !ok {
+		baseline = &latencyBaseline{mean: latency}
+		d.baselines[route] = baseline
+	}
+	mean := baseline.mean
+	anomalous := baseline.samples >= d.warmup && latency > mean*d.factor
+	baseline.mean += baselineWeight * (latency - baseline.mean)
+	baseline.samples++
+	if !anomalous {
+		return mean, nil, false
+	}
+
+	baseline.examples = append(baseline.examples, traceID)
+	if len(baseline.examples) > maxAnomalyExamples {
+		baseline.examples = baseline.examples[1:]
+	}
+	return mean, append([]string(nil), baseline.examples...), true
+}
+
+func (d *latencyDetector) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := clk.Now()
+		next.ServeHTTP(writer, request)
+		latency := float64(clk.Since(start)) / float64(time.Millisecond)
+
+		route := routeTemplate(request)
+		ctx := request.Context()
+		span := trace.SpanFromContext(ctx)
+		traceID := span.SpanContext().TraceID().String()
+
+		baseline, examples, anomalous := d.observe(route, latency, traceID)
+		if !anomalous {
+			return
+		}
+		span.AddEvent("latency.anomaly", trace.WithAttributes(
+			attribute.Float64("latency.ms", latency),
+			attribute.Float64("latency.baseline.ms", baseline),
+			attribute.Float64("latency.factor", d.factor),
+		))
+		d.anomalies.Add(ctx, 1, spanDimensions(ctx, attribute.String("http.route", route)))
+		logger.FromContext(ctx).WithFields(logrus.Fields{
+			"route":       route,
+			"latency_ms":  latency,
+			"baseline_ms": baseline,
+			"examples":    examples,
+		}).Warn("request latency deviates from baseline")
+	})
+}
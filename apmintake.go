@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// apmIntakeExporter converts finished spans to Elastic APM intake v2
+// events and posts them to the APM Server, for deployments where OTLP
+// ingestion is not enabled. Server and root spans become transactions,
+// everything else becomes a span; the OpenTelemetry attributes are
+// passed through in the "otel" field that the APM Server understands.
+type apmIntakeExporter struct {
+	url      string
+	headers  map[string]string
+	metadata map[string]interface{}
+	client   *http.Client
+}
+
+func newAPMIntakeExporter(endpoint string, headers map[string]string,
+	res0urce *resource.Resource) *apmIntakeExporter {
+
+	service := map[string]interface{}{
+		"agent":    map[string]string{"name": "opentelemetry/go", "version": otel.Version()},
+		"language": map[string]string{"name": "go"},
+	}
+	for _, kv := range res0urce.Attributes() {
+		switch kv.Key {
+		case semconv.ServiceNameKey:
+			service["name"] = kv.Value.AsString()
+		case semconv.ServiceVersionKey:
+			service["version"] = kv.Value.AsString()
+		}
+	}
+	url := endpoint
+	if !strings.Contains(url, "://") {
+		url = "https://" + url
+	}
+	return &apmIntakeExporter{
+		url:      strings.TrimSuffix(url, "/") + "/intake/v2/events",
+		headers:  headers,
+		metadata: map[string]interface{}{"service": service},
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (e *apmIntakeExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	if err := encoder.Encode(map[string]interface{}{"metadata": e.metadata}); err != nil {
+		return err
+	}
+	for _, span := range spans {
+		if err := encoder.Encode(intakeEvent(span)); err != nil {
+			return err
+		}
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, &body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	for key, value := range e.headers {
+		request.Header.Set(key, value)
+	}
+	response, err := e.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= http.StatusMultipleChoices {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("APM Server intake returned %s: %s", response.Status, message)
+	}
+	return nil
+}
+
+func (e *apmIntakeExporter) Shutdown(ctx context.Context) error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+// intakeEvent maps a finished span to an intake v2 transaction or span.
+func intakeEvent(span sdktrace.ReadOnlySpan) map[string]interface{} {
+	attributes := make(map[string]interface{}, len(span.Attributes()))
+	for _, kv := range span.Attributes() {
+		attributes[string(kv.Key)] = kv.Value.AsInterface()
+	}
+	outcome := "success"
+	if span.Status().Code == codes.Error {
+		outcome = "failure"
+	}
+	event := map[string]interface{}{
+		"id":        span.SpanContext().SpanID().String(),
+		"trace_id":  span.SpanContext().TraceID().String(),
+		"name":      span.Name(),
+		"timestamp": span.StartTime().UnixMicro(),
+		"duration":  float64(span.EndTime().Sub(span.StartTime())) / float64(time.Millisecond),
+		"outcome":   outcome,
+		"otel": map[string]interface{}{
+			"span_kind":  strings.ToUpper(span.SpanKind().String()),
+			"attributes": attributes,
+		},
+	}
+	parent := span.Parent()
+	if parent.IsValid() {
+		event["parent_id"] = parent.SpanID().String()
+	}
+
+	if !parent.IsValid() || parent.IsRemote() || span.SpanKind() == trace.SpanKindServer {
+		event["type"] = "request"
+		event["span_count"] = map[string]int{"started": 0}
+		return map[string]interface{}{"transaction": event}
+	}
+	event["type"] = intakeSpanType(span)
+	return map[string]interface{}{"span": event}
+}
+
+// intakeSpanType picks the APM span type from the span attributes.
+func intakeSpanType(span sdktrace.ReadOnlySpan) string {
+	for _, kv := range span.Attributes() {
+		if kv.Key == semconv.DBSystemKey {
+			return "db"
+		}
+	}
+	if span.SpanKind() == trace.SpanKindClient {
+		return "external"
+	}
+	return "app"
+}
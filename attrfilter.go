@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	"otel-with-golang/metrics"
+	"otel-with-golang/requestcontext"
+)
+
+// attributeDenyLists holds the attributes that are never exported in a
+// given deployment environment. SPAN_ATTRIBUTES_DENY adds to these and
+// SPAN_ATTRIBUTES_ALLOW, when set, restricts export to the listed keys.
+var attributeDenyLists = map[string][]attribute.Key{
+	"production": {requestcontext.UserNameAttribute},
+}
+
+// attributeFilterProcessor removes attributes from finished spans before
+// handing them to the next processor.
+type attributeFilterProcessor struct {
+	sdktrace.SpanProcessor
+	allow   map[attribute.Key]bool
+	deny    map[attribute.Key]bool
+	dropped metric.Int64Counter
+}
+
+func newAttributeFilterProcessor(next sdktrace.SpanProcessor,
+	environment string) (sdktrace.SpanProcessor, error) {
+
+	dropped, err := metrics.DroppedAttributes.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	processor := &attributeFilterProcessor{
+		SpanProcessor: next,
+		allow:         keySet(envList("SPAN_ATTRIBUTES_ALLOW")),
+		deny:          keySet(append(attributeDenyLists[environment], envList("SPAN_ATTRIBUTES_DENY")...)),
+		dropped:       dropped,
+	}
+	if len(processor.allow) == 0 && len(processor.deny) == 0 {
+		return next, nil
+	}
+	return processor, nil
+}
+
+func (p *attributeFilterProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	attrs := s.Attributes()
+	kept := make([]attribute.KeyValue, 0, len(attrs))
+	for _, kv := range attrs {
+		if p.keep(kv.Key) {
+			kept = append(kept, kv)
+			continue
+		}
+		p.dropped.Add(context.Background(), 1,
+			metric.WithAttributes(attribute.String("attribute.key", string(kv.Key))))
+	}
+	if len(kept) == len(attrs) {
+		p.SpanProcessor.OnEnd(s)
+		return
+	}
+	p.SpanProcessor.OnEnd(filteredSpan{ReadOnlySpan: s, attributes: kept})
+}
+
+func (p *attributeFilterProcessor) keep(key attribute.Key) bool {
+	if len(p.allow) > 0 && !p.allow[key] {
+		return false
+	}
+	return !p.deny[key]
+}
+
+// filteredSpan is a finished span with a reduced attribute set.
+type filteredSpan struct {
+	sdktrace.ReadOnlySpan
+	attributes []attribute.KeyValue
+}
+
+func (s filteredSpan) Attributes() []attribute.KeyValue {
+	return s.attributes
+}
+
+// envList reads a comma separated list from the environment.
+func envList(key string) []attribute.Key {
+	var keys []attribute.Key
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			keys = append(keys, attribute.Key(item))
+		}
+	}
+	return keys
+}
+
+func keySet(keys []attribute.Key) map[attribute.Key]bool {
+	set := make(map[attribute.Key]bool, len(keys))
+	for _, key := range keys {
+		set[key] = true
+	}
+	return set
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/metrics"
+)
+
+var (
+	bodyLimitKey    = attribute.Key("http.request.body.limit")
+	bodySizeKey     = attribute.Key("http.request.body.size")
+	bodyRejectedKey = attribute.Key("http.request.body.rejected_reason")
+)
+
+// limitRequestBody caps request bodies at limit bytes. Requests announcing
+// a larger Content-Length are rejected up front; chunked bodies are cut off
+// by http.MaxBytesReader while the handler streams them, which decodeBody
+// answers with the same status.
+func limitRequestBody(limit int64) (func(http.Handler) http.Handler, error) {
+	oversized, err := metrics.OversizedRequests.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if request.Body == nil || request.Body == http.NoBody {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			ctx := request.Context()
+			span := trace.SpanFromContext(ctx)
+			span.SetAttributes(bodyLimitKey.Int64(limit))
+
+			if request.ContentLength > limit {
+				span.SetAttributes(
+					bodySizeKey.Int64(request.ContentLength),
+					bodyRejectedKey.String("content-length exceeds limit"))
+				oversized.Add(ctx, 1)
+				http.Error(writer, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			body := &countingBody{ReadCloser: http.MaxBytesReader(writer, request.Body, limit)}
+			request.Body = body
+			next.ServeHTTP(writer, request)
+
+			span.SetAttributes(bodySizeKey.Int64(body.read))
+			if body.exceeded {
+				span.SetAttributes(bodyRejectedKey.String("body exceeds limit"))
+				oversized.Add(ctx, 1)
+			}
+		})
+	}, nil
+}
+
+// countingBody tracks how much of the body the handler consumed and
+// whether reading stopped at the size limit.
+type countingBody struct {
+	io.ReadCloser
+	read     int64
+	exceeded bool
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// decodeBody decodes the JSON body of request into v. When it cannot, it
+// also returns the status to answer with: 413 for a body cut off at the
+// size limit, as limitRequestBody answers a Content-Length over it, and 400
+// for any other body.
+func decodeBody(request *http.Request, v any) (int, error) {
+	err := json.NewDecoder(request.Body).Decode(v)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge, err
+	}
+	return http.StatusBadRequest, err
+}
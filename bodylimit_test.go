@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitRequestBody(t *testing.T) {
+	limit, err := limitRequestBody(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := limit(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var body map[string]string
+		if status, err := decodeBody(request, &body); err != nil {
+			http.Error(writer, err.Error(), status)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}))
+
+	large := `{"name": "` + strings.Repeat("z", 32) + `"}`
+	tests := []struct {
+		name string
+		body io.Reader
+		want int
+	}{
+		{"within the limit", strings.NewReader(`{"name": "zoe"}`), http.StatusNoContent},
+		{"content-length over the limit", strings.NewReader(large), http.StatusRequestEntityTooLarge},
+		// Without a length, as a chunked body, the limit is only hit
+		// while the handler reads it
+		{"streamed over the limit", io.MultiReader(strings.NewReader(large)), http.StatusRequestEntityTooLarge},
+		{"malformed", strings.NewReader(`{"name"`), http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/", test.body)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			if recorder.Code != test.want {
+				t.Errorf("answered %d, want %d", recorder.Code, test.want)
+			}
+		})
+	}
+}
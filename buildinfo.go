@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// keyDependencies are the modules whose versions are worth seeing next to
+// every trace, because upgrading them changes what the telemetry looks like.
+var keyDependencies = []string{
+	"go.opentelemetry.io/otel",
+	"go.opentelemetry.io/otel/sdk",
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux",
+	"google.golang.org/grpc",
+	"github.com/gorilla/mux",
+}
+
+type dependency struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	Sum     string `json:"sum,omitempty"`
+	Replace string `json:"replace,omitempty"`
+}
+
+type buildReport struct {
+	GoVersion    string       `json:"go_version"`
+	Main         dependency   `json:"main"`
+	Dependencies []dependency `json:"dependencies"`
+	Settings     []string     `json:"settings"`
+}
+
+// readBuildReport lists the modules compiled into the binary.
+func readBuildReport() (buildReport, bool) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return buildReport{}, false
+	}
+	report := buildReport{
+		GoVersion: info.GoVersion,
+		Main:      toDependency(&info.Main),
+	}
+	for _, module := range info.Deps {
+		report.Dependencies = append(report.Dependencies, toDependency(module))
+	}
+	for _, setting := range info.Settings {
+		report.Settings = append(report.Settings, setting.Key+"="+setting.Value)
+	}
+	return report, true
+}
+
+func toDependency(module *debug.Module) dependency {
+	dep := dependency{Path: module.Path, Version: module.Version, Sum: module.Sum}
+	if module.Replace != nil {
+		dep.Replace = module.Replace.Path + "@" + module.Replace.Version
+	}
+	return dep
+}
+
+// buildAttributes describes the build as resource attributes: the Go
+// version and the versions of keyDependencies as "path@version".
+func buildAttributes() []attribute.KeyValue {
+	report, ok := readBuildReport()
+	if !ok {
+		return nil
+	}
+	var versions []string
+	for _, dep := range report.Dependencies {
+		for _, key := range keyDependencies {
+			if dep.Path == key {
+				versions = append(versions, dep.Path+"@"+dep.Version)
+			}
+		}
+	}
+	return []attribute.KeyValue{
+		attribute.String("app.build.go_version", report.GoVersion),
+		attribute.StringSlice("app.build.dependencies", versions),
+	}
+}
+
+// depsHandler serves the build report at /admin/deps.
+func depsHandler(writer http.ResponseWriter, request *http.Request) {
+	report, ok := readBuildReport()
+	if !ok {
+		http.Error(writer, "build information is not available", http.StatusNotFound)
+		return
+	}
+	writer.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(report)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+
+	"otel-with-golang/metrics"
+	"otel-with-golang/requestcontext"
+)
+
+const (
+	// noTenant accounts for the requests that named no tenant.
+	noTenant = "none"
+	// otherTenants accounts for the tenants beyond the limit, so clients
+	// making up tenant names cannot grow the totals without bound.
+	otherTenants = "other"
+)
+
+// chargeback is set at startup and accounts for what each tenant costs.
+var chargeback *tenantAccounting
+
+// tenantTotals is what a tenant used since the service started.
+type tenantTotals struct {
+	Requests     int64   `json:"requests"`
+	DBMS         float64 `json:"db_ms"`
+	DownstreamMS float64 `json:"downstream_ms"`
+}
+
+// tenantAccounting sums the requests, database time and downstream time of
+// each tenant, as the basis for chargeback. The totals are exported as
+// observable counters by tenant, so each metric export carries a summary
+// of the period, and reported at /admin/usage.
+type tenantAccounting struct {
+	maxTenants int
+
+	mu     sync.Mutex
+	totals map[string]*tenantTotals
+}
+
+func newTenantAccounting() (*tenantAccounting, error) {
+	a := &tenantAccounting{
+		maxTenants: int(envInt("CHARGEBACK_MAX_TENANTS", 1000)),
+		totals:     make(map[string]*tenantTotals),
+	}
+	_, err := metrics.TenantRequests.New(meter, func(_ context.Context, o metric.Int64Observer) error {
+		for tenant, totals := range a.report() {
+			o.Observe(totals.Requests, metric.WithAttributes(requestcontext.TenantAttribute.String(tenant)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = metrics.TenantDBTime.New(meter, func(_ context.Context, o metric.Float64Observer) error {
+		for tenant, totals := range a.report() {
+			o.Observe(totals.DBMS, metric.WithAttributes(requestcontext.TenantAttribute.String(tenant)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = metrics.TenantDownstreamTime.New(meter, func(_ context.Context, o metric.Float64Observer) error {
+		for tenant, totals := range a.report() {
+			o.Observe(totals.DownstreamMS, metric.WithAttributes(requestcontext.TenantAttribute.String(tenant)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// middleware counts each request and its database time for its tenant. It
+// must run inside serverTiming, which times the database calls.
+func (a *tenantAccounting) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		next.ServeHTTP(writer, request)
+		ctx := request.Context()
+		a.add(ctx, func(totals *tenantTotals) {
+			totals.Requests++
+			totals.DBMS += milliseconds(dbTime(ctx))
+		})
+	})
+}
+
+// addDownstream accounts d spent calling a downstream service to the
+// tenant of ctx, including after its request is answered, such as for
+// webhook deliveries. A nil receiver accounts for nothing.
+func (a *tenantAccounting) addDownstream(ctx context.Context, d time.Duration) {
+	if a == nil {
+		return
+	}
+	a.add(ctx, func(totals *tenantTotals) {
+		totals.DownstreamMS += milliseconds(d)
+	})
+}
+
+func (a *tenantAccounting) add(ctx context.Context, update func(totals *tenantTotals)) {
+	tenant := requestTenant(ctx)
+	if tenant == "" {
+		tenant = noTenant
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	totals, ok := a.totals[tenant]
+	if !ok && len(a.totals) >= a.maxTenants {
+		tenant = otherTenants
+		totals, ok = a.totals[tenant]
+	}
+	if !ok {
+		totals = &tenantTotals{}
+		a.totals[tenant] = totals
+	}
+	update(totals)
+}
+
+// report returns a copy of the totals by tenant.
+func (a *tenantAccounting) report() map[string]tenantTotals {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	report := make(map[string]tenantTotals, len(a.totals))
+	for tenant, totals := range a.totals {
+		report[tenant] = *totals
+	}
+	return report
+}
+
+// handler serves /admin/usage: the totals of every tenant, or of the one
+// named by the tenant query parameter.
+func (a *tenantAccounting) handler(writer http.ResponseWriter, request *http.Request) {
+	var body interface{} = a.report()
+	if tenant := request.URL.Query().Get("tenant"); tenant != "" {
+		totals, ok := a.report()[tenant]
+		if !ok {
+			http.Error(writer, "unknown tenant", http.StatusNotFound)
+			return
+		}
+		body = totals
+	}
+	writer.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(body)
+}
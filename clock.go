@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// clock is the source of time for handlers, periodic jobs, retention and
+// metrics, so time-based behaviour can be driven by a manualClock instead
+// of waiting for the wall clock.
+type clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	NewTicker(d time.Duration) ticker
+	NewTimer(d time.Duration) ticker
+}
+
+// ticker is the part of time.Ticker and time.Timer in use here.
+type ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+var clk clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                  { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration { return time.Since(t) }
+func (realClock) NewTicker(d time.Duration) ticker {
+	return realTicker{time.NewTicker(d)}
+}
+func (realClock) NewTimer(d time.Duration) ticker {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTicker struct{ *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+func (t realTimer) Stop()               { t.Timer.Stop() }
+
+// manualClock only moves when Advance is called, firing the tickers and
+// timers that come due on the way.
+type manualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*manualTicker
+}
+
+func newManualClock(now time.Time) *manualClock {
+	return &manualClock{now: now}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *manualClock) NewTicker(d time.Duration) ticker {
+	return c.add(d, d)
+}
+
+func (c *manualClock) NewTimer(d time.Duration) ticker {
+	return c.add(d, 0)
+}
+
+func (c *manualClock) add(d, period time.Duration) *manualTicker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &manualTicker{clock: c, next: c.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward by d.
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.now.Add(d)
+	for {
+		sort.Slice(c.tickers, func(i, j int) bool { return c.tickers[i].next.Before(c.tickers[j].next) })
+		if len(c.tickers) == 0 || c.tickers[0].next.After(end) {
+			break
+		}
+		t := c.tickers[0]
+		c.now = t.next
+		select {
+		case t.c <- c.now:
+		default: // like time.Ticker, drop ticks nobody is reading
+		}
+		if t.period == 0 {
+			c.tickers = c.tickers[1:]
+		} else {
+			t.next = t.next.Add(t.period)
+		}
+	}
+	c.now = end
+}
+
+func (c *manualClock) remove(t *manualTicker) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, candidate := range c.tickers {
+		if candidate == t {
+			c.tickers = append(c.tickers[:i], c.tickers[i+1:]...)
+			return
+		}
+	}
+}
+
+type manualTicker struct {
+	clock  *manualClock
+	next   time.Time
+	period time.Duration
+	c      chan time.Time
+}
+
+func (t *manualTicker) C() <-chan time.Time { return t.c }
+func (t *manualTicker) Stop()               { t.clock.remove(t) }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// useManualClock makes clk a manualClock for the duration of the test.
+func useManualClock(t *testing.T) *manualClock {
+	t.Helper()
+	clock := newManualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	previous := clk
+	clk = clock
+	t.Cleanup(func() { clk = previous })
+	return clock
+}
+
+// waitForTickers waits for the code under test to create n tickers or
+// timers, since it does so in goroutines of its own.
+func waitForTickers(t *testing.T, clock *manualClock, n int) {
+	t.Helper()
+	eventually(t, func() bool {
+		clock.mu.Lock()
+		defer clock.mu.Unlock()
+		return len(clock.tickers) >= n
+	})
+}
+
+// eventually fails the test unless condition holds within a second.
+func eventually(t *testing.T, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatal("condition not met within a second")
+}
+
+func TestManualClockFiresTickersAndTimers(t *testing.T) {
+	clock := newManualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	start := clock.Now()
+	ticker := clock.NewTicker(time.Second)
+	timer := clock.NewTimer(1500 * time.Millisecond)
+
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case <-ticker.C():
+		t.Fatal("ticker fired early")
+	case <-timer.C():
+		t.Fatal("timer fired early")
+	default:
+	}
+
+	clock.Advance(time.Millisecond)
+	if tick := <-ticker.C(); !tick.Equal(start.Add(time.Second)) {
+		t.Errorf("tick at %v, want %v", tick, start.Add(time.Second))
+	}
+	clock.Advance(time.Second)
+	<-ticker.C()
+	if fired := <-timer.C(); !fired.Equal(start.Add(1500 * time.Millisecond)) {
+		t.Errorf("timer fired at %v, want %v", fired, start.Add(1500*time.Millisecond))
+	}
+	if since := clock.Since(start); since != 2*time.Second {
+		t.Errorf("Since = %v, want 2s", since)
+	}
+
+	ticker.Stop()
+	clock.Advance(time.Hour)
+	select {
+	case <-ticker.C():
+		t.Error("stopped ticker fired")
+	case <-timer.C():
+		t.Error("timer fired twice")
+	default:
+	}
+}
+
+func TestJobStoreForgetsFinishedJobsAfterRetention(t *testing.T) {
+	clock := useManualClock(t)
+	store := newJobStore(time.Minute, time.Minute, 10)
+	run := func() job {
+		j, err := store.start(context.Background(), "test", func(ctx context.Context) (string, error) {
+			return "done", nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return j
+	}
+
+	first := run()
+	clock.Advance(30 * time.Second)
+	second := run() // prunes nothing yet
+	if _, ok := store.get(first.ID); !ok {
+		t.Fatal("job forgotten before its retention")
+	}
+
+	clock.Advance(31 * time.Second)
+	run() // prunes the first job only
+	if _, ok := store.get(first.ID); ok {
+		t.Error("job kept after its retention")
+	}
+	if _, ok := store.get(second.ID); !ok {
+		t.Error("job forgotten before its retention")
+	}
+}
+
+func TestTaskSchedulerRunsTasksOnceDue(t *testing.T) {
+	clock := useManualClock(t)
+	previous := repository
+	repository = newMemoryStatsRepository()
+	t.Cleanup(func() { repository = previous })
+
+	store := newMemoryTaskStore()
+	scheduler, err := newTaskScheduler(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.interval = time.Second
+	scheduled, err := scheduler.schedule(context.Background(), "zoe", clock.Now().Add(5*time.Second), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go scheduler.run(ctx)
+	waitForTickers(t, clock, 1)
+
+	status := func() string {
+		t.Helper()
+		current, _, err := store.Get(context.Background(), scheduled.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return current.Status
+	}
+	clock.Advance(3 * time.Second)
+	time.Sleep(10 * time.Millisecond)
+	if got := status(); got != "pending" {
+		t.Fatalf("status before due = %q, want pending", got)
+	}
+
+	clock.Advance(3 * time.Second)
+	eventually(t, func() bool { return status() == "done" })
+	if err := jobs.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := repository.Count(context.Background(), "zoe"); count != 1 {
+		t.Errorf("count after the task = %d, want 1", count)
+	}
+}
+
+func TestStoppedTaskSchedulerLeavesTasksPending(t *testing.T) {
+	clock := useManualClock(t)
+	store := newMemoryTaskStore()
+	scheduler, err := newTaskScheduler(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.interval = time.Second
+	if err := scheduler.stop(context.Background()); err != nil {
+		t.Fatalf("stop before launch = %v", err)
+	}
+	scheduler.launch(context.Background())
+	waitForTickers(t, clock, 1)
+	if err := scheduler.stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduled, err := scheduler.schedule(context.Background(), "zoe", clock.Now(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(3 * time.Second)
+	time.Sleep(10 * time.Millisecond)
+	if current, _, _ := store.Get(context.Background(), scheduled.ID); current.Status != "pending" {
+		t.Errorf("status after stop = %q, want pending", current.Status)
+	}
+}
@@ -0,0 +1,195 @@
+// Command fakedownstream is a small instrumented HTTP server standing in
+// for a downstream service in demos. It answers every path after a
+// configurable latency, fails a configurable share of requests, and keeps
+// the traceparent header of the requests it received so a demo can check
+// the trace context was propagated.
+//
+// Behavior is set with FAKE_LATENCY (such as "50ms") and FAKE_ERROR_RATE
+// (between 0 and 1), and can be overridden per request with the latency and
+// status query parameters. Whether a request fails is decided from its
+// trace ID, the way the service's database chaos decides, so a trace fails
+// on every replica or on none, and the decision is recorded on the server
+// span as chaos.decision. The received requests are listed by
+// GET /_inspect/requests and forgotten by DELETE /_inspect/requests.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/pkg/otelboot"
+)
+
+// chaosDecisionKey records on the server span whether the request was
+// failed.
+var chaosDecisionKey = attribute.Key("chaos.decision")
+
+// maxReceived bounds the requests kept for inspection.
+const maxReceived = 1000
+
+// received is a request as the fake downstream saw it.
+type received struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Traceparent string    `json:"traceparent,omitempty"`
+	Tracestate  string    `json:"tracestate,omitempty"`
+	Status      int       `json:"status"`
+}
+
+type fakeDownstream struct {
+	latency   time.Duration
+	errorRate float64
+
+	mu       sync.Mutex
+	received []received
+}
+
+func (f *fakeDownstream) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	latency := f.latency
+	if value := request.URL.Query().Get("latency"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			latency = d
+		}
+	}
+	status, decision := http.StatusOK, "none"
+	if traceDraw(request.Context(), "error") < f.errorRate {
+		status, decision = http.StatusInternalServerError, "error"
+	}
+	trace.SpanFromContext(request.Context()).SetAttributes(chaosDecisionKey.String(decision))
+	if value := request.URL.Query().Get("status"); value != "" {
+		if code, err := strconv.Atoi(value); err == nil {
+			status = code
+		}
+	}
+
+	f.record(received{
+		Time:        time.Now(),
+		Method:      request.Method,
+		Path:        request.URL.Path,
+		Traceparent: request.Header.Get("traceparent"),
+		Tracestate:  request.Header.Get("tracestate"),
+		Status:      status,
+	})
+	select {
+	case <-time.After(latency):
+	case <-request.Context().Done():
+		return
+	}
+	writer.Header().Add("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(map[string]string{"status": http.StatusText(status)})
+}
+
+// traceDraw returns a number in [0, 1) fixed by the trace ID of ctx and
+// kind, drawn as the service's database chaos draws, so with the same rates
+// the same traces fail in both. Requests outside of a trace draw at random.
+func traceDraw(ctx context.Context, kind string) float64 {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		return rand.Float64()
+	}
+	traceID := spanContext.TraceID()
+	hash := fnv.New64a()
+	hash.Write(traceID[:])
+	hash.Write([]byte(kind))
+	return float64(hash.Sum64()>>11) / (1 << 53)
+}
+
+func (f *fakeDownstream) record(r received) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.received) == maxReceived {
+		f.received = f.received[1:]
+	}
+	f.received = append(f.received, r)
+}
+
+// inspect lists or forgets the received requests.
+func (f *fakeDownstream) inspect(writer http.ResponseWriter, request *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch request.Method {
+	case http.MethodGet:
+		writer.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(f.received)
+	case http.MethodDelete:
+		f.received = nil
+		writer.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func main() {
+	log := logrus.New()
+	log.SetFormatter(&logrus.JSONFormatter{})
+	ctx := context.Background()
+
+	// The exporter settings come from the OTEL_EXPORTER_OTLP_* variables
+	shutdown, err := otelboot.Setup(ctx, otelboot.Options{
+		ServiceName:    "fake-downstream",
+		DisableMetrics: true,
+		DisableLogs:    true,
+	})
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to set up telemetry", err)
+	}
+
+	fake := &fakeDownstream{
+		latency:   envDuration("FAKE_LATENCY", 0),
+		errorRate: envFloat("FAKE_ERROR_RATE", 0),
+	}
+	mux := http.NewServeMux()
+	// The inspection API is left out of the traces it reports on
+	mux.HandleFunc("/_inspect/requests", fake.inspect)
+	mux.Handle("/", otelhttp.NewHandler(fake, "fake downstream"))
+
+	addr := os.Getenv("LISTEN_ADDR")
+	if addr == "" {
+		addr = ":9100"
+	}
+	log.Infof("fake downstream listening on %s, latency %v, error rate %v",
+		addr, fake.latency, fake.errorRate)
+	server := &http.Server{Addr: addr, Handler: mux}
+	signalCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-signalCtx.Done()
+		server.Shutdown(ctx)
+	}()
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	if err := shutdown(ctx); err != nil {
+		log.Warnf("failed to flush telemetry: %v", err)
+	}
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return d
+	}
+	return def
+}
+
+func envFloat(key string, def float64) float64 {
+	if f, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return f
+	}
+	return def
+}
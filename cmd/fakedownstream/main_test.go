@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// startFake serves fake the way main does.
+func startFake(t *testing.T, fake *fakeDownstream) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_inspect/requests", fake.inspect)
+	mux.Handle("/", otelhttp.NewHandler(fake, "fake downstream",
+		otelhttp.WithPropagators(propagation.TraceContext{})))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func get(t *testing.T, url string, header http.Header) int {
+	t.Helper()
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	return response.StatusCode
+}
+
+func TestFakeDownstreamLatencyAndErrors(t *testing.T) {
+	failing := startFake(t, &fakeDownstream{errorRate: 1})
+	if status := get(t, failing.URL+"/orders", nil); status != http.StatusInternalServerError {
+		t.Errorf("status with FAKE_ERROR_RATE=1 = %d, want 500", status)
+	}
+	if status := get(t, failing.URL+"/orders?status=418", nil); status != http.StatusTeapot {
+		t.Errorf("status with ?status=418 = %d, want 418", status)
+	}
+
+	fake := &fakeDownstream{latency: 50 * time.Millisecond}
+	server := startFake(t, fake)
+	start := time.Now()
+	if status := get(t, server.URL+"/orders", nil); status != http.StatusOK {
+		t.Errorf("status with FAKE_ERROR_RATE=0 = %d, want 200", status)
+	}
+	if elapsed := time.Since(start); elapsed < fake.latency {
+		t.Errorf("answered after %v, want at least FAKE_LATENCY %v", elapsed, fake.latency)
+	}
+	start = time.Now()
+	get(t, server.URL+"/orders?latency=0s", nil)
+	if elapsed := time.Since(start); elapsed >= fake.latency {
+		t.Errorf("answered after %v with ?latency=0s, want less than %v", elapsed, fake.latency)
+	}
+}
+
+func TestFakeDownstreamInspection(t *testing.T) {
+	server := startFake(t, &fakeDownstream{})
+	get(t, server.URL+"/orders", http.Header{"Traceparent": {testTraceparent}})
+	get(t, server.URL+"/orders?status=503", nil)
+
+	inspect := func() []received {
+		t.Helper()
+		response, err := http.Get(server.URL + "/_inspect/requests")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		var requests []received
+		if err := json.NewDecoder(response.Body).Decode(&requests); err != nil {
+			t.Fatal(err)
+		}
+		return requests
+	}
+	requests := inspect()
+	if len(requests) != 2 {
+		t.Fatalf("inspection lists %d requests, want 2", len(requests))
+	}
+	if requests[0].Traceparent != testTraceparent || requests[0].Path != "/orders" || requests[0].Status != http.StatusOK {
+		t.Errorf("first request = %+v, want /orders with traceparent %s answered 200", requests[0], testTraceparent)
+	}
+	if requests[1].Traceparent != "" || requests[1].Status != http.StatusServiceUnavailable {
+		t.Errorf("second request = %+v, want no traceparent and 503", requests[1])
+	}
+
+	request, err := http.NewRequest(http.MethodDelete, server.URL+"/_inspect/requests", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if requests := inspect(); len(requests) != 0 {
+		t.Errorf("inspection lists %d requests after DELETE, want none", len(requests))
+	}
+}
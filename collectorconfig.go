@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"text/template"
+
+	"otel-with-golang/pkg/otelboot"
+)
+
+// collectorConfigTemplate describes a collector that receives OTLP from
+// this service and forwards it to the endpoint the service itself would
+// export to, with the same protocol, headers, TLS and sampling settings.
+var collectorConfigTemplate = template.Must(template.New("collector").
+	Funcs(template.FuncMap{"quote": strconv.Quote}).
+	Parse(`receivers:
+  otlp:
+    protocols:
+      grpc:
+        endpoint: {{ quote .ReceiverEndpoint }}
+      http:
+        endpoint: {{ quote .HTTPReceiverEndpoint }}
+
+processors:
+  batch:
+    timeout: 1s
+    send_batch_size: 1024
+{{- if .SamplingPercentage }}
+  # The share of the traces OTEL_TRACES_SAMPLER keeps. Sampling them again
+  # in the service would multiply the two, so run it with always_on
+  probabilistic_sampler:
+    sampling_percentage: {{ .SamplingPercentage }}
+{{- end }}
+
+extensions:
+  health_check:
+
+exporters:
+  {{ .Exporter }}:
+    endpoint: {{ quote .Endpoint }}
+{{- if .Headers }}
+    headers:
+{{- range $key, $value := .Headers }}
+      {{ quote $key }}: {{ quote $value }}
+{{- end }}
+{{- end }}
+    tls:
+      insecure: {{ .Insecure }}
+{{- if .CAFile }}
+      ca_file: {{ quote .CAFile }}
+{{- end }}
+{{- if .CertFile }}
+      cert_file: {{ quote .CertFile }}
+      key_file: {{ quote .KeyFile }}
+{{- end }}
+
+service:
+  extensions: [health_check]
+  pipelines:
+    logs:
+      receivers: [otlp]
+      processors: [batch]
+      exporters: [{{ .Exporter }}]
+    metrics:
+      receivers: [otlp]
+      processors: [batch]
+      exporters: [{{ .Exporter }}]
+    traces:
+      receivers: [otlp]
+      processors: [{{ if .SamplingPercentage }}probabilistic_sampler, {{ end }}batch]
+      exporters: [{{ .Exporter }}]
+`))
+
+// genCollectorConfig writes a collector YAML matching the exporter
+// settings in the environment, from the same options the exporters of the
+// service are set up with. Point OTEL_EXPORTER_OTLP_ENDPOINT (or
+// EXPORTER_ENDPOINT) of the service at COLLECTOR_RECEIVER_ENDPOINT, or at
+// COLLECTOR_RECEIVER_HTTP_ENDPOINT for OTLP/HTTP, once the collector runs
+// with it.
+func genCollectorConfig(out io.Writer) error {
+	opts, err := exporterOptions()
+	if err != nil {
+		return err
+	}
+	receiverEndpoint := os.Getenv("COLLECTOR_RECEIVER_ENDPOINT")
+	if receiverEndpoint == "" {
+		receiverEndpoint = "0.0.0.0:4317"
+	}
+	httpReceiverEndpoint := os.Getenv("COLLECTOR_RECEIVER_HTTP_ENDPOINT")
+	if httpReceiverEndpoint == "" {
+		httpReceiverEndpoint = "0.0.0.0:4318"
+	}
+	// The options leave the standard variables to the exporters, which
+	// read them themselves; the collector needs them spelled out
+	endpoint, headers := opts.Endpoint, opts.Headers
+	if endpoint == "" {
+		endpoint = exporterEndpoint()
+	}
+	if headers == nil {
+		if headers, err = exporterHeaders(); err != nil {
+			return err
+		}
+	}
+	insecure := opts.Insecure || envBool("OTEL_EXPORTER_OTLP_INSECURE", false)
+	exporter := "otlp/elastic"
+	if opts.Protocol == otelboot.ProtocolHTTP {
+		// The OTLP/HTTP exporter takes a URL, under which it posts to
+		// /v1/traces, /v1/metrics and /v1/logs
+		exporter = "otlphttp/elastic"
+		scheme := "https"
+		if insecure {
+			scheme = "http"
+		}
+		endpoint = scheme + "://" + endpoint + opts.PathPrefix
+	}
+	// The collector samples the traces as the service would, unless the
+	// service keeps them all
+	ratio, err := otelboot.SamplingRatio()
+	if err != nil {
+		return err
+	}
+	samplingPercentage := ""
+	if ratio < 1 {
+		samplingPercentage = strconv.FormatFloat(ratio*100, 'g', 10, 64)
+	}
+	caFile, certFile, keyFile := exporterTLSFiles()
+	return collectorConfigTemplate.Execute(out, struct {
+		ReceiverEndpoint     string
+		HTTPReceiverEndpoint string
+		SamplingPercentage   string
+		Exporter             string
+		Endpoint             string
+		Headers              map[string]string
+		Insecure             bool
+		CAFile               string
+		CertFile             string
+		KeyFile              string
+	}{
+		ReceiverEndpoint:     receiverEndpoint,
+		HTTPReceiverEndpoint: httpReceiverEndpoint,
+		SamplingPercentage:   samplingPercentage,
+		Exporter:             exporter,
+		Endpoint:             endpoint,
+		Headers:              headers,
+		Insecure:             insecure,
+		CAFile:               caFile,
+		CertFile:             certFile,
+		KeyFile:              keyFile,
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGenCollectorConfigFollowsExporterSettings(t *testing.T) {
+	ca := newTestCertificate(t, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	client := newTestCertificate(t, "client", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "client"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+
+	for _, test := range []struct {
+		name   string
+		env    map[string]string
+		want   []string
+		absent []string
+	}{
+		{
+			name: "grpc with TLS files",
+			env: map[string]string{
+				"EXPORTER_ENDPOINT":         "apm.example.com:443",
+				"EXPORTER_CA_FILE":          ca.certFile,
+				"EXPORTER_CLIENT_CERT_FILE": client.certFile,
+				"EXPORTER_CLIENT_KEY_FILE":  client.keyFile,
+			},
+			want: []string{
+				"  otlp/elastic:\n    endpoint: \"apm.example.com:443\"",
+				"insecure: false",
+				"ca_file: " + strconv.Quote(ca.certFile),
+				"cert_file: " + strconv.Quote(client.certFile),
+				"key_file: " + strconv.Quote(client.keyFile),
+				"exporters: [otlp/elastic]",
+			},
+			absent: []string{"probabilistic_sampler"},
+		},
+		{
+			name: "default receivers",
+			env:  map[string]string{"EXPORTER_ENDPOINT": "apm.example.com:443"},
+			want: []string{
+				"grpc:\n        endpoint: \"0.0.0.0:4317\"",
+				"http:\n        endpoint: \"0.0.0.0:4318\"",
+			},
+		},
+		{
+			name: "sampled traces",
+			env: map[string]string{
+				"EXPORTER_ENDPOINT":       "apm.example.com:443",
+				"OTEL_TRACES_SAMPLER":     "parentbased_traceidratio",
+				"OTEL_TRACES_SAMPLER_ARG": "0.1",
+			},
+			want: []string{
+				"probabilistic_sampler:\n    sampling_percentage: 10\n",
+				"processors: [probabilistic_sampler, batch]\n      exporters: [otlp/elastic]\n",
+			},
+		},
+		{
+			name: "plaintext http",
+			env: map[string]string{
+				"EXPORTER_ENDPOINT": "collector:4318",
+				"EXPORTER_PROTOCOL": "http/protobuf",
+				"EXPORTER_INSECURE": "true",
+				"EXPORTER_PATH":     "/otlp",
+			},
+			want: []string{
+				"  otlphttp/elastic:\n    endpoint: \"http://collector:4318/otlp\"",
+				"insecure: true",
+				"exporters: [otlphttp/elastic]",
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for _, key := range []string{"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_PROTOCOL", "OTEL_EXPORTER_OTLP_INSECURE",
+				"OTEL_TRACES_SAMPLER", "OTEL_TRACES_SAMPLER_ARG", "COLLECTOR_RECEIVER_ENDPOINT", "COLLECTOR_RECEIVER_HTTP_ENDPOINT"} {
+				t.Setenv(key, "")
+			}
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			var out strings.Builder
+			if err := genCollectorConfig(&out); err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range test.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("config lacks %q:\n%s", want, out.String())
+				}
+			}
+			for _, absent := range test.absent {
+				if strings.Contains(out.String(), absent) {
+					t.Errorf("config has %q:\n%s", absent, out.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// configSnapshot is the configuration a run of the service resolved, as
+// kept in CONFIG_STATE_FILE for the next run to compare against.
+type configSnapshot struct {
+	SavedAt time.Time         `json:"saved_at"`
+	Version string            `json:"version"`
+	Config  map[string]string `json:"config"`
+}
+
+// configChange is a setting whose value differs from the previous run.
+type configChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// logConfigDiff compares the resolved configuration, redacted as in the
+// support bundle, with the one saved by the previous run in
+// CONFIG_STATE_FILE, logs the settings added, removed and changed since,
+// then saves the current one in its place. That way "what changed since it
+// last worked" can be answered from the logs. Without CONFIG_STATE_FILE
+// nothing is compared or saved.
+func logConfigDiff() {
+	path := os.Getenv("CONFIG_STATE_FILE")
+	if path == "" {
+		return
+	}
+	current := configSnapshot{SavedAt: clk.Now(), Version: serviceVersion, Config: flattenConfig(resolvedConfig())}
+
+	previous, err := readConfigSnapshot(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		log.WithField("config_file", path).Info("no previous configuration to compare against")
+	case err != nil:
+		log.Warnf("failed to read the previous configuration: %v", err)
+	default:
+		added, removed, changed := diffConfig(previous.Config, current.Config)
+		entry := log.WithFields(logrus.Fields{
+			"config_file":      path,
+			"previous_run":     previous.SavedAt,
+			"previous_version": previous.Version,
+		})
+		if len(added)+len(removed)+len(changed) == 0 {
+			entry.Info("configuration unchanged since the previous run")
+			break
+		}
+		entry.WithFields(logrus.Fields{
+			"config_added":   added,
+			"config_removed": removed,
+			"config_changed": changed,
+		}).Infof("configuration changed since the previous run: %d added, %d removed, %d changed",
+			len(added), len(removed), len(changed))
+	}
+
+	if err := writeConfigSnapshot(path, current); err != nil {
+		log.Warnf("failed to save the configuration: %v", err)
+	}
+}
+
+// flattenConfig turns the resolved configuration into settings named by
+// their path, such as env.DB_DRIVER, so nested values compare one by one.
+// The state of the running service, such as whether telemetry is ready
+// yet, is left out.
+func flattenConfig(config map[string]interface{}) map[string]string {
+	flat := make(map[string]string)
+	for key, value := range config {
+		switch value := value.(type) {
+		case map[string]string:
+			for name, v := range value {
+				flat[key+"."+name] = v
+			}
+		default:
+			if key != "telemetry_ready" {
+				flat[key] = fmt.Sprint(value)
+			}
+		}
+	}
+	return flat
+}
+
+// diffConfig returns the settings of current missing from previous, those
+// of previous missing from current, and those whose value differs.
+func diffConfig(previous, current map[string]string) (map[string]string, []string, map[string]configChange) {
+	added := make(map[string]string)
+	changed := make(map[string]configChange)
+	for key, value := range current {
+		old, ok := previous[key]
+		switch {
+		case !ok:
+			added[key] = value
+		case old != value:
+			changed[key] = configChange{From: old, To: value}
+		}
+	}
+	removed := []string{}
+	for key := range previous {
+		if _, ok := current[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(removed)
+	return added, removed, changed
+}
+
+func readConfigSnapshot(path string) (configSnapshot, error) {
+	var snapshot configSnapshot
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return snapshot, err
+	}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return snapshot, fmt.Errorf("%s: %w", path, err)
+	}
+	return snapshot, nil
+}
+
+// writeConfigSnapshot replaces the file at path through a rename, so a
+// crash while writing cannot leave half a snapshot for the next run.
+func writeConfigSnapshot(path string, snapshot configSnapshot) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
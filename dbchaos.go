@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/logger"
+	"otel-with-golang/metrics"
+)
+
+// errChaosSerialization is what the statements failed by the chaos driver
+// return, the way a database aborts a transaction that conflicted with a
+// concurrent one.
+var errChaosSerialization = errors.New("could not serialize access due to concurrent update")
+
+var (
+	chaosKindKey     = attribute.Key("db.chaos.kind")
+	chaosDecisionKey = attribute.Key("db.chaos.decision")
+)
+
+// dbChaos is set at startup when the database driver is wrapped, and backs
+// /admin/db-chaos.
+var dbChaos *chaosInjector
+
+// chaosConfig sets what the chaos driver injects into the database calls:
+// Latency added to a LatencyRate share of the traces, a DropRate share
+// failing as if the connection dropped, and an ErrorRate share of the
+// others failing with a serialization error. The rates are between 0 and
+// 1.
+type chaosConfig struct {
+	Latency     string  `json:"latency"`
+	LatencyRate float64 `json:"latency_rate"`
+	ErrorRate   float64 `json:"error_rate"`
+	DropRate    float64 `json:"drop_rate"`
+}
+
+// chaosInjector decides the fault of each database call, so users can
+// practice diagnosing database problems from the traces and metrics of the
+// service. It sits below otelsql, so the injected latency and errors show
+// up in the query spans like real ones.
+type chaosInjector struct {
+	injected metric.Int64Counter
+
+	mu      sync.Mutex
+	config  chaosConfig
+	latency time.Duration
+}
+
+// newChaosInjector returns an injector that injects nothing until
+// configured, so the schema can be set up first.
+func newChaosInjector() (*chaosInjector, error) {
+	injected, err := metrics.DBChaosInjected.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	return &chaosInjector{injected: injected, config: chaosConfig{Latency: "0s"}}, nil
+}
+
+// chaosConfigFromEnv reads the DB_CHAOS_* variables.
+func chaosConfigFromEnv() chaosConfig {
+	return chaosConfig{
+		Latency:     envDuration("DB_CHAOS_LATENCY", 0).String(),
+		LatencyRate: envFloat("DB_CHAOS_LATENCY_RATE", 1),
+		ErrorRate:   envFloat("DB_CHAOS_ERROR_RATE", 0),
+		DropRate:    envFloat("DB_CHAOS_DROP_RATE", 0),
+	}
+}
+
+func (c *chaosInjector) configure(config chaosConfig) error {
+	if config.Latency == "" {
+		config.Latency = "0s"
+	}
+	latency, err := time.ParseDuration(config.Latency)
+	if err != nil || latency < 0 {
+		return fmt.Errorf("invalid latency %q", config.Latency)
+	}
+	for name, rate := range map[string]float64{
+		"latency_rate": config.LatencyRate,
+		"error_rate":   config.ErrorRate,
+		"drop_rate":    config.DropRate,
+	} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("%s must be between 0 and 1, got %v", name, rate)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.config = config
+	c.latency = latency
+	return nil
+}
+
+// inject delays the call by the configured latency, then returns the error
+// it should fail with, if any: sqldriver.ErrBadConn for a dropped
+// connection, after which conn is no longer used, or
+// errChaosSerialization. The faults are drawn from the trace ID, so every
+// call of a trace gets the same ones, on every instance, and the decision
+// is recorded on the span of the call.
+func (c *chaosInjector) inject(ctx context.Context, conn *chaosConn) error {
+	c.mu.Lock()
+	config, latency := c.config, c.latency
+	c.mu.Unlock()
+
+	var faults []string
+	defer func() {
+		decision := "none"
+		if len(faults) > 0 {
+			decision = strings.Join(faults, "+")
+		}
+		trace.SpanFromContext(ctx).SetAttributes(chaosDecisionKey.String(decision))
+	}()
+	if latency > 0 && traceDraw(ctx, "latency") < config.LatencyRate {
+		faults = append(faults, "latency")
+		c.injected.Add(ctx, 1, metric.WithAttributes(chaosKindKey.String("latency")))
+		timer := clk.NewTimer(latency)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	switch {
+	case traceDraw(ctx, "drop") < config.DropRate:
+		faults = append(faults, "drop")
+		c.injected.Add(ctx, 1, metric.WithAttributes(chaosKindKey.String("drop")))
+		conn.dropped.Store(true)
+		return sqldriver.ErrBadConn
+	case traceDraw(ctx, "error") < config.ErrorRate:
+		faults = append(faults, "error")
+		c.injected.Add(ctx, 1, metric.WithAttributes(chaosKindKey.String("error")))
+		return errChaosSerialization
+	}
+	return nil
+}
+
+// traceDraw returns a number in [0, 1) fixed by the trace ID of ctx and
+// kind, so all the calls of a trace draw the same for a kind of fault,
+// whichever instance makes them, while the kinds stay independent. Calls
+// outside of a trace draw at random.
+func traceDraw(ctx context.Context, kind string) float64 {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		return rand.Float64()
+	}
+	traceID := spanContext.TraceID()
+	hash := fnv.New64a()
+	hash.Write(traceID[:])
+	hash.Write([]byte(kind))
+	return float64(hash.Sum64()>>11) / (1 << 53)
+}
+
+// chaosConnector opens the connections of the wrapped driver through the
+// injector.
+type chaosConnector struct {
+	driver sqldriver.Driver
+	dsn    string
+	chaos  *chaosInjector
+}
+
+// openChaosConnector wraps the driver registered as driverName, such as
+// sqlite3, so its calls go through chaos.
+func openChaosConnector(driverName, dsn string, chaos *chaosInjector) (sqldriver.Connector, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	driver := db.Driver()
+	if err := db.Close(); err != nil {
+		return nil, err
+	}
+	return &chaosConnector{driver: driver, dsn: dsn, chaos: chaos}, nil
+}
+
+func (c *chaosConnector) Connect(ctx context.Context) (sqldriver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &chaosConn{Conn: conn, chaos: c.chaos}, nil
+}
+
+func (c *chaosConnector) Driver() sqldriver.Driver {
+	return c.driver
+}
+
+// chaosConn injects faults before the statements and transactions of its
+// connection. Calls the wrapped connection does not support answer
+// sqldriver.ErrSkip, so database/sql falls back as it would without the
+// wrapper.
+type chaosConn struct {
+	sqldriver.Conn
+	chaos   *chaosInjector
+	dropped atomic.Bool
+}
+
+func (c *chaosConn) ExecContext(ctx context.Context, query string, args []sqldriver.NamedValue) (sqldriver.Result, error) {
+	execer, ok := c.Conn.(sqldriver.ExecerContext)
+	if !ok {
+		return nil, sqldriver.ErrSkip
+	}
+	if err := c.chaos.inject(ctx, c); err != nil {
+		return nil, err
+	}
+	return execer.ExecContext(ctx, query, args)
+}
+
+func (c *chaosConn) QueryContext(ctx context.Context, query string, args []sqldriver.NamedValue) (sqldriver.Rows, error) {
+	queryer, ok := c.Conn.(sqldriver.QueryerContext)
+	if !ok {
+		return nil, sqldriver.ErrSkip
+	}
+	if err := c.chaos.inject(ctx, c); err != nil {
+		return nil, err
+	}
+	return queryer.QueryContext(ctx, query, args)
+}
+
+func (c *chaosConn) BeginTx(ctx context.Context, opts sqldriver.TxOptions) (sqldriver.Tx, error) {
+	if err := c.chaos.inject(ctx, c); err != nil {
+		return nil, err
+	}
+	if beginner, ok := c.Conn.(sqldriver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *chaosConn) PrepareContext(ctx context.Context, query string) (sqldriver.Stmt, error) {
+	var stmt sqldriver.Stmt
+	var err error
+	if preparer, ok := c.Conn.(sqldriver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &chaosStmt{Stmt: stmt, conn: c}, nil
+}
+
+func (c *chaosConn) Ping(ctx context.Context) error {
+	if c.dropped.Load() {
+		return sqldriver.ErrBadConn
+	}
+	if pinger, ok := c.Conn.(sqldriver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// IsValid reports a dropped connection to database/sql, which then closes
+// it instead of returning it to the pool.
+func (c *chaosConn) IsValid() bool {
+	return !c.dropped.Load()
+}
+
+// chaosStmt injects faults before the executions of a prepared statement,
+// as chaosConn does before those of plain queries.
+type chaosStmt struct {
+	sqldriver.Stmt
+	conn *chaosConn
+}
+
+func (s *chaosStmt) ExecContext(ctx context.Context, args []sqldriver.NamedValue) (sqldriver.Result, error) {
+	if err := s.conn.chaos.inject(ctx, s.conn); err != nil {
+		return nil, err
+	}
+	if execer, ok := s.Stmt.(sqldriver.StmtExecContext); ok {
+		return execer.ExecContext(ctx, args)
+	}
+	values, err := namedValueValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.Stmt.Exec(values)
+}
+
+func (s *chaosStmt) QueryContext(ctx context.Context, args []sqldriver.NamedValue) (sqldriver.Rows, error) {
+	if err := s.conn.chaos.inject(ctx, s.conn); err != nil {
+		return nil, err
+	}
+	if queryer, ok := s.Stmt.(sqldriver.StmtQueryContext); ok {
+		return queryer.QueryContext(ctx, args)
+	}
+	values, err := namedValueValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.Stmt.Query(values)
+}
+
+// CheckNamedValue leaves the conversion of the arguments to the wrapped
+// statement, or to database/sql when it has none.
+func (s *chaosStmt) CheckNamedValue(value *sqldriver.NamedValue) error {
+	if checker, ok := s.Stmt.(sqldriver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return sqldriver.ErrSkip
+}
+
+// namedValueValues returns the values of args, for statements that only
+// take positional arguments.
+func namedValueValues(args []sqldriver.NamedValue) ([]sqldriver.Value, error) {
+	values := make([]sqldriver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, fmt.Errorf("the driver does not support the named argument %q", arg.Name)
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
+
+// dbChaosHandler shows what the chaos driver injects, and changes the
+// settings named in the JSON body of a PUT, such as
+// {"latency": "200ms", "latency_rate": 0.1}.
+func dbChaosHandler(writer http.ResponseWriter, request *http.Request) {
+	if dbChaos == nil {
+		http.Error(writer, "database chaos is not set up", http.StatusNotFound)
+		return
+	}
+	if request.Method == http.MethodPut {
+		dbChaos.mu.Lock()
+		config := dbChaos.config
+		dbChaos.mu.Unlock()
+		if status, err := decodeBody(request, &config); err != nil {
+			http.Error(writer, err.Error(), status)
+			return
+		}
+		if err := dbChaos.configure(config); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.FromContext(request.Context()).WithField("chaos", config).Info("changed database chaos")
+	}
+	dbChaos.mu.Lock()
+	config := dbChaos.config
+	dbChaos.mu.Unlock()
+	writer.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(config)
+}
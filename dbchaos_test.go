@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+func TestChaosInjectsIntoPreparedStatements(t *testing.T) {
+	if !sqliteAvailable {
+		t.Skip("built without the SQLite driver")
+	}
+	chaos, err := newChaosInjector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	connector, err := openChaosConnector("sqlite3", ":memory:", chaos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, "CREATE TABLE stats (name TEXT, count INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	insert, err := db.PrepareContext(ctx, "INSERT INTO stats (name, count) VALUES (?, ?)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer insert.Close()
+	query, err := db.PrepareContext(ctx, "SELECT count FROM stats WHERE name=?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer query.Close()
+
+	if err := chaos.configure(chaosConfig{ErrorRate: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := insert.ExecContext(ctx, "zoe", 1); !errors.Is(err, errChaosSerialization) {
+		t.Errorf("prepared exec returned %v, want %v", err, errChaosSerialization)
+	}
+	var count int
+	if err := query.QueryRowContext(ctx, "zoe").Scan(&count); !errors.Is(err, errChaosSerialization) {
+		t.Errorf("prepared query returned %v, want %v", err, errChaosSerialization)
+	}
+
+	// Without faults, the prepared statements run as usual
+	if err := chaos.configure(chaosConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := insert.ExecContext(ctx, "zoe", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := query.QueryRowContext(ctx, "zoe").Scan(&count); err != nil || count != 2 {
+		t.Errorf("got %d, %v, want 2", count, err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	deadlineBudgetKey    = attribute.Key("app.deadline.budget_ms")
+	deadlineRemainingKey = attribute.Key("app.deadline.remaining_ms")
+)
+
+// requestDeadline bounds the whole request path with a single deadline
+// carried in the request context. Every layer below the handler derives
+// its context from it, so none of them can outlive the request.
+func requestDeadline(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			ctx, cancel := context.WithTimeout(request.Context(), timeout)
+			defer cancel()
+			trace.SpanFromContext(ctx).SetAttributes(deadlineBudgetKey.Int64(timeout.Milliseconds()))
+			next.ServeHTTP(writer, request.WithContext(ctx))
+		})
+	}
+}
+
+// requestTimeout bounds every request, read from REQUEST_TIMEOUT.
+func requestTimeout() time.Duration {
+	return envDuration("REQUEST_TIMEOUT", 10*time.Second)
+}
+
+// remainingBudget reports how much of the request deadline is left, to be
+// recorded on the span of each hop.
+func remainingBudget(ctx context.Context) []attribute.KeyValue {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return nil
+	}
+	return []attribute.KeyValue{deadlineRemainingKey.Int64(deadline.Sub(clk.Now()).Milliseconds())}
+}
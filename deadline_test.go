@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// testDeadline is the request deadline of the tests, and deadlineSlack how
+// much later than it a layer may return.
+const (
+	testDeadline  = 100 * time.Millisecond
+	deadlineSlack = 500 * time.Millisecond
+)
+
+// serveWithDeadline runs hop with the context of a request served under
+// requestDeadline, and returns its error and how long the request took.
+func serveWithDeadline(t *testing.T, hop func(ctx context.Context) error) (error, time.Duration) {
+	t.Helper()
+	var err error
+	handler := requestDeadline(testDeadline)(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		err = hop(request.Context())
+	}))
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/hello/deadline", nil))
+	return err, time.Since(start)
+}
+
+func assertWithinDeadline(t *testing.T, err error, elapsed time.Duration) {
+	t.Helper()
+	if err == nil {
+		t.Fatal("the hop outlived the request deadline without failing")
+	}
+	if elapsed > testDeadline+deadlineSlack {
+		t.Fatalf("the request took %v, want at most %v", elapsed, testDeadline+deadlineSlack)
+	}
+}
+
+func TestRequestDeadlineEndsWithTheRequest(t *testing.T) {
+	var requestCtx context.Context
+	err, _ := serveWithDeadline(t, func(ctx context.Context) error {
+		requestCtx = ctx
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return errors.New("no deadline")
+		}
+		if remaining := time.Until(deadline); remaining > testDeadline {
+			t.Errorf("remaining budget %v is over the deadline of %v", remaining, testDeadline)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requestCtx.Err() == nil {
+		t.Error("the request context is still live once the request is answered")
+	}
+}
+
+func TestRemainingBudget(t *testing.T) {
+	if attrs := remainingBudget(context.Background()); attrs != nil {
+		t.Errorf("remainingBudget without a deadline = %v, want nothing", attrs)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), testDeadline)
+	defer cancel()
+	attrs := remainingBudget(ctx)
+	if len(attrs) != 1 || attrs[0].Key != deadlineRemainingKey {
+		t.Fatalf("remainingBudget = %v, want %s", attrs, deadlineRemainingKey)
+	}
+	if remaining := attrs[0].Value.AsInt64(); remaining <= 0 || remaining > testDeadline.Milliseconds() {
+		t.Errorf("remaining budget = %dms, want between 0 and %dms", remaining, testDeadline.Milliseconds())
+	}
+}
+
+func TestRequestDeadlineDatabase(t *testing.T) {
+	if !sqliteAvailable {
+		t.Skip("built without the SQLite driver")
+	}
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err, elapsed := serveWithDeadline(t, func(ctx context.Context) error {
+		// Counts for far longer than the deadline unless interrupted
+		var count int64
+		return db.QueryRowContext(ctx, `WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n)
+			SELECT count(*) FROM (SELECT i FROM n LIMIT 1000000000)`).Scan(&count)
+	})
+	assertWithinDeadline(t, err, elapsed)
+}
+
+func TestRequestDeadlineDownstream(t *testing.T) {
+	cancelled := make(chan struct{})
+	downstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		select {
+		case <-request.Context().Done():
+			close(cancelled)
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer downstream.Close()
+	client := &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+
+	err, elapsed := serveWithDeadline(t, func(ctx context.Context) error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, downstream.URL, nil)
+		if err != nil {
+			return err
+		}
+		response, err := client.Do(request)
+		if err != nil {
+			return err
+		}
+		return response.Body.Close()
+	})
+	assertWithinDeadline(t, err, elapsed)
+	select {
+	case <-cancelled:
+	case <-time.After(deadlineSlack):
+		t.Error("the downstream request was not cancelled with the request")
+	}
+}
+
+// blockingRepository answers reads once released.
+type blockingRepository struct {
+	StatsRepository
+	release chan struct{}
+}
+
+func (r *blockingRepository) Count(ctx context.Context, name string) (int, error) {
+	<-r.release
+	return 1, nil
+}
+
+func TestRequestDeadlineWorkers(t *testing.T) {
+	t.Run("collapsed reads", func(t *testing.T) {
+		next := &blockingRepository{StatsRepository: newMemoryStatsRepository(), release: make(chan struct{})}
+		defer close(next.release)
+		reads, err := newSingleflightRepository(next, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The shared query outlives the request, which stops waiting for it
+		err, elapsed := serveWithDeadline(t, func(ctx context.Context) error {
+			_, err := reads.Count(ctx, "deadline")
+			return err
+		})
+		assertWithinDeadline(t, err, elapsed)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+
+	t.Run("admission queue", func(t *testing.T) {
+		admission, err := newPriorityAdmission()
+		if err != nil {
+			t.Fatal(err)
+		}
+		admission.limit = 1
+		if err := admission.acquire(context.Background(), defaultPriority); err != nil {
+			t.Fatal(err)
+		}
+		defer admission.release()
+		err, elapsed := serveWithDeadline(t, func(ctx context.Context) error {
+			return admission.acquire(ctx, defaultPriority)
+		})
+		assertWithinDeadline(t, err, elapsed)
+	})
+}
+
+// stalledRepository answers reads only when their context ends.
+type stalledRepository struct {
+	StatsRepository
+}
+
+func (r stalledRepository) Count(ctx context.Context, name string) (int, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestSingleflightRepositoryBoundsSharedRead(t *testing.T) {
+	reads, err := newSingleflightRepository(stalledRepository{newMemoryStatsRepository()}, testDeadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A caller without a deadline of its own still gets an answer
+	start := time.Now()
+	_, err = reads.Count(context.Background(), "stalled")
+	assertWithinDeadline(t, err, time.Since(start))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// demoPhase is one chapter of the demo storyline.
+type demoPhase struct {
+	name      string
+	narration string
+	duration  time.Duration
+	interval  time.Duration
+	// concurrency is the number of clients sending requests in parallel.
+	concurrency int
+	names       []string
+	// dbErrorRate, when positive, is the share of the database calls the
+	// target's database chaos fails during the phase.
+	dbErrorRate float64
+}
+
+var demoNames = []string{"alice", "bob", "carol", "dave"}
+
+// demoScript is the storyline: steady traffic, a latency spike caused by a
+// burst of concurrent clients, a burst of failing requests (names too long
+// or with control characters are rejected, and database calls fail), and a
+// return to normal.
+var demoScript = []demoPhase{
+	{"normal", "steady traffic, everything is healthy", 30 * time.Second, 500 * time.Millisecond, 1, demoNames, 0},
+	{"latency spike", "a burst of concurrent clients, watch the latency distribution widen", 20 * time.Second, 10 * time.Millisecond, 50, demoNames, 0},
+	{"error burst", "clients send names the service cannot handle while the database fails, watch the error rate", 20 * time.Second, 200 * time.Millisecond, 2, append([]string{strings.Repeat("zoë", 30), "renée\x7f", "josé\n"}, demoNames...), 0.5},
+	{"recovery", "traffic is back to normal, latency and error rate settle", 30 * time.Second, 500 * time.Millisecond, 1, demoNames, 0},
+}
+
+// runDemo plays demoScript against DEMO_TARGET, narrating each phase, so
+// workshops get the same predictable story in Elastic APM every time.
+// DEMO_SPEED shortens (or stretches) every phase by that factor.
+func runDemo(ctx context.Context) {
+	target := os.Getenv("DEMO_TARGET")
+	if target == "" {
+		target = "http://localhost:9000"
+	}
+	speed := envFloat("DEMO_SPEED", 1)
+	if speed <= 0 {
+		log.Fatalf("DEMO_SPEED must be positive, got %v", speed)
+	}
+
+	if err := initNameObfuscation(); err != nil {
+		log.Fatalf("%s: %v", "failed to set up name obfuscation", err)
+	}
+	initTelemetry(ctx)
+	// Stop early on SIGINT or SIGTERM, still flushing what was recorded
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	client := &http.Client{
+		Transport: otelhttp.NewTransport(obfuscatingTransport{http.DefaultTransport}),
+		Timeout:   10 * time.Second,
+	}
+
+	for i, phase := range demoScript {
+		if ctx.Err() != nil {
+			log.Info("demo interrupted")
+			break
+		}
+		duration := time.Duration(float64(phase.duration) / speed)
+		log.WithField("demo.phase", phase.name).
+			Infof("phase %d/%d (%v): %s", i+1, len(demoScript), duration, phase.narration)
+		restore := func() {}
+		if phase.dbErrorRate > 0 {
+			var err error
+			restore, err = demoDatabaseErrors(ctx, client, target, phase.dbErrorRate)
+			if err != nil {
+				log.WithField("demo.phase", phase.name).
+					Warnf("database errors not injected, only invalid names will fail: %v", err)
+				restore = func() {}
+			}
+		}
+		ok, failed := playPhase(ctx, client, target, phase, duration)
+		restore()
+		log.WithField("demo.phase", phase.name).
+			Infof("phase %s done: %d succeeded, %d failed", phase.name, ok, failed)
+	}
+
+	// Export the spans and the final metrics before the process exits
+	flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout())
+	defer cancel()
+	if err := shutdownTelemetry(flushCtx); err != nil {
+		log.Warnf("failed to flush telemetry: %v", err)
+	}
+	log.Info("demo complete")
+}
+
+// playPhase runs the clients of a phase for duration and counts the
+// outcomes.
+func playPhase(ctx context.Context, client *http.Client, target string,
+	phase demoPhase, duration time.Duration) (int, int) {
+
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	var mu sync.Mutex
+	var ok, failed int
+	var wg sync.WaitGroup
+	for worker := 0; worker < phase.concurrency; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			ticker := time.NewTicker(phase.interval)
+			defer ticker.Stop()
+			for n := worker; ; n++ {
+				name := phase.names[n%len(phase.names)]
+				err := demoRequest(ctx, client, target, name)
+				mu.Lock()
+				if err != nil {
+					failed++
+				} else {
+					ok++
+				}
+				mu.Unlock()
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	return ok, failed
+}
+
+func demoRequest(ctx context.Context, client *http.Client, target, name string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		target+"/hello/"+url.PathEscape(name), nil)
+	if err != nil {
+		return err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return nil
+}
+
+// demoDatabaseErrors sets the error rate of the target's database chaos,
+// so requests fail with server errors too, and returns a function setting
+// it back. The target must run with DB_CHAOS=true, and DEMO_ADMIN_KEY is
+// sent as its admin API key.
+func demoDatabaseErrors(ctx context.Context, client *http.Client, target string, rate float64) (func(), error) {
+	previous, err := demoChaosRequest(ctx, client, target, http.MethodGet, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := demoChaosRequest(ctx, client, target, http.MethodPut, &chaosConfig{ErrorRate: rate}); err != nil {
+		return nil, err
+	}
+	return func() {
+		// Restore even when the demo was interrupted
+		ctx := context.WithoutCancel(ctx)
+		if _, err := demoChaosRequest(ctx, client, target, http.MethodPut, &chaosConfig{ErrorRate: previous.ErrorRate}); err != nil {
+			log.Warnf("failed to restore the database error rate: %v", err)
+		}
+	}, nil
+}
+
+// demoChaosRequest gets /admin/db-chaos, or with a config puts its error
+// rate, and returns the resulting configuration.
+func demoChaosRequest(ctx context.Context, client *http.Client, target, method string, config *chaosConfig) (chaosConfig, error) {
+	var body io.Reader
+	if config != nil {
+		body = strings.NewReader(fmt.Sprintf(`{"error_rate":%v}`, config.ErrorRate))
+	}
+	request, err := http.NewRequestWithContext(ctx, method, target+"/admin/db-chaos", body)
+	if err != nil {
+		return chaosConfig{}, err
+	}
+	if key := os.Getenv("DEMO_ADMIN_KEY"); key != "" {
+		request.Header.Set(adminKeyHeader, key)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return chaosConfig{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return chaosConfig{}, fmt.Errorf("/admin/db-chaos answered %s", response.Status)
+	}
+	var current chaosConfig
+	err = json.NewDecoder(response.Body).Decode(&current)
+	return current, err
+}
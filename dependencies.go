@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/metrics"
+)
+
+var dependencyKey = attribute.Key("app.dependency")
+
+// dependencies is set once the service is initialized and backs the
+// /admin/dependencies report.
+var dependencies *dependencyMonitor
+
+// dependencyCheck reports whether a dependency is usable right now.
+type dependencyCheck func(ctx context.Context) error
+
+// dependencyStatus is the outcome of the latest probes of a dependency.
+type dependencyStatus struct {
+	Status      string    `json:"status"`
+	LatencyMS   float64   `json:"latency_ms"`
+	CheckedAt   time.Time `json:"checked_at"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitempty"`
+}
+
+// dependencyMonitor probes every dependency of the service in the
+// background every DEPENDENCY_PROBE_INTERVAL. Each probe is a span of its
+// own and is recorded in the dependency.latency and dependency.up metrics,
+// so a failing integration shows up in Elastic as well as in the report.
+type dependencyMonitor struct {
+	interval time.Duration
+	checks   map[string]dependencyCheck
+	latency  metric.Float64Histogram
+
+	mu       sync.Mutex
+	statuses map[string]dependencyStatus
+}
+
+func newDependencyMonitor(checks map[string]dependencyCheck) (*dependencyMonitor, error) {
+	monitor := &dependencyMonitor{
+		interval: envInterval("DEPENDENCY_PROBE_INTERVAL", 30*time.Second),
+		checks:   checks,
+		statuses: make(map[string]dependencyStatus),
+	}
+	var err error
+	monitor.latency, err = metrics.DependencyLatency.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	_, err = metrics.DependencyUp.New(meter, func(_ context.Context, o metric.Int64Observer) error {
+		for name, status := range monitor.report() {
+			up := int64(0)
+			if status.Status == "up" {
+				up = 1
+			}
+			o.Observe(up, metric.WithAttributes(dependencyKey.String(name)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return monitor, nil
+}
+
+// run probes all dependencies every interval until ctx is cancelled.
+func (m *dependencyMonitor) run(ctx context.Context) {
+	ticker := clk.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for name, check := range m.checks {
+			wg.Add(1)
+			go func(name string, check dependencyCheck) {
+				defer wg.Done()
+				m.probe(ctx, name, check)
+			}(name, check)
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+func (m *dependencyMonitor) probe(ctx context.Context, name string, check dependencyCheck) {
+	ctx, cancel := context.WithTimeout(ctx, m.interval)
+	defer cancel()
+	ctx, span := tracer.Start(ctx, "probe "+name, trace.WithAttributes(dependencyKey.String(name)))
+	defer span.End()
+
+	start := clk.Now()
+	err := check(ctx)
+	elapsed := clk.Since(start)
+	latency := float64(elapsed) / float64(time.Millisecond)
+	m.latency.Record(ctx, latency, metric.WithAttributes(dependencyKey.String(name)))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := m.statuses[name]
+	wasDown := status.Status == "down"
+	status.Status = "up"
+	status.LatencyMS = latency
+	status.CheckedAt = clk.Now()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		if !wasDown {
+			log.WithField("dependency", name).Warnf("dependency unhealthy: %v", err)
+		}
+		status.Status = "down"
+		status.LastError = err.Error()
+		status.LastErrorAt = status.CheckedAt
+	}
+	if err == nil && wasDown {
+		log.WithField("dependency", name).Info("dependency healthy again")
+	}
+	m.statuses[name] = status
+}
+
+// report returns the latest status of every dependency probed so far.
+func (m *dependencyMonitor) report() map[string]dependencyStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	report := make(map[string]dependencyStatus, len(m.statuses))
+	for name, status := range m.statuses {
+		report[name] = status
+	}
+	return report
+}
+
+func dependenciesHandler(writer http.ResponseWriter, request *http.Request) {
+	if dependencies == nil {
+		http.Error(writer, "dependency probes are not running", http.StatusServiceUnavailable)
+		return
+	}
+	report := dependencies.report()
+	writer.Header().Add("Content-Type", "application/json")
+	for _, status := range report {
+		if status.Status != "up" {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			break
+		}
+	}
+	json.NewEncoder(writer).Encode(report)
+}
+
+// dependencyChecks returns the checks of the database, the OTLP endpoint
+// and of the downstream HTTP services, caches and queues listed as
+// name=url in DEPENDENCY_HTTP and as name=host:port in DEPENDENCY_TCP.
+func dependencyChecks() map[string]dependencyCheck {
+	checks := map[string]dependencyCheck{
+		"database": func(ctx context.Context) error {
+			if db == nil {
+				return nil
+			}
+			return db.PingContext(ctx)
+		},
+	}
+	if endpoint := exporterEndpoint(); endpoint != "" && !telemetryDisabled {
+		checks["otlp"] = dialCheck(endpoint)
+	}
+	client := &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+	for name, url := range envPairs("DEPENDENCY_HTTP") {
+		checks[name] = httpCheck(client, url)
+	}
+	for name, address := range envPairs("DEPENDENCY_TCP") {
+		checks[name] = dialCheck(address)
+	}
+	return checks
+}
+
+// dialCheck succeeds when a TCP connection to address can be opened.
+func dialCheck(address string) dependencyCheck {
+	return func(ctx context.Context) error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// httpCheck succeeds when a GET of url answers with a status below 500.
+func httpCheck(client *http.Client, url string) dependencyCheck {
+	return func(ctx context.Context) error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		response, err := client.Do(request)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("%s answered %s", url, response.Status)
+		}
+		return nil
+	}
+}
+
+// dependencyNames lists the probed dependencies for the startup log.
+func dependencyNames(checks map[string]dependencyCheck) string {
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+
+	"otel-with-golang/metrics"
+)
+
+const (
+	// sdkDebugVerbosity is the logr level of the SDK debug messages, one of
+	// which carries the total number of dropped spans.
+	sdkDebugVerbosity = 8
+)
+
+// dropMonitor makes telemetry loss visible. The batch span processor drops
+// spans silently when its queue is full and only mentions the running total
+// in a debug message, so the monitor installs an OpenTelemetry logger that
+// picks that total up, and checks it periodically. SDK errors, such as
+// failed exports, are logged and counted through the global error handler.
+type dropMonitor struct {
+	totalDropped atomic.Int64
+	reported     int64
+	dropped      metric.Int64Counter
+	errors       metric.Int64Counter
+}
+
+func newDropMonitor() (*dropMonitor, error) {
+	monitor := &dropMonitor{}
+	var err error
+	monitor.dropped, err = metrics.DroppedSpans.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	monitor.errors, err = metrics.TelemetryErrors.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	otel.SetLogger(logr.New(&sdkLogSink{monitor: monitor}))
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		monitor.errors.Add(context.Background(), 1)
+		telemetryLog.Warnf("OpenTelemetry error: %v", err)
+	}))
+	return monitor, nil
+}
+
+// run checks for newly dropped spans every interval until ctx is cancelled.
+func (m *dropMonitor) run(ctx context.Context, interval time.Duration) {
+	ticker := clk.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		m.check(ctx)
+	}
+}
+
+func (m *dropMonitor) check(ctx context.Context) {
+	total := m.totalDropped.Load()
+	if total <= m.reported {
+		return
+	}
+	m.dropped.Add(ctx, total-m.reported)
+	telemetryLog.WithField("total_dropped", total).
+		Warnf("batch span processor dropped %d spans, consider a larger SPAN_QUEUE_SIZE or a faster exporter", total-m.reported)
+	m.reported = total
+}
+
+// sdkLogSink receives the internal log of the OpenTelemetry SDK. It keeps
+// the dropped span total of the batch span processor and forwards errors
+// to logrus; the rest of the debug output is discarded.
+type sdkLogSink struct {
+	monitor *dropMonitor
+}
+
+func (s *sdkLogSink) Init(logr.RuntimeInfo) {}
+
+func (s *sdkLogSink) Enabled(level int) bool {
+	return level <= sdkDebugVerbosity
+}
+
+func (s *sdkLogSink) Info(level int, msg string, keysAndValues ...interface{}) {
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		if keysAndValues[i] != "total_dropped" {
+			continue
+		}
+		if total, ok := keysAndValues[i+1].(uint32); ok {
+			s.monitor.totalDropped.Store(int64(total))
+		}
+	}
+}
+
+func (s *sdkLogSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	telemetryLog.WithField("error", err).Errorf("OpenTelemetry: %s", msg)
+}
+
+func (s *sdkLogSink) WithValues(keysAndValues ...interface{}) logr.LogSink { return s }
+
+func (s *sdkLogSink) WithName(name string) logr.LogSink { return s }
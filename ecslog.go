@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ecsVersion is the version of the Elastic Common Schema the log entries
+// follow.
+const ecsVersion = "1.6.0"
+
+// ecsFormatter writes log entries as ECS documents, with the dotted field
+// names nested into objects, so Elasticsearch maps them correctly without
+// an ingest pipeline.
+type ecsFormatter struct {
+	environment string
+}
+
+func newECSFormatter() *ecsFormatter {
+	return &ecsFormatter{environment: deploymentEnvironment()}
+}
+
+func (f *ecsFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	doc := map[string]interface{}{}
+	setECSField(doc, "@timestamp", entry.Time.UTC().Format(time.RFC3339Nano))
+	setECSField(doc, "log.level", entry.Level.String())
+	setECSField(doc, "message", entry.Message)
+	setECSField(doc, "ecs.version", ecsVersion)
+	setECSField(doc, "service.name", serviceName)
+	setECSField(doc, "service.version", serviceVersion)
+	setECSField(doc, "service.environment", f.environment)
+	setECSField(doc, "event.dataset", serviceName+".log")
+	if entry.HasCaller() {
+		setECSField(doc, "log.origin.function", entry.Caller.Function)
+		setECSField(doc, "log.origin.file.name", entry.Caller.File)
+		setECSField(doc, "log.origin.file.line", entry.Caller.Line)
+	}
+	for key, value := range entry.Data {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		if key == logrus.ErrorKey {
+			key = "error.message"
+		}
+		setECSField(doc, key, value)
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// setECSField sets the dotted key in doc, nesting an object for each of
+// its parts. A key whose prefix already holds a value is kept flat rather
+// than overwriting it.
+func setECSField(doc map[string]interface{}, key string, value interface{}) {
+	parts := strings.Split(key, ".")
+	object := doc
+	for i, part := range parts[:len(parts)-1] {
+		switch child := object[part].(type) {
+		case map[string]interface{}:
+			object = child
+		case nil:
+			nested := map[string]interface{}{}
+			object[part] = nested
+			object = nested
+		default:
+			object[strings.Join(parts[i:], ".")] = value
+			return
+		}
+	}
+	object[parts[len(parts)-1]] = value
+}
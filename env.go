@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envDuration reads a duration such as "30s" from the environment,
+// falling back to def when the variable is unset or malformed.
+func envDuration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.WithField("key", key).Warnf("invalid duration %q, using %v", value, def)
+		return def
+	}
+	return d
+}
+
+// envInterval reads a duration like envDuration for the period of a
+// ticker, falling back to def when it is not positive too, which the
+// ticker would panic on.
+func envInterval(key string, def time.Duration) time.Duration {
+	d := envDuration(key, def)
+	if d <= 0 {
+		log.WithField("key", key).Warnf("interval %v is not positive, using %v", d, def)
+		return def
+	}
+	return d
+}
+
+// envInt reads an integer from the environment, falling back to def when
+// the variable is unset or malformed.
+func envInt(key string, def int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.WithField("key", key).Warnf("invalid integer %q, using %d", value, def)
+		return def
+	}
+	return n
+}
+
+// envFloat reads a floating point number from the environment, falling
+// back to def when the variable is unset or malformed.
+func envFloat(key string, def float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.WithField("key", key).Warnf("invalid number %q, using %v", value, def)
+		return def
+	}
+	return f
+}
+
+// envBool reads a boolean such as "true" or "1" from the environment,
+// falling back to def when the variable is unset or malformed.
+func envBool(key string, def bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.WithField("key", key).Warnf("invalid boolean %q, using %v", value, def)
+		return def
+	}
+	return b
+}
+
+// envPairs reads a list such as "a=1,b=2" from the environment. Values are
+// split at their first "=", so they may contain more; entries without "="
+// or a key are skipped with a warning.
+func envPairs(key string) map[string]string {
+	pairs := make(map[string]string)
+	list := os.Getenv(key)
+	if list == "" {
+		return pairs
+	}
+	for _, item := range strings.Split(list, ",") {
+		name, value, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			log.WithField("key", key).Warnf("ignoring malformed entry %q", item)
+			continue
+		}
+		pairs[name] = strings.TrimSpace(value)
+	}
+	return pairs
+}
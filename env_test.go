@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEnvPairs(t *testing.T) {
+	tests := []struct {
+		value string
+		want  map[string]string
+	}{
+		{"", map[string]string{}},
+		{"a=high,b=low", map[string]string{"a": "high", "b": "low"}},
+		{"key==abc=,missing,=orphan, c = normal ", map[string]string{"key": "=abc=", "c": "normal"}},
+		{"api=http://example.com/health?a=b&c=d", map[string]string{"api": "http://example.com/health?a=b&c=d"}},
+	}
+	for _, test := range tests {
+		t.Setenv("TEST_PAIRS", test.value)
+		if got := envPairs("TEST_PAIRS"); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("envPairs(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestEnvIntervalFallsBackWhenNotPositive(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"":    5 * time.Second,
+		"2s":  2 * time.Second,
+		"0":   5 * time.Second,
+		"-1s": 5 * time.Second,
+	} {
+		t.Setenv("WATCH_HEARTBEAT", value)
+		if got := envInterval("WATCH_HEARTBEAT", 5*time.Second); got != want {
+			t.Errorf("envInterval(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
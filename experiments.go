@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	experimentIDKey      = attribute.Key("experiment.id")
+	experimentVariantKey = attribute.Key("experiment.variant")
+)
+
+var experimentSet *experiments
+
+// experiments are the A/B experiments run on hello responses, loaded from
+// the YAML file named by EXPERIMENTS_FILE. See experiments.yaml.
+type experiments struct {
+	Experiments []experiment `yaml:"experiments"`
+
+	mu       sync.Mutex
+	assigned map[string]map[string]int64
+}
+
+// experiment splits the names into variants in proportion to their weights.
+type experiment struct {
+	ID       string    `yaml:"id"`
+	Variants []variant `yaml:"variants"`
+}
+
+// variant replaces the default greeting with Message, when set. Its first
+// %d is replaced by the request count.
+type variant struct {
+	Name    string `yaml:"name"`
+	Weight  int    `yaml:"weight"`
+	Message string `yaml:"message"`
+}
+
+// assignment is the variant of each experiment a name falls into, in the
+// order of the experiments.
+type assignment struct {
+	ids      []string
+	variants []variant
+}
+
+func loadExperiments(path string) (*experiments, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set experiments
+	if err := yaml.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for _, experiment := range set.Experiments {
+		total := 0
+		for _, variant := range experiment.Variants {
+			if variant.Weight < 0 {
+				return nil, fmt.Errorf("variant %s of experiment %s has a negative weight", variant.Name, experiment.ID)
+			}
+			total += variant.Weight
+		}
+		if total == 0 {
+			return nil, fmt.Errorf("experiment %s has no weighted variant", experiment.ID)
+		}
+	}
+	set.assigned = make(map[string]map[string]int64)
+	return &set, nil
+}
+
+// assign buckets name into a variant of every experiment. The same name
+// always gets the same variant, so a user sees a consistent response. A nil
+// receiver assigns nothing.
+func (e *experiments) assign(name string) assignment {
+	var a assignment
+	if e == nil || !features.enabled("experiments") {
+		return a
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, experiment := range e.Experiments {
+		variant := experiment.bucket(name)
+		a.ids = append(a.ids, experiment.ID)
+		a.variants = append(a.variants, variant)
+		if e.assigned[experiment.ID] == nil {
+			e.assigned[experiment.ID] = make(map[string]int64)
+		}
+		e.assigned[experiment.ID][variant.Name]++
+	}
+	return a
+}
+
+func (e experiment) bucket(name string) variant {
+	total := 0
+	for _, variant := range e.Variants {
+		total += variant.Weight
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(e.ID + "\x00" + name))
+	point := int(hash.Sum32() % uint32(total))
+	for _, variant := range e.Variants {
+		if point < variant.Weight {
+			return variant
+		}
+		point -= variant.Weight
+	}
+	return e.Variants[len(e.Variants)-1]
+}
+
+// attributes tags spans and metrics with the experiments and variants, as
+// two lists in the same order.
+func (a assignment) attributes() []attribute.KeyValue {
+	if len(a.ids) == 0 {
+		return nil
+	}
+	names := make([]string, len(a.variants))
+	for i, variant := range a.variants {
+		names[i] = variant.Name
+	}
+	return []attribute.KeyValue{
+		experimentIDKey.StringSlice(a.ids),
+		experimentVariantKey.StringSlice(names),
+	}
+}
+
+// apply gives m the message of the first variant that has one, unless a
+// greeting rule already replaced the default greeting.
+func (a assignment) apply(m ruleMatch) ruleMatch {
+	if m.message != defaultGreeting {
+		return m
+	}
+	for _, variant := range a.variants {
+		if variant.Message != "" {
+			m.message = variant.Message
+			break
+		}
+	}
+	return m
+}
+
+// experimentsHandler reports, for each experiment, the weight of its
+// variants and how many requests each variant served so far.
+func experimentsHandler(writer http.ResponseWriter, request *http.Request) {
+	if experimentSet == nil {
+		http.Error(writer, "EXPERIMENTS_FILE is not set", http.StatusNotFound)
+		return
+	}
+	type variantReport struct {
+		Weight   int   `json:"weight"`
+		Assigned int64 `json:"assigned"`
+	}
+	report := make(map[string]map[string]variantReport)
+	experimentSet.mu.Lock()
+	for _, experiment := range experimentSet.Experiments {
+		variants := make(map[string]variantReport)
+		for _, variant := range experiment.Variants {
+			variants[variant.Name] = variantReport{
+				Weight:   variant.Weight,
+				Assigned: experimentSet.assigned[experiment.ID][variant.Name],
+			}
+		}
+		report[experiment.ID] = variants
+	}
+	experimentSet.mu.Unlock()
+	writer.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(report)
+}
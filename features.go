@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+
+	"otel-with-golang/logger"
+)
+
+// features are the behaviours that can be switched off at runtime, such as
+// during an incident, without a restart. FEATURES_DISABLED lists those off
+// at startup.
+var features = newFeatureToggles(map[string]string{
+	"webhooks":    "Deliver webhooks when a count changes.",
+	"tasks":       "Run the scheduled tasks when they are due.",
+	"experiments": "Assign names to the variants of the greeting experiments.",
+}, os.Getenv("FEATURES_DISABLED"))
+
+type featureToggle struct {
+	description string
+	enabled     atomic.Bool
+}
+
+// featureToggles holds a fixed set of features, each enabled or not.
+type featureToggles map[string]*featureToggle
+
+func newFeatureToggles(descriptions map[string]string, disabled string) featureToggles {
+	toggles := make(featureToggles, len(descriptions))
+	for name, description := range descriptions {
+		toggles[name] = &featureToggle{description: description}
+		toggles[name].enabled.Store(true)
+	}
+	for _, name := range strings.Split(disabled, ",") {
+		if toggle, ok := toggles[strings.TrimSpace(name)]; ok {
+			toggle.enabled.Store(false)
+		}
+	}
+	return toggles
+}
+
+// enabled reports whether the feature is on. Unknown features are.
+func (t featureToggles) enabled(name string) bool {
+	toggle, ok := t[name]
+	return !ok || toggle.enabled.Load()
+}
+
+type featureStatus struct {
+	Enabled     bool   `json:"enabled"`
+	Description string `json:"description"`
+}
+
+// handler lists the features, and switches those named in the JSON body
+// of a PUT, such as {"webhooks": false}.
+func (t featureToggles) handler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method == http.MethodPut {
+		var changes map[string]bool
+		if status, err := decodeBody(request, &changes); err != nil {
+			http.Error(writer, err.Error(), status)
+			return
+		}
+		var unknown []string
+		for name := range changes {
+			if _, ok := t[name]; !ok {
+				unknown = append(unknown, name)
+			}
+		}
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			http.Error(writer, fmt.Sprintf("unknown features %v", unknown), http.StatusBadRequest)
+			return
+		}
+		for name, enabled := range changes {
+			t[name].enabled.Store(enabled)
+		}
+		logger.FromContext(request.Context()).WithField("features", changes).Info("changed features")
+	}
+	report := make(map[string]featureStatus, len(t))
+	for name, toggle := range t {
+		report[name] = featureStatus{Enabled: toggle.enabled.Load(), Description: toggle.description}
+	}
+	writer.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(report)
+}
+
+// logLevelHandler shows the level of the service log, and changes it to the
+// one in the JSON body of a PUT, such as {"level": "info"}.
+func logLevelHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method == http.MethodPut {
+		var body struct {
+			Level string `json:"level"`
+		}
+		if status, err := decodeBody(request, &body); err != nil {
+			http.Error(writer, err.Error(), status)
+			return
+		}
+		level, err := logrus.ParseLevel(body.Level)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.SetLevel(level)
+		logger.FromContext(request.Context()).WithField("level", level.String()).Info("changed log level")
+	}
+	writer.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(map[string]string{"level": log.GetLevel().String()})
+}
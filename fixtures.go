@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxPendingTraces bounds the traces a fixtureProcessor buffers while
+// waiting for their root span to end.
+const maxPendingTraces = 1000
+
+var fixtureFileUnsafe = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// traceFixtures is set when TRACE_FIXTURES is and backs the
+// /admin/trace-fixtures report.
+var traceFixtures *fixtureProcessor
+
+// fixtureSpan is the canonical form of a span in a trace fixture: what the
+// instrumentation promises, without the IDs, timestamps and attribute
+// values that change from one request to the next.
+type fixtureSpan struct {
+	Name       string        `json:"name"`
+	Kind       string        `json:"kind"`
+	Status     string        `json:"status"`
+	Attributes []string      `json:"attributes,omitempty"`
+	Events     []string      `json:"events,omitempty"`
+	Children   []fixtureSpan `json:"children,omitempty"`
+}
+
+// fixtureProcessor records the span tree of the first trace of each root
+// span name into TRACE_FIXTURES_DIR (record mode), or compares every trace
+// with those golden files and reports the differences (check mode), so
+// renamed spans and lost attributes are caught by a local run of the demo.
+type fixtureProcessor struct {
+	sdktrace.SpanProcessor
+	mode string
+	dir  string
+
+	mu       sync.Mutex
+	pending  map[trace.TraceID][]sdktrace.ReadOnlySpan
+	recorded map[string]bool
+	results  map[string]string
+}
+
+func newFixtureProcessor(next sdktrace.SpanProcessor, mode, dir string) (*fixtureProcessor, error) {
+	switch mode {
+	case "record":
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	case "check":
+	default:
+		return nil, fmt.Errorf("unknown TRACE_FIXTURES mode %q, want record or check", mode)
+	}
+	return &fixtureProcessor{
+		SpanProcessor: next,
+		mode:          mode,
+		dir:           dir,
+		pending:       make(map[trace.TraceID][]sdktrace.ReadOnlySpan),
+		recorded:      make(map[string]bool),
+		results:       make(map[string]string),
+	}, nil
+}
+
+func (p *fixtureProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	p.SpanProcessor.OnEnd(s)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	traceID := s.SpanContext().TraceID()
+	if len(p.pending) >= maxPendingTraces {
+		// Traces whose root never ends would otherwise pile up
+		p.pending = make(map[trace.TraceID][]sdktrace.ReadOnlySpan)
+	}
+	p.pending[traceID] = append(p.pending[traceID], s)
+	if s.Parent().IsValid() && !s.Parent().IsRemote() {
+		return
+	}
+	spans := p.pending[traceID]
+	delete(p.pending, traceID)
+	tree := fixtureTree(s, spans)
+	file := filepath.Join(p.dir, strings.Trim(fixtureFileUnsafe.ReplaceAllString(s.Name(), "_"), "_")+".json")
+	if p.mode == "record" {
+		p.record(s.Name(), file, tree)
+	} else {
+		p.check(s.Name(), file, tree)
+	}
+}
+
+// record writes the first trace of each root span name seen in this run.
+// The caller holds p.mu.
+func (p *fixtureProcessor) record(name, file string, tree fixtureSpan) {
+	if p.recorded[name] {
+		return
+	}
+	p.recorded[name] = true
+	data, _ := json.MarshalIndent(tree, "", "  ")
+	if err := os.WriteFile(file, append(data, '\n'), 0o644); err != nil {
+		log.WithField("fixture", file).Warnf("failed to record trace fixture: %v", err)
+		return
+	}
+	p.results[name] = "recorded"
+	log.WithField("fixture", file).Infof("recorded trace fixture of %s", name)
+}
+
+// check compares tree with the golden file of name. The caller holds p.mu.
+func (p *fixtureProcessor) check(name, file string, tree fixtureSpan) {
+	golden, err := os.ReadFile(file)
+	if err != nil {
+		p.results[name] = "missing: " + err.Error()
+		return
+	}
+	data, _ := json.MarshalIndent(tree, "", "  ")
+	if diff := firstDifference(strings.TrimSpace(string(golden)), string(data)); diff != "" {
+		if !strings.HasPrefix(p.results[name], "mismatch") {
+			log.WithField("fixture", file).Warnf("trace of %s differs from its fixture: %s", name, diff)
+		}
+		p.results[name] = "mismatch: " + diff
+		return
+	}
+	if p.results[name] == "" {
+		p.results[name] = "ok"
+	}
+}
+
+// fixtureTree builds the canonical tree rooted at root out of the spans of
+// its trace. Siblings are sorted, since concurrent spans end in any order.
+func fixtureTree(root sdktrace.ReadOnlySpan, spans []sdktrace.ReadOnlySpan) fixtureSpan {
+	node := fixtureSpan{
+		Name:   root.Name(),
+		Kind:   root.SpanKind().String(),
+		Status: root.Status().Code.String(),
+	}
+	for _, kv := range root.Attributes() {
+		node.Attributes = append(node.Attributes, string(kv.Key))
+	}
+	sort.Strings(node.Attributes)
+	for _, event := range root.Events() {
+		node.Events = append(node.Events, event.Name)
+	}
+	for _, span := range spans {
+		if span.Parent().SpanID() == root.SpanContext().SpanID() {
+			node.Children = append(node.Children, fixtureTree(span, spans))
+		}
+	}
+	sort.Slice(node.Children, func(i, j int) bool {
+		a, _ := json.Marshal(node.Children[i])
+		b, _ := json.Marshal(node.Children[j])
+		return string(a) < string(b)
+	})
+	return node
+}
+
+// firstDifference describes the first line where want and got differ, or
+// returns "" when they are the same.
+func firstDifference(want, got string) string {
+	wantLines, gotLines := strings.Split(want, "\n"), strings.Split(got, "\n")
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		var w, g string
+		if i < len(wantLines) {
+			w = strings.TrimSpace(wantLines[i])
+		}
+		if i < len(gotLines) {
+			g = strings.TrimSpace(gotLines[i])
+		}
+		if w != g {
+			return fmt.Sprintf("line %d: want %q, got %q", i+1, w, g)
+		}
+	}
+	return ""
+}
+
+func (p *fixtureProcessor) report() map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	report := make(map[string]string, len(p.results))
+	for name, result := range p.results {
+		report[name] = result
+	}
+	return report
+}
+
+// traceFixturesHandler reports the fixture of each root span name seen so
+// far, and answers 409 when one of them differs, so a script can fail on
+// it.
+func traceFixturesHandler(writer http.ResponseWriter, request *http.Request) {
+	if traceFixtures == nil {
+		http.Error(writer, "TRACE_FIXTURES is not set", http.StatusNotFound)
+		return
+	}
+	report := traceFixtures.report()
+	writer.Header().Add("Content-Type", "application/json")
+	for _, result := range report {
+		if strings.HasPrefix(result, "mismatch") {
+			writer.WriteHeader(http.StatusConflict)
+			break
+		}
+	}
+	json.NewEncoder(writer).Encode(report)
+}
+
+// Shutdown logs a summary of the check before shutting down.
+func (p *fixtureProcessor) Shutdown(ctx context.Context) error {
+	if p.mode == "check" {
+		for name, result := range p.report() {
+			log.WithField("fixture", name).Infof("trace fixture %s", result)
+		}
+	}
+	return p.SpanProcessor.Shutdown(ctx)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/metrics"
+	"otel-with-golang/requestcontext"
+)
+
+var updateFixtures = flag.Bool("update-fixtures", false, "record the trace fixtures in testdata/handlers instead of checking them")
+
+// TestTraceFixtures serves the greeting and stats routes with the memory
+// repository and compares the traces of their handlers with the golden
+// files, as a TRACE_FIXTURES=check run of the service would. They are kept
+// apart from testdata/traces, which the service records into with its
+// whole middleware pipeline. Run it with -update-fixtures after changing
+// the instrumentation on purpose.
+func TestTraceFixtures(t *testing.T) {
+	mode := "check"
+	if *updateFixtures {
+		mode = "record"
+	}
+	fixtures, err := newFixtureProcessor(tracetest.NewSpanRecorder(), mode, "testdata/handlers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(fixtures))
+	defer provider.Shutdown(context.Background())
+
+	previousTracer, previousRepository := tracer, repository
+	previousCounter, previousEncoder := numberOfExec, responseJSON
+	t.Cleanup(func() {
+		tracer, repository = previousTracer, previousRepository
+		numberOfExec, responseJSON = previousCounter, previousEncoder
+	})
+	tracer = provider.Tracer("io.opentelemetry.traces.hello")
+	repository = newMemoryStatsRepository()
+	if numberOfExec, err = metrics.NumberOfExec.New(meter); err != nil {
+		t.Fatal(err)
+	}
+	if responseJSON, err = newJSONEncoder(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A server span named after the route, as otelmux starts it
+	router := mux.NewRouter()
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			route, _ := mux.CurrentRoute(request).GetPathTemplate()
+			ctx, span := tracer.Start(request.Context(), route, trace.WithSpanKind(trace.SpanKindServer))
+			defer span.End()
+			next.ServeHTTP(writer, request.WithContext(ctx))
+		})
+	}, requestcontext.Middleware)
+	router.HandleFunc("/hello/{name}", hello)
+	router.HandleFunc("/stats/{name}", countStats)
+
+	for _, path := range []string{"/hello/zoe", "/stats/zoe"} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("GET %s answered %d", path, recorder.Code)
+		}
+	}
+
+	report := fixtures.report()
+	for _, route := range []string{"/hello/{name}", "/stats/{name}"} {
+		if result := report[route]; result != "ok" && result != "recorded" {
+			t.Errorf("trace of %s: %s", route, result)
+		}
+	}
+}
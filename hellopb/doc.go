@@ -0,0 +1,5 @@
+// Package hellopb holds the protobuf form of the hello API response,
+// served to clients that send "Accept: application/x-protobuf".
+package hellopb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative hello.proto
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/quic-go/quic-go/http3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var protocolKey = attribute.Key("app.http.protocol")
+
+// serveHTTP3 serves handler over TLS on HTTP3_ADDR, with HTTP/3 on the UDP
+// port and HTTP/1.1 and HTTP/2 on the TCP port of the same number. The TCP
+// responses advertise HTTP/3 through Alt-Svc, so clients that support it
+// switch over and the three protocols can be compared for one endpoint.
+// It does nothing unless HTTP3_ADDR is set. The returned function shuts
+// both servers down.
+func serveHTTP3(handler http.Handler) func(ctx context.Context) error {
+	addr := os.Getenv("HTTP3_ADDR")
+	if addr == "" {
+		return func(context.Context) error { return nil }
+	}
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to configure TLS", err)
+	}
+
+	listener, err := listen(addr, "tls")
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to listen", err)
+	}
+	quicServer := &http3.Server{Addr: addr, Handler: handler, TLSConfig: tlsConfig}
+	tlsServer := &http.Server{
+		ErrorLog:  listener.errorLog(),
+		TLSConfig: tlsConfig.Clone(),
+		Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			quicServer.SetQUICHeaders(writer.Header())
+			handler.ServeHTTP(writer, request)
+		}),
+	}
+	go func() {
+		if err := quicServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	go func() {
+		if err := tlsServer.ServeTLS(listener, "", ""); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	log.Infof("serving HTTP/3 and TLS on %s", addr)
+	return func(ctx context.Context) error {
+		return errors.Join(quicServer.Close(), tlsServer.Shutdown(ctx))
+	}
+}
+
+// recordProtocol records the negotiated protocol, such as HTTP/1.1, HTTP/2.0
+// or HTTP/3.0, on the server span.
+func recordProtocol(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		trace.SpanFromContext(request.Context()).SetAttributes(protocolKey.String(request.Proto))
+		next.ServeHTTP(writer, request)
+	})
+}
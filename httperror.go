@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/logger"
+)
+
+// errorBody is the JSON body of error responses. It carries the trace ID
+// of the request, so a client reporting an error points at its trace.
+type errorBody struct {
+	Error   string `json:"error"`
+	TraceID string `json:"trace_id,omitempty"`
+}
+
+// writeError answers request with status and a JSON errorBody.
+func writeError(writer http.ResponseWriter, request *http.Request, status int, message string) {
+	body := errorBody{Error: message}
+	if spanContext := trace.SpanContextFromContext(request.Context()); spanContext.HasTraceID() {
+		body.TraceID = spanContext.TraceID().String()
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(body)
+}
+
+// failRequest answers request with status and records err on its span,
+// setting the span status to error, so the failure shows up in the APM UI.
+// Client errors carry the message of err; server errors only the status
+// text, their details being on the span and in the error log, which keeps
+// them when telemetry is disabled.
+func failRequest(writer http.ResponseWriter, request *http.Request, status int, err error) {
+	span := trace.SpanFromContext(request.Context())
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	message := err.Error()
+	if status >= http.StatusInternalServerError {
+		logger.FromContext(request.Context()).WithError(err).Errorf("request failed with status %d", status)
+		message = strings.ToLower(http.StatusText(status))
+	}
+	writeError(writer, request, status, message)
+}
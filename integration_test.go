@@ -0,0 +1,234 @@
+//go:build integration
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The integration tests run the service against Elasticsearch and APM
+// Server in containers and check what got indexed. They need Docker:
+//
+//	go test -tags integration -run TestElasticStack -timeout 15m
+//
+// ELASTIC_STACK_VERSION picks the version of the images.
+
+// TestElasticStack greets a few names, fails one request, and checks that
+// the transactions, spans, errors and metrics reached Elasticsearch with
+// the fields Kibana relies on.
+func TestElasticStack(t *testing.T) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker is not installed")
+	}
+	version := os.Getenv("ELASTIC_STACK_VERSION")
+	if version == "" {
+		version = "8.15.3"
+	}
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	network := "hello-it-" + suffix
+	docker(t, "network", "create", network)
+	t.Cleanup(func() { exec.Command("docker", "network", "rm", network).Run() })
+
+	elasticsearch := startContainer(t, "hello-it-es-"+suffix,
+		"--network", network, "--network-alias", "elasticsearch",
+		"-e", "discovery.type=single-node",
+		"-e", "xpack.security.enabled=false",
+		"-e", "ES_JAVA_OPTS=-Xms512m -Xmx512m",
+		"-p", "127.0.0.1::9200",
+		"docker.elastic.co/elasticsearch/elasticsearch:"+version)
+	esURL := "http://" + containerAddress(t, elasticsearch, "9200/tcp")
+	waitForHTTP(t, esURL+"/_cluster/health?wait_for_status=yellow", 3*time.Minute)
+
+	apmServer := startContainer(t, "hello-it-apm-"+suffix,
+		"--network", network,
+		"-p", "127.0.0.1::8200",
+		"docker.elastic.co/apm/apm-server:"+version,
+		"-e", "-E", "apm-server.host=0.0.0.0:8200",
+		"-E", `output.elasticsearch.hosts=["elasticsearch:9200"]`)
+	apmAddress := containerAddress(t, apmServer, "8200/tcp")
+	waitForHTTP(t, "http://"+apmAddress+"/", 3*time.Minute)
+
+	// The service exports over plaintext OTLP/gRPC, flushing often
+	binary := filepath.Join(t.TempDir(), "hello-app")
+	if output, err := exec.Command("go", "build", "-o", binary, ".").CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, output)
+	}
+	app := exec.Command(binary)
+	app.Env = append(os.Environ(),
+		"OTEL_EXPORTER_OTLP_ENDPOINT=http://"+apmAddress,
+		"EXPORTER_INSECURE=true",
+		"METRIC_EXPORT_INTERVAL=1s",
+		"SPAN_BATCH_TIMEOUT=100ms",
+	)
+	var logs bytes.Buffer
+	app.Stdout, app.Stderr = &logs, &logs
+	if err := app.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if t.Failed() {
+			t.Logf("service logs:\n%s", logs.String())
+		}
+	}()
+	waitForHTTP(t, "http://localhost:9000/healthz", time.Minute)
+
+	for _, name := range []string{"alice", "bob", "alice"} {
+		if status := getStatus(t, "http://localhost:9000/hello/"+name); status != http.StatusOK {
+			t.Errorf("GET /hello/%s answered %d", name, status)
+		}
+	}
+	// A name with a control character fails with a recorded error
+	if status := getStatus(t, "http://localhost:9000/hello/bob%7F"); status != http.StatusBadRequest {
+		t.Errorf("GET /hello/bob%%7F answered %d, want 400", status)
+	}
+	// Draining flushes the spans and the last metrics
+	app.Process.Signal(syscall.SIGTERM)
+	if err := app.Wait(); err != nil {
+		t.Fatalf("service exited with %v", err)
+	}
+
+	for _, test := range []struct {
+		index  string
+		event  string
+		filter map[string]string
+		fields []string
+	}{
+		{"traces-apm*", "transaction", nil, []string{"transaction.name", "transaction.duration.us", "transaction.result", "trace.id"}},
+		{"traces-apm*", "span", map[string]string{"span.name": "updateRequestCount"}, []string{"span.duration.us", "parent.id", "trace.id"}},
+		{"logs-apm.error*", "error", nil, []string{"error.exception", "trace.id", "transaction.id"}},
+		{"metrics-apm*", "metric", nil, []string{"metricset.name", "@timestamp"}},
+	} {
+		t.Run(test.event, func(t *testing.T) {
+			source := searchDocument(t, esURL, test.index, test.event, test.filter)
+			for _, field := range test.fields {
+				if _, ok := documentField(source, field); !ok {
+					t.Errorf("%s document has no %s: %v", test.event, field, source)
+				}
+			}
+		})
+	}
+}
+
+// docker runs a docker command and returns its trimmed output.
+func docker(t *testing.T, args ...string) string {
+	t.Helper()
+	output, err := exec.Command("docker", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("docker %s: %v\n%s", strings.Join(args, " "), err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// startContainer starts a container named name, removed with the test.
+func startContainer(t *testing.T, name string, args ...string) string {
+	t.Helper()
+	docker(t, append([]string{"run", "--detach", "--name", name}, args...)...)
+	t.Cleanup(func() {
+		if t.Failed() {
+			output, _ := exec.Command("docker", "logs", "--tail", "50", name).CombinedOutput()
+			t.Logf("%s logs:\n%s", name, output)
+		}
+		exec.Command("docker", "rm", "--force", name).Run()
+	})
+	return name
+}
+
+// containerAddress returns the host address port of container is
+// published on.
+func containerAddress(t *testing.T, container, port string) string {
+	t.Helper()
+	address, _, _ := strings.Cut(docker(t, "port", container, port), "\n")
+	return address
+}
+
+// waitForHTTP waits until url answers 200.
+func waitForHTTP(t *testing.T, url string, timeout time.Duration) {
+	t.Helper()
+	client := &http.Client{Timeout: 5 * time.Second}
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(time.Second) {
+		response, err := client.Get(url)
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode == http.StatusOK {
+				return
+			}
+		}
+	}
+	t.Fatalf("%s did not answer within %v", url, timeout)
+}
+
+func getStatus(t *testing.T, url string) int {
+	t.Helper()
+	response, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	return response.StatusCode
+}
+
+// searchDocument waits for a document of the service with processor.event
+// event and the filter terms to be indexed, and returns its source.
+func searchDocument(t *testing.T, esURL, index, event string, filter map[string]string) map[string]interface{} {
+	t.Helper()
+	terms := []interface{}{
+		map[string]interface{}{"term": map[string]string{"service.name": serviceName}},
+		map[string]interface{}{"term": map[string]string{"processor.event": event}},
+	}
+	for field, value := range filter {
+		terms = append(terms, map[string]interface{}{"term": map[string]string{field: value}})
+	}
+	query, _ := json.Marshal(map[string]interface{}{
+		"size":  1,
+		"query": map[string]interface{}{"bool": map[string]interface{}{"filter": terms}},
+	})
+	for deadline := time.Now().Add(2 * time.Minute); time.Now().Before(deadline); time.Sleep(2 * time.Second) {
+		response, err := http.Post(esURL+"/"+index+"/_search", "application/json", bytes.NewReader(query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result struct {
+			Hits struct {
+				Hits []struct {
+					Source map[string]interface{} `json:"_source"`
+				} `json:"hits"`
+			} `json:"hits"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err == nil && len(result.Hits.Hits) > 0 {
+			return result.Hits.Hits[0].Source
+		}
+	}
+	t.Fatalf("no %s document of %s indexed in %s", event, serviceName, index)
+	return nil
+}
+
+// documentField looks a dotted field up in source, whether it was indexed
+// as nested objects or with a dotted key.
+func documentField(source map[string]interface{}, field string) (interface{}, bool) {
+	if value, ok := source[field]; ok {
+		return value, true
+	}
+	for prefix, rest, ok := strings.Cut(field, "."); ok; {
+		if nested, isObject := source[prefix].(map[string]interface{}); isObject {
+			if value, found := documentField(nested, rest); found {
+				return value, true
+			}
+		}
+		var next string
+		next, rest, ok = strings.Cut(rest, ".")
+		prefix += "." + next
+	}
+	return nil, false
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/logger"
+)
+
+// respondAsync is the Prefer header value asking for a 202 Accepted and a
+// status URL instead of waiting for the result.
+const respondAsync = "respond-async"
+
+var jobIDKey = attribute.Key("app.job.id")
+
+var jobs = newJobStore(envDuration("JOB_RETENTION", 10*time.Minute),
+	envDuration("JOB_TIMEOUT", time.Minute), int(envInt("JOB_MAX_RUNNING", 100)))
+
+// errTooManyJobs is returned when as many jobs are running as allowed.
+var errTooManyJobs = errors.New("too many jobs running")
+
+// job is an operation accepted with 202 and processed in the background.
+type job struct {
+	ID       string     `json:"id"`
+	Status   string     `json:"status"`
+	Message  string     `json:"message,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Accepted time.Time  `json:"accepted"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	spanContext trace.SpanContext
+}
+
+// jobStore keeps jobs for retention after they finish so their status can
+// still be polled. At most maxRunning jobs run at once, each for at most
+// timeout.
+type jobStore struct {
+	retention time.Duration
+	timeout   time.Duration
+	slots     chan struct{}
+	running   sync.WaitGroup
+	mu        sync.Mutex
+	jobs      map[string]*job
+}
+
+func newJobStore(retention, timeout time.Duration, maxRunning int) *jobStore {
+	return &jobStore{
+		retention: retention,
+		timeout:   timeout,
+		slots:     make(chan struct{}, max(maxRunning, 1)),
+		jobs:      make(map[string]*job),
+	}
+}
+
+// start runs work in the background as a job with a trace of its own,
+// linked to the request that accepted it. The job keeps the values of ctx
+// but not its cancellation or deadline, which end with the request, and
+// gets a deadline of its own. It returns errTooManyJobs instead when all
+// the slots are taken.
+func (s *jobStore) start(ctx context.Context, name string,
+	work func(ctx context.Context) (string, error)) (job, error) {
+
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		return job{}, errTooManyJobs
+	}
+	// Holding a slot, the job runs right away
+	j := &job{ID: newJobID(), Status: "running", Accepted: clk.Now()}
+	jobCtx, span := tracer.Start(context.WithoutCancel(ctx), "job "+name,
+		trace.WithNewRoot(),
+		trace.WithLinks(trace.LinkFromContext(ctx)),
+		trace.WithAttributes(jobIDKey.String(j.ID)))
+	jobCtx = logger.WithTransaction(jobCtx)
+	j.spanContext = span.SpanContext()
+	trace.SpanFromContext(ctx).SetAttributes(jobIDKey.String(j.ID))
+
+	s.mu.Lock()
+	s.prune()
+	s.jobs[j.ID] = j
+	accepted := *j
+	s.mu.Unlock()
+
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		defer func() { <-s.slots }()
+		defer span.End()
+		jobCtx, cancel := context.WithTimeout(jobCtx, s.timeout)
+		defer cancel()
+		message, err := runJob(jobCtx, work)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		finished := clk.Now()
+		j.Finished = &finished
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			j.Status, j.Error = "failed", err.Error()
+			return
+		}
+		j.Status, j.Message = "done", message
+	}()
+	return accepted, nil
+}
+
+// runJob turns a panic of work into an error, since there is no request
+// left to fail.
+func runJob(ctx context.Context, work func(ctx context.Context) (string, error)) (message string, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("%v", recovered)
+		}
+	}()
+	return work(ctx)
+}
+
+// wait returns once the running jobs are finished, or with the error of
+// ctx when it is done first.
+func (s *jobStore) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// get returns a copy of the job with the given ID.
+func (s *jobStore) get(id string) (job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	return *j, true
+}
+
+// prune forgets the jobs that finished more than retention ago. The caller
+// holds s.mu.
+func (s *jobStore) prune() {
+	for id, j := range s.jobs {
+		if j.Finished != nil && clk.Since(*j.Finished) > s.retention {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+func newJobID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// acceptJob answers 202 with the status URL of j.
+func acceptJob(writer http.ResponseWriter, j job) {
+	writer.Header().Add("Content-Type", "application/json")
+	writer.Header().Add("Location", basePath+"/jobs/"+j.ID)
+	writer.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(writer).Encode(j)
+}
+
+// jobStatus reports a job and links the polling request to the trace of
+// the job, so the polls show up next to the work they waited for.
+func jobStatus(writer http.ResponseWriter, request *http.Request) {
+	j, ok := jobs.get(mux.Vars(request)["id"])
+	if !ok {
+		http.Error(writer, "unknown job", http.StatusNotFound)
+		return
+	}
+	span := trace.SpanFromContext(request.Context())
+	span.AddLink(trace.Link{SpanContext: j.spanContext})
+	span.SetAttributes(jobIDKey.String(j.ID), attribute.String("app.job.status", j.Status))
+
+	writer.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(j)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/metrics"
+	"otel-with-golang/requestcontext"
+)
+
+func TestAsyncHelloIsPolledUntilDone(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer provider.Shutdown(context.Background())
+
+	previousTracer, previousRepository, previousJobs := tracer, repository, jobs
+	previousCounter, previousEncoder := numberOfExec, responseJSON
+	t.Cleanup(func() {
+		tracer, repository, jobs = previousTracer, previousRepository, previousJobs
+		numberOfExec, responseJSON = previousCounter, previousEncoder
+	})
+	tracer = provider.Tracer("io.opentelemetry.traces.hello")
+	repository = newMemoryStatsRepository()
+	jobs = newJobStore(time.Minute, time.Minute, 10)
+	var err error
+	if numberOfExec, err = metrics.NumberOfExec.New(meter); err != nil {
+		t.Fatal(err)
+	}
+	if responseJSON, err = newJSONEncoder(); err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			route, _ := mux.CurrentRoute(request).GetPathTemplate()
+			ctx, span := tracer.Start(request.Context(), route, trace.WithSpanKind(trace.SpanKindServer))
+			defer span.End()
+			next.ServeHTTP(writer, request.WithContext(ctx))
+		})
+	}, requestcontext.Middleware)
+	router.HandleFunc("/hello/{name}", hello)
+	router.HandleFunc("/jobs/{id}", jobStatus)
+
+	request := httptest.NewRequest(http.MethodGet, "/hello/zoe", nil)
+	request.Header.Set("Prefer", respondAsync)
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("GET /hello answered %d, want 202", response.Code)
+	}
+	var accepted job
+	if err := json.NewDecoder(response.Body).Decode(&accepted); err != nil {
+		t.Fatal(err)
+	}
+	if want := basePath + "/jobs/" + accepted.ID; response.Header().Get("Location") != want {
+		t.Errorf("Location = %q, want %q", response.Header().Get("Location"), want)
+	}
+	if err := jobs.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/jobs/"+accepted.ID, nil))
+	var polled job
+	if err := json.NewDecoder(response.Body).Decode(&polled); err != nil {
+		t.Fatal(err)
+	}
+	if polled.Status != "done" || polled.Message == "" {
+		t.Errorf("polled job %+v, want it done with a message", polled)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	linksTo := func(span sdktrace.ReadOnlySpan, target sdktrace.ReadOnlySpan) bool {
+		for _, link := range span.Links() {
+			if link.SpanContext.Equal(target.SpanContext()) {
+				return true
+			}
+		}
+		return false
+	}
+	accepting, background, poll := spans["/hello/{name}"], spans["job hello"], spans["/jobs/{id}"]
+	if accepting == nil || background == nil || poll == nil {
+		t.Fatalf("spans %v, want the request, job and poll spans", spans)
+	}
+	if background.SpanContext().TraceID() == accepting.SpanContext().TraceID() || !linksTo(background, accepting) {
+		t.Error("the job is not a trace of its own linked to the request that accepted it")
+	}
+	if !linksTo(poll, background) {
+		t.Error("the poll does not link to the job")
+	}
+}
+
+func TestJobStoreBoundsRunningJobs(t *testing.T) {
+	store := newJobStore(time.Minute, time.Minute, 1)
+	release := make(chan struct{})
+	blocking, err := store.start(context.Background(), "test", func(ctx context.Context) (string, error) {
+		<-release
+		return "done", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := store.get(blocking.ID); blocking.Status != "running" || current.Status != "running" {
+		t.Errorf("accepted job %q and polled %q, want it running once it holds a slot", blocking.Status, current.Status)
+	}
+	if _, err := store.start(context.Background(), "test", func(ctx context.Context) (string, error) {
+		return "done", nil
+	}); !errors.Is(err, errTooManyJobs) {
+		t.Errorf("starting a job over the limit got %v, want %v", err, errTooManyJobs)
+	}
+	close(release)
+	if err := store.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.start(context.Background(), "test", func(ctx context.Context) (string, error) {
+		return "done", nil
+	}); err != nil {
+		t.Errorf("starting a job once the slot is free got %v", err)
+	}
+	store.wait(context.Background())
+}
+
+func TestJobStoreTimesJobsOut(t *testing.T) {
+	store := newJobStore(time.Minute, 10*time.Millisecond, 1)
+	// Cancelling the request does not cancel the job, its timeout does
+	ctx, cancel := context.WithCancel(context.Background())
+	started, err := store.start(ctx, "test", func(ctx context.Context) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	})
+	cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if finished, _ := store.get(started.ID); finished.Status != "failed" || finished.Error != context.DeadlineExceeded.Error() {
+		t.Errorf("job %+v, want it failed past its deadline", finished)
+	}
+}
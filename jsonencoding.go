@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"otel-with-golang/metrics"
+)
+
+var jsonEncoderKey = attribute.Key("app.json.encoder")
+
+// jsonEncoders are the JSON encoders built into the binary by name. The
+// high-performance ones register themselves when built with their tag,
+// such as -tags jsoniter or -tags sonic.
+var jsonEncoders = map[string]func(v any) ([]byte, error){
+	"std": json.Marshal,
+}
+
+// responseJSON encodes the JSON responses. It is set once the telemetry
+// is initialized.
+var responseJSON *jsonEncoder
+
+// jsonEncoder marshals responses with the encoder picked by JSON_ENCODER,
+// recording how long each took, so encoders can be compared under load.
+type jsonEncoder struct {
+	name     string
+	marshal  func(v any) ([]byte, error)
+	duration metric.Float64Histogram
+	attrs    metric.MeasurementOption
+}
+
+func newJSONEncoder() (*jsonEncoder, error) {
+	name := os.Getenv("JSON_ENCODER")
+	if name == "" {
+		name = "std"
+	}
+	marshal, ok := jsonEncoders[name]
+	if !ok {
+		var names []string
+		for name := range jsonEncoders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("JSON encoder %q is not built in, want one of %v", name, names)
+	}
+	duration, err := metrics.SerializationDuration.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonEncoder{
+		name:     name,
+		marshal:  marshal,
+		duration: duration,
+		attrs:    metric.WithAttributes(jsonEncoderKey.String(name)),
+	}, nil
+}
+
+// Marshal encodes v and records the time it took.
+func (e *jsonEncoder) Marshal(ctx context.Context, v any) ([]byte, error) {
+	start := clk.Now()
+	data, err := e.marshal(v)
+	e.duration.Record(ctx, milliseconds(clk.Since(start)), e.attrs)
+	return data, err
+}
@@ -0,0 +1,13 @@
+//go:build jsoniter
+
+package main
+
+import (
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Built with -tags jsoniter, JSON_ENCODER=jsoniter encodes responses with
+// json-iterator, which is compatible with encoding/json.
+func init() {
+	jsonEncoders["jsoniter"] = jsoniter.ConfigCompatibleWithStandardLibrary.Marshal
+}
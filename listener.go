@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	stdlog "log"
+	"net"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"otel-with-golang/metrics"
+)
+
+// instrumentedListener records connection level metrics, which show
+// problems HTTP telemetry cannot see, such as load balancer health checks
+// opening and dropping connections without ever sending a request.
+type instrumentedListener struct {
+	net.Listener
+	attrs    metric.MeasurementOption
+	accepted metric.Int64Counter
+	closed   metric.Int64Counter
+	active   metric.Int64UpDownCounter
+	lifetime metric.Float64Histogram
+	tlsFails metric.Int64Counter
+}
+
+// listen opens a TCP listener on addr whose metrics carry the listener
+// name, so the servers of one process can be told apart.
+func listen(addr, name string) (*instrumentedListener, error) {
+	l := &instrumentedListener{
+		attrs: metric.WithAttributes(attribute.String("listener", name)),
+	}
+	var err error
+	if l.accepted, err = metrics.ConnectionsAccepted.New(meter); err != nil {
+		return nil, err
+	}
+	if l.closed, err = metrics.ConnectionsClosed.New(meter); err != nil {
+		return nil, err
+	}
+	if l.active, err = metrics.ConnectionsActive.New(meter); err != nil {
+		return nil, err
+	}
+	if l.lifetime, err = metrics.ConnectionLifetime.New(meter); err != nil {
+		return nil, err
+	}
+	if l.tlsFails, err = metrics.TLSHandshakeFailures.New(meter); err != nil {
+		return nil, err
+	}
+	if l.Listener, err = net.Listen("tcp", addr); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *instrumentedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	l.accepted.Add(ctx, 1, l.attrs)
+	l.active.Add(ctx, 1, l.attrs)
+	return &instrumentedConn{Conn: conn, listener: l, opened: clk.Now()}, nil
+}
+
+// errorLog returns a logger for http.Server.ErrorLog that counts TLS
+// handshake failures, which net/http only reports there, and passes every
+// message on to logrus.
+func (l *instrumentedListener) errorLog() *stdlog.Logger {
+	return stdlog.New(serverErrorWriter{l}, "", 0)
+}
+
+type serverErrorWriter struct {
+	listener *instrumentedListener
+}
+
+func (w serverErrorWriter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("TLS handshake error")) {
+		w.listener.tlsFails.Add(context.Background(), 1, w.listener.attrs)
+	}
+	log.WithField(componentField, "http").Warn(string(bytes.TrimSpace(p)))
+	return len(p), nil
+}
+
+// instrumentedConn records its lifetime when closed.
+type instrumentedConn struct {
+	net.Conn
+	listener *instrumentedListener
+	opened   time.Time
+	once     sync.Once
+}
+
+func (c *instrumentedConn) Close() error {
+	c.once.Do(func() {
+		l := c.listener
+		ctx := context.Background()
+		l.closed.Add(ctx, 1, l.attrs)
+		l.active.Add(ctx, -1, l.attrs)
+		l.lifetime.Record(ctx, float64(clk.Since(c.opened))/float64(time.Millisecond), l.attrs)
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,92 @@
+// Package logger hands out log entries scoped to the span of a context, so
+// every line written while handling a request carries its trace, span,
+// route and tenant without each call site adding them.
+package logger
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/requestcontext"
+)
+
+// ECS names of the trace fields, which Kibana uses to link a log line to
+// its trace and to the transaction, the local root span, it belongs to.
+const (
+	TraceIDField       = "trace.id"
+	SpanIDField        = "span.id"
+	TransactionIDField = "transaction.id"
+)
+
+var std = logrus.StandardLogger()
+
+// SetLogger makes FromContext write through l instead of the logrus
+// standard logger.
+func SetLogger(l *logrus.Logger) {
+	std = l
+}
+
+// FromContext returns an entry carrying ctx, so TraceHook adds its trace
+// fields, with fields for the http.route of the current span and the
+// values of requestcontext. Fields that are not known are left out, so it
+// can be used outside of requests too.
+func FromContext(ctx context.Context) *logrus.Entry {
+	fields := requestcontext.Fields(ctx)
+	if span, ok := trace.SpanFromContext(ctx).(sdktrace.ReadOnlySpan); ok {
+		for _, kv := range span.Attributes() {
+			if kv.Key == semconv.HTTPRouteKey {
+				fields[string(kv.Key)] = kv.Value.AsString()
+			}
+		}
+	}
+	return std.WithContext(ctx).WithFields(fields)
+}
+
+type transactionKey struct{}
+
+// WithTransaction returns a copy of ctx recording its current span as the
+// transaction of the spans started from it.
+func WithTransaction(ctx context.Context) context.Context {
+	return context.WithValue(ctx, transactionKey{}, trace.SpanContextFromContext(ctx).SpanID())
+}
+
+// Middleware records the server span of each request as its transaction.
+// It must run after the middleware starting that span.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		next.ServeHTTP(writer, request.WithContext(WithTransaction(request.Context())))
+	})
+}
+
+// TraceHook adds the trace, span and transaction IDs of the active span to
+// every entry logged with a context, such as through log.WithContext(ctx).
+type TraceHook struct{}
+
+func (TraceHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (TraceHook) Fire(entry *logrus.Entry) error {
+	if entry.Context == nil {
+		return nil
+	}
+	span := trace.SpanFromContext(entry.Context)
+	spanContext := span.SpanContext()
+	if !spanContext.IsValid() {
+		return nil
+	}
+	entry.Data[TraceIDField] = spanContext.TraceID().String()
+	entry.Data[SpanIDField] = spanContext.SpanID().String()
+	if transaction, ok := entry.Context.Value(transactionKey{}).(trace.SpanID); ok && transaction.IsValid() {
+		entry.Data[TransactionIDField] = transaction.String()
+	} else if span, ok := span.(sdktrace.ReadOnlySpan); ok && (!span.Parent().IsValid() || span.Parent().IsRemote()) {
+		// A span without a local parent is a transaction itself
+		entry.Data[TransactionIDField] = spanContext.SpanID().String()
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"otel-with-golang/metrics"
+)
+
+const (
+	// componentField is the log field naming the part of the service that
+	// wrote an entry.
+	componentField   = "component"
+	defaultComponent = "main"
+)
+
+// telemetryLog tags the entries about the telemetry pipeline itself.
+var telemetryLog = log.WithField(componentField, "telemetry")
+
+// logMetricsHook counts every log entry, so error log rates can be charted
+// from metrics before log ingestion is set up.
+type logMetricsHook struct {
+	entries metric.Int64Counter
+}
+
+func newLogMetricsHook() (*logMetricsHook, error) {
+	entries, err := metrics.LogEntries.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	return &logMetricsHook{entries: entries}, nil
+}
+
+func (h *logMetricsHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *logMetricsHook) Fire(entry *logrus.Entry) error {
+	component := defaultComponent
+	if value, ok := entry.Data[componentField]; ok {
+		component = fmt.Sprint(value)
+	}
+	ctx := entry.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	h.entries.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("log.level", entry.Level.String()),
+		attribute.String(componentField, component)))
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	otellog "go.opentelemetry.io/otel/log"
+	"go.opentelemetry.io/otel/metric"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+
+	"otel-with-golang/metrics"
+)
+
+var logExportOutcomeKey = attribute.Key("outcome")
+
+// logStderr is unset by LOG_STDERR=false, for deployments that collect the
+// logs over OTLP only. Entries about the telemetry pipeline, which are not
+// exported, and those whose export failed still go to stderr.
+var logStderr = envBool("LOG_STDERR", true)
+
+var (
+	// logExportsMonitored is set once the log exporter is wrapped by a
+	// logExportMonitor, which takes the records counted in logsPending.
+	logExportsMonitored atomic.Bool
+	// logsPending counts the records emitted by the OTLP hook that the
+	// exporter has not taken yet: those waiting in the batch queue, and
+	// those the queue dropped when full.
+	logsPending atomic.Int64
+)
+
+// logExportMonitor counts the log records exported and failed, and reports
+// how many are pending, so a broken log pipeline shows up in the metrics
+// even though the logs about it cannot get through. When stderr output is
+// off, the records of failed exports are written there instead of being
+// lost.
+type logExportMonitor struct {
+	sdklog.Exporter
+	exports   metric.Int64Counter
+	fallback  io.Writer
+	formatter logrus.Formatter
+}
+
+func newLogExportMonitor(next sdklog.Exporter, fallback io.Writer) (*logExportMonitor, error) {
+	exports, err := metrics.LogExports.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	_, err = metrics.LogPending.New(meter, func(_ context.Context, o metric.Int64Observer) error {
+		o.Observe(logsPending.Load())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	logExportsMonitored.Store(true)
+	return &logExportMonitor{
+		Exporter:  next,
+		exports:   exports,
+		fallback:  fallback,
+		formatter: newECSFormatter(),
+	}, nil
+}
+
+func (m *logExportMonitor) Export(ctx context.Context, records []sdklog.Record) error {
+	logsPending.Add(-int64(len(records)))
+	err := m.Exporter.Export(ctx, records)
+	outcome := "exported"
+	if err != nil {
+		outcome = "failed"
+		m.writeFallback(records)
+	}
+	m.exports.Add(ctx, int64(len(records)), metric.WithAttributes(logExportOutcomeKey.String(outcome)))
+	return err
+}
+
+// writeFallback writes records to the fallback writer, if any, in the
+// format of the other log entries.
+func (m *logExportMonitor) writeFallback(records []sdklog.Record) {
+	if m.fallback == nil {
+		return
+	}
+	for _, record := range records {
+		entry := &logrus.Entry{
+			Time:    record.Timestamp(),
+			Message: record.Body().String(),
+			Data:    logrus.Fields{},
+		}
+		if level, err := logrus.ParseLevel(record.SeverityText()); err == nil {
+			entry.Level = level
+		}
+		record.WalkAttributes(func(kv otellog.KeyValue) bool {
+			entry.Data[kv.Key] = kv.Value.String()
+			return true
+		})
+		if data, err := m.formatter.Format(entry); err == nil {
+			m.fallback.Write(data)
+		}
+	}
+}
+
+// telemetryOnlyFormatter writes only the entries about the telemetry
+// pipeline, which are not exported over OTLP.
+type telemetryOnlyFormatter struct {
+	logrus.Formatter
+}
+
+func (f telemetryOnlyFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if entry.Data[componentField] != "telemetry" {
+		return nil, nil
+	}
+	return f.Formatter.Format(entry)
+}
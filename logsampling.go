@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"otel-with-golang/logger"
+)
+
+// sampledOutField marks the entries dropped by the log sampler, so the
+// formatter and the OTLP hook leave them out. It is never written.
+const sampledOutField = "log.sampled_out"
+
+// maxSampledMessages bounds the counters a logSampler keeps.
+const maxSampledMessages = 10000
+
+// logSamplingConfig sets which log entries are sampled. Within each
+// interval, the first entries of each component and message are kept, then
+// one in Thereafter. Entries more severe than Level, errors included, are
+// always kept.
+type logSamplingConfig struct {
+	Level      string         `json:"level"`
+	First      int            `json:"first"`
+	Thereafter int            `json:"thereafter"`
+	Interval   string         `json:"interval"`
+	Components map[string]int `json:"components,omitempty"`
+}
+
+// logSampler keeps chatty log lines, such as the debug line of each hello
+// request, from flooding the log backend under load, as a hook that runs
+// before the OTLP hook.
+type logSampler struct {
+	mu       sync.Mutex
+	config   logSamplingConfig
+	level    logrus.Level
+	interval time.Duration
+	counters map[string]*sampleCounter
+	dropped  int64
+}
+
+type sampleCounter struct {
+	start time.Time
+	count int
+}
+
+// logSampling is configured from the LOG_SAMPLING_* variables and changed
+// at runtime through /admin/log-sampling.
+var logSampling *logSampler
+
+func newLogSampler() (*logSampler, error) {
+	sampler := &logSampler{}
+	config := logSamplingConfig{
+		Level:      os.Getenv("LOG_SAMPLING_LEVEL"),
+		First:      int(envInt("LOG_SAMPLING_FIRST", 10)),
+		Thereafter: int(envInt("LOG_SAMPLING_THEREAFTER", 1)),
+		Interval:   envDuration("LOG_SAMPLING_INTERVAL", time.Second).String(),
+	}
+	if config.Level == "" {
+		config.Level = logrus.DebugLevel.String()
+	}
+	if components := os.Getenv("LOG_SAMPLING_COMPONENTS"); components != "" {
+		config.Components = make(map[string]int)
+		for _, pair := range strings.Split(components, ",") {
+			component, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			thereafter, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid LOG_SAMPLING_COMPONENTS entry %q", pair)
+			}
+			config.Components[component] = thereafter
+		}
+	}
+	if err := sampler.configure(config); err != nil {
+		return nil, err
+	}
+	return sampler, nil
+}
+
+// configure replaces the sampling configuration and resets the counters.
+func (s *logSampler) configure(config logSamplingConfig) error {
+	level, err := logrus.ParseLevel(config.Level)
+	if err != nil {
+		return err
+	}
+	interval, err := time.ParseDuration(config.Interval)
+	if err != nil {
+		return err
+	}
+	if config.First < 0 || config.Thereafter < 0 || interval <= 0 {
+		return fmt.Errorf("first and thereafter must not be negative, and interval must be positive")
+	}
+	for component, thereafter := range config.Components {
+		if thereafter < 0 {
+			return fmt.Errorf("negative thereafter for component %s", component)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+	s.level = level
+	s.interval = interval
+	s.counters = make(map[string]*sampleCounter)
+	return nil
+}
+
+func (s *logSampler) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (s *logSampler) Fire(entry *logrus.Entry) error {
+	if !s.keep(entry) {
+		entry.Data[sampledOutField] = true
+	}
+	return nil
+}
+
+// keep decides whether entry is written.
+func (s *logSampler) keep(entry *logrus.Entry) bool {
+	component := defaultComponent
+	if value, ok := entry.Data[componentField]; ok {
+		component = fmt.Sprint(value)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry.Level < s.level {
+		return true
+	}
+	thereafter, ok := s.config.Components[component]
+	if !ok {
+		thereafter = s.config.Thereafter
+	}
+	if thereafter == 1 {
+		return true
+	}
+	key := component + "\x00" + entry.Message
+	counter, ok := s.counters[key]
+	now := clk.Now()
+	if !ok || now.Sub(counter.start) >= s.interval {
+		if !ok && len(s.counters) >= maxSampledMessages {
+			s.counters = make(map[string]*sampleCounter)
+		}
+		counter = &sampleCounter{start: now}
+		s.counters[key] = counter
+	}
+	counter.count++
+	if counter.count <= s.config.First ||
+		thereafter > 0 && (counter.count-s.config.First)%thereafter == 0 {
+		return true
+	}
+	s.dropped++
+	return false
+}
+
+// sampledFormatter writes nothing for the entries dropped by the sampler.
+type sampledFormatter struct {
+	logrus.Formatter
+}
+
+func (f sampledFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if entry.Data[sampledOutField] == true {
+		return nil, nil
+	}
+	return f.Formatter.Format(entry)
+}
+
+// logSamplingHandler shows the sampling configuration with the number of
+// entries dropped so far, and replaces it with the JSON body of a PUT.
+func logSamplingHandler(writer http.ResponseWriter, request *http.Request) {
+	if logSampling == nil {
+		http.Error(writer, "log sampling is not set up", http.StatusNotFound)
+		return
+	}
+	if request.Method == http.MethodPut {
+		var config logSamplingConfig
+		if status, err := decodeBody(request, &config); err != nil {
+			http.Error(writer, err.Error(), status)
+			return
+		}
+		if err := logSampling.configure(config); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.FromContext(request.Context()).WithField("sampling", config).Info("changed log sampling")
+	}
+	logSampling.mu.Lock()
+	report := struct {
+		logSamplingConfig
+		Dropped int64 `json:"dropped"`
+	}{logSampling.config, logSampling.dropped}
+	logSampling.mu.Unlock()
+	writer.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(report)
+}
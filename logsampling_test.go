@@ -0,0 +1,106 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestLogSampler(t *testing.T, config logSamplingConfig) *logSampler {
+	t.Helper()
+	sampler := &logSampler{}
+	if err := sampler.configure(config); err != nil {
+		t.Fatal(err)
+	}
+	return sampler
+}
+
+func logEntry(level logrus.Level, component, message string) *logrus.Entry {
+	entry := &logrus.Entry{Level: level, Message: message, Data: logrus.Fields{}}
+	if component != "" {
+		entry.Data[componentField] = component
+	}
+	return entry
+}
+
+// keptEntries returns which of n identical entries sampler keeps, numbered from 1.
+func keptEntries(sampler *logSampler, n int, level logrus.Level, component string) []int {
+	var numbers []int
+	for i := 1; i <= n; i++ {
+		if sampler.keep(logEntry(level, component, "handling hello request")) {
+			numbers = append(numbers, i)
+		}
+	}
+	return numbers
+}
+
+func TestLogSamplerKeepsFirstThenOneInThereafter(t *testing.T) {
+	clock := newManualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	previous := clk
+	clk = clock
+	defer func() { clk = previous }()
+
+	sampler := newTestLogSampler(t, logSamplingConfig{
+		Level: "debug", First: 2, Thereafter: 3, Interval: "1s",
+		Components: map[string]int{"repository": 0, "proxy": 1},
+	})
+	if got, want := keptEntries(sampler, 9, logrus.DebugLevel, ""), []int{1, 2, 5, 8}; !slices.Equal(got, want) {
+		t.Errorf("kept debug entries %v, want %v", got, want)
+	}
+	if got := keptEntries(sampler, 5, logrus.InfoLevel, ""); len(got) != 5 {
+		t.Errorf("kept %v of 5 info entries, want all", got)
+	}
+	if got := keptEntries(sampler, 5, logrus.ErrorLevel, ""); len(got) != 5 {
+		t.Errorf("kept %v of 5 error entries, want all", got)
+	}
+	if got, want := keptEntries(sampler, 5, logrus.DebugLevel, "repository"), []int{1, 2}; !slices.Equal(got, want) {
+		t.Errorf("kept repository entries %v, want only the first %v", got, want)
+	}
+	if got := keptEntries(sampler, 5, logrus.DebugLevel, "proxy"); len(got) != 5 {
+		t.Errorf("kept %v of 5 proxy entries, want all", got)
+	}
+	if sampler.dropped != 5+3 {
+		t.Errorf("dropped = %d, want 8", sampler.dropped)
+	}
+
+	// A new interval starts counting again
+	clock.Advance(time.Second)
+	if got, want := keptEntries(sampler, 3, logrus.DebugLevel, ""), []int{1, 2}; !slices.Equal(got, want) {
+		t.Errorf("kept debug entries %v in the next interval, want %v", got, want)
+	}
+}
+
+func TestLogSamplerDropsFromTheFormatter(t *testing.T) {
+	sampler := newTestLogSampler(t, logSamplingConfig{Level: "debug", First: 1, Thereafter: 0, Interval: "1m"})
+	formatter := sampledFormatter{&logrus.TextFormatter{DisableTimestamp: true}}
+	for i, want := range []bool{true, false} {
+		entry := logEntry(logrus.DebugLevel, "", "handling hello request")
+		entry.Logger = logrus.New()
+		if err := sampler.Fire(entry); err != nil {
+			t.Fatal(err)
+		}
+		line, err := formatter.Format(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if written := len(line) > 0; written != want {
+			t.Errorf("entry %d written = %v, want %v", i+1, written, want)
+		}
+	}
+}
+
+func TestLogSamplerRejectsInvalidConfigurations(t *testing.T) {
+	for _, config := range []logSamplingConfig{
+		{Level: "chatty", Interval: "1s"},
+		{Level: "debug", Interval: "soon"},
+		{Level: "debug", Interval: "0s"},
+		{Level: "debug", First: -1, Interval: "1s"},
+		{Level: "debug", Interval: "1s", Components: map[string]int{"proxy": -1}},
+	} {
+		if err := (&logSampler{}).configure(config); err == nil {
+			t.Errorf("configure(%+v) accepted an invalid configuration", config)
+		}
+	}
+}
@@ -2,197 +2,790 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"database/sql"
-	"encoding/json"
+	sqldriver "database/sql/driver"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
+	"github.com/XSAM/otelsql"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
-	"go.elastic.co/apm/module/apmsql"
-	_ "go.elastic.co/apm/module/apmsql/sqlite3"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+	"go.opentelemetry.io/contrib/instrumentation/host"
+	otelruntime "go.opentelemetry.io/contrib/instrumentation/runtime"
 	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/propagation"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	"go.opentelemetry.io/otel/trace"
-	"google.golang.org/grpc/credentials"
+	"golang.org/x/text/unicode/norm"
+	"google.golang.org/protobuf/proto"
+
+	"otel-with-golang/hellopb"
+	"otel-with-golang/logger"
+	"otel-with-golang/metrics"
+	"otel-with-golang/pkg/otelboot"
+	"otel-with-golang/requestcontext"
 )
 
 const (
-	serviceName      = "hello-app"
-	serviceVersion   = "v1.0.0"
-	metricPrefix     = "custom.metric."
-	numberOfExecName = metricPrefix + "number.of.exec"
-	numberOfExecDesc = "Count the number of executions."
-	heapMemoryName   = metricPrefix + "heap.memory"
-	heapMemoryDesc   = "Reports heap memory utilization."
+	serviceName    = "hello-app"
+	serviceVersion = "v1.0.0"
 )
 
+// protobufContentType selects the protobuf response encoding when present
+// in the Accept header.
+const protobufContentType = "application/x-protobuf"
+
 var (
-	tracer trace.Tracer
+	tracer       trace.Tracer
+	meter        = otel.Meter("io.opentelemetry.metrics.hello")
+	numberOfExec metric.Int64Counter
 )
 
 var db *sql.DB
 
+var repository StatsRepository
+
+// sqliteAvailable is set when the binary is built with the SQLite driver.
+var sqliteAvailable bool
+
+var greetingRuleSet *greetingRules
+
 var log = &logrus.Logger{
-	Out:   os.Stderr,
-	Hooks: make(logrus.LevelHooks),
-	Level: logrus.DebugLevel,
-	Formatter: &logrus.JSONFormatter{
-		FieldMap: logrus.FieldMap{
-			logrus.FieldKeyTime:  "@timestamp",
-			logrus.FieldKeyLevel: "log.level",
-			logrus.FieldKeyMsg:   "message",
-			logrus.FieldKeyFunc:  "function.name", // non-ECS
-		},
-	},
+	Out:       os.Stderr,
+	Hooks:     make(logrus.LevelHooks),
+	Level:     logrus.DebugLevel,
+	Formatter: sampledFormatter{newECSFormatter()},
 }
 
 func main() {
 	ctx := context.Background()
-	var err error
-	db, err = apmsql.Open("sqlite3", ":memory:")
+
+	logger.SetLogger(log)
+	log.AddHook(logger.TraceHook{})
+	logMetrics, err := newLogMetricsHook()
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("%s: %v", "failed to create log metrics hook", err)
 	}
-	if _, err := db.Exec("CREATE TABLE stats (name TEXT PRIMARY KEY, count INTEGER);"); err != nil {
-		log.Fatal(err)
+	log.AddHook(logMetrics)
+	if logSampling, err = newLogSampler(); err != nil {
+		log.Fatalf("%s: %v", "failed to configure log sampling", err)
 	}
-	// OpenTelemetry agent connectivity data
-	endpoint := os.Getenv("EXPORTER_ENDPOINT")
-	headers := os.Getenv("EXPORTER_HEADERS")
-	headersMap := func(headers string) map[string]string {
-		headersMap := make(map[string]string)
-		if len(headers) > 0 {
-			headerItems := strings.Split(headers, ",")
-			for _, headerItem := range headerItems {
-				parts := strings.Split(headerItem, "=")
-				headersMap[parts[0]] = parts[1]
+	log.AddHook(logSampling)
+	log.AddHook(recentLogs)
+	// Send the log entries to the OTLP endpoint along with the traces
+	otlpLogs, err := newOTLPLogHook()
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to create OTLP log hook", err)
+	}
+	log.AddHook(otlpLogs)
+	// The entries still reach stderr when the OTLP export fails, and
+	// always when there is no export
+	if !logStderr && !telemetryDisabled {
+		log.Formatter = telemetryOnlyFormatter{log.Formatter}
+	}
+
+	if len(os.Args) > 1 {
+		switch command := os.Args[1]; command {
+		case "gen-collector-config":
+			if err := genCollectorConfig(os.Stdout); err != nil {
+				log.Fatalf("%s: %v", "failed to generate collector config", err)
+			}
+		case "proxy":
+			runProxy(ctx)
+		case "demo":
+			runDemo(ctx)
+		case "pipe":
+			runPipe(ctx)
+		case "migrate":
+			runMigrate(ctx)
+		case "reveal-name":
+			if err := revealNames(os.Args[2:]); err != nil {
+				log.Fatalf("%s: %v", "failed to reveal names", err)
 			}
+		default:
+			log.Fatalf("unknown command %q", command)
 		}
-		return headersMap
-	}(headers)
+		return
+	}
 
-	// Resource to name traces/metrics
-	res0urce, err := resource.New(ctx,
-		resource.WithAttributes(
-			semconv.ServiceNameKey.String(serviceName),
-			semconv.ServiceVersionKey.String(serviceVersion),
-			semconv.TelemetrySDKVersionKey.String("v1.4.1"),
-			semconv.TelemetrySDKLanguageGo,
-		),
-	)
+	if err := initNameObfuscation(); err != nil {
+		log.Fatalf("%s: %v", "failed to set up name obfuscation", err)
+	}
+
+	bodyLimit, err := limitRequestBody(envInt("MAX_REQUEST_BODY_BYTES", 1<<20))
 	if err != nil {
-		log.Fatalf("%s: %v", "failed to create resource", err)
+		log.Fatalf("%s: %v", "failed to create body limit", err)
 	}
 
-	// Initialize the tracer provider
-	initTracer(ctx, endpoint, headersMap, res0urce)
+	anomalies, err := newLatencyDetector()
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to create latency detector", err)
+	}
+
+	if chargeback, err = newTenantAccounting(); err != nil {
+		log.Fatalf("%s: %v", "failed to create tenant accounting", err)
+	}
+
+	red, err := newREDMetrics()
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to create request metrics", err)
+	}
+
+	overhead, err := newOverheadTimer()
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to create overhead timer", err)
+	}
+
+	admission, err := newPriorityAdmission()
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to create priority admission", err)
+	}
+
+	slowest := newSlowestRequests(int(envInt("SLOWEST_REQUESTS", 10)))
+	go slowest.summarize(ctx, envInterval("SLOWEST_SUMMARY_INTERVAL", time.Minute))
+
+	traceResponse, err := traceResponseHeaders(os.Getenv("TRACE_RESPONSE_HEADERS"))
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to configure trace response headers", err)
+	}
+
+	traceTrust, err := newTraceContextPolicy()
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to configure trace context policy", err)
+	}
+
+	authorization, err := newAdminAuthorization()
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to configure admin authorization", err)
+	}
+
+	middlewares := pipeline{
+		{"tracetrust", traceTrust.middleware},
+		{"otelmux", otelmux.Middleware(serviceName, traceTrust.otelmuxOptions()...)},
+		{"transaction", logger.Middleware},
+		{"traceresponse", traceResponse},
+		{"servertiming", serverTiming},
+		{"red", red.middleware},
+		{"requestcontext", requestcontext.Middleware},
+		{"authz", authorization.middleware},
+		{"chargeback", chargeback.middleware},
+		{"verbosity", traceVerbosity(defaultVerbosity())},
+		{"deadline", requestDeadline(requestTimeout())},
+		{"protocol", recordProtocol},
+		{"clientcert", recordClientCertificate},
+		{"admission", admission.middleware},
+		{"bodylimit", bodyLimit},
+		{"anomalies", anomalies.middleware},
+		{"slowest", slowest.middleware},
+		{"recovery", recoverPanics},
+	}
 	router := mux.NewRouter()
-	router.Use(otelmux.Middleware(serviceName))
-	router.HandleFunc("/hello/{name}", hello)
-	log.Fatal(http.ListenAndServe(":9000", router))
+	if err := middlewares.apply(router, envBool("MIDDLEWARE_TIMING", false)); err != nil {
+		log.Fatalf("%s: %v", "failed to install middlewares", err)
+	}
+	router.HandleFunc("/hello/{name}", overhead.inner(hello))
+	router.HandleFunc("/stats/{name}", countStats).Methods(http.MethodGet)
+	router.HandleFunc("/stats/{name}/watch", watchStats).Methods(http.MethodGet)
+	router.HandleFunc("/stats/{name}/webhooks", webhookSubscriptions).
+		Methods(http.MethodGet, http.MethodPost, http.MethodDelete)
+	router.HandleFunc("/jobs/{id}", jobStatus).Methods(http.MethodGet)
+	router.HandleFunc("/tasks", scheduleTask).Methods(http.MethodPost)
+	router.HandleFunc("/tasks/{id}", taskStatus).Methods(http.MethodGet)
+	router.HandleFunc("/admin/slowest", slowest.handler)
+	router.HandleFunc("/admin/telemetry/usage", telemetryUsageHandler)
+	router.HandleFunc("/admin/usage", chargeback.handler)
+	router.HandleFunc("/admin/telemetry/flush", flushTelemetryHandler).Methods(http.MethodPost)
+	router.HandleFunc("/admin/trace-fixtures", traceFixturesHandler)
+	router.HandleFunc("/admin/middleware", middlewares.handler)
+	router.HandleFunc("/admin/deps", depsHandler)
+	router.HandleFunc("/admin/dependencies", dependenciesHandler)
+	router.HandleFunc("/admin/experiments", experimentsHandler)
+	router.HandleFunc("/admin/log-sampling", logSamplingHandler).Methods(http.MethodGet, http.MethodPut)
+	router.HandleFunc("/admin/support-bundle", supportBundleHandler).Methods(http.MethodPost)
+	router.HandleFunc("/admin/features", features.handler).Methods(http.MethodGet, http.MethodPut)
+	router.HandleFunc("/admin/log-level", logLevelHandler).Methods(http.MethodGet, http.MethodPut)
+	router.HandleFunc("/admin/db-chaos", dbChaosHandler).Methods(http.MethodGet, http.MethodPut)
+
+	// Listen right away, answering 503 until initialization completes
+	go initialize(ctx)
+	handler, shutdownPrometheus := servePrometheus(startupGate(overhead.outer(underBasePath(router))))
+	handler = healthChecks(handler)
+	shutdownHTTP3 := serveHTTP3(handler)
+	listener, err := listen(":9000", "http")
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to listen", err)
+	}
+	server := &http.Server{Handler: handler, ErrorLog: listener.errorLog()}
+	serve := func() error { return server.Serve(listener) }
+	if envBool("LISTEN_TLS", false) {
+		if server.TLSConfig, err = serverTLSConfig(); err != nil {
+			log.Fatalf("%s: %v", "failed to configure TLS", err)
+		}
+		serve = func() error { return server.ServeTLS(listener, "", "") }
+	}
+	if err := serveUntilSignal(ctx, server, serve, shutdownHTTP3, shutdownPrometheus); err != nil {
+		log.Fatal(err)
+	}
+	log.Info("shut down")
 }
 
-func hello(writer http.ResponseWriter, request *http.Request) {
-	vars := mux.Vars(request)
-	log.WithField("vars", vars).Info("handling hello request")
-	name := vars["name"]
-	ctx := request.Context()
+// initialize opens the database and sets up telemetry, then marks the
+// service as ready to serve requests.
+func initialize(ctx context.Context) {
+	// Telemetry first, so the migrations are traced
+	initTelemetry(ctx)
+	initStorage(ctx)
+	logConfigDiff()
 
-	requestCount, err := updateRequestCount(ctx, name)
-	if err != nil {
-		panic(err)
+	var err error
+	checks := dependencyChecks()
+	if dependencies, err = newDependencyMonitor(checks); err != nil {
+		log.Fatalf("%s: %v", "failed to create dependency monitor", err)
 	}
-	buildResponse(writer, requestCount)
+	log.Infof("probing dependencies: %s", dependencyNames(checks))
+	go dependencies.run(ctx)
+	tasks.launch(ctx)
+
+	startup.Store(stateReady)
+	log.Info("initialization complete, serving requests")
 }
 
-func updateRequestCount(ctx context.Context, name string) (int, error) {
-	_, updateSpan := tracer.Start(ctx, "updateRequestCount")
-	defer updateSpan.End()
+// initStorage opens the database and the stores kept in it, and loads the
+// greeting rules and experiments.
+func initStorage(ctx context.Context) {
+	var err error
+	driver := os.Getenv("DB_DRIVER")
+	if driver == "" {
+		driver = "sqlite3"
+	}
+	if driver == "sqlite3" && !sqliteAvailable {
+		log.Warn("built without cgo, using the in-memory repository instead of SQLite")
+		driver = "memory"
+	}
+	switch driver {
+	case "memory":
+		repository = newMemoryStatsRepository()
+	case "sqlite3":
+		dsn, err := sqliteDSN()
+		if err != nil {
+			log.Fatalf("%s: %v", "failed to prepare the SQLite database", err)
+		}
+		db = openSQLite(dsn)
+		migrateOnStartup(ctx, driver)
+		// Spread hot counts over several rows for high request rates
+		if shards := envInt("COUNTER_SHARDS", 1); shards > 1 {
+			repository, err = newShardedStatsRepository(ctx, db, int(shards))
+		} else if err = moveCounts(ctx, db, moveCountsFromShards); err == nil {
+			repository, err = newSQLStatsRepository(db)
+		}
+		if err != nil {
+			log.Fatalf("%s: %v", "failed to create SQL repository", err)
+		}
+	case "postgres", "mysql":
+		// A database server lets several replicas share the counts
+		dsn := os.Getenv("DB_DSN")
+		if dsn == "" {
+			log.Fatalf("DB_DRIVER=%s needs DB_DSN", driver)
+		}
+		dialect := serverDialects[driver]
+		db = openDB(dialect.driverName, dsn, dialect.system)
+		migrateOnStartup(ctx, driver)
+		// Spread hot counts over several rows, which these databases
+		// lock one by one
+		if shards := envInt("COUNTER_SHARDS", 1); shards > 1 {
+			repository, err = newShardedServerStatsRepository(ctx, db, driver, int(shards))
+		} else if err = moveCounts(ctx, db, moveCountsFromShards); err == nil {
+			repository, err = newServerStatsRepository(db, driver)
+		}
+		if err != nil {
+			log.Fatalf("%s: %v", "failed to create SQL repository", err)
+		}
+		log.Warn("keeping webhook subscriptions and scheduled tasks in memory, each replica its own")
+	default:
+		log.Fatalf("unknown DB_DRIVER %q", driver)
+	}
+	// The webhook and task tables are only set up in SQLite
+	var subscriptions subscriptionStore = newMemorySubscriptionStore()
+	if driver == "sqlite3" {
+		subscriptions = newSQLSubscriptionStore(db)
+	}
+	webhooks = newWebhookDispatcher(subscriptions)
+	var scheduled taskStore = newMemoryTaskStore()
+	if driver == "sqlite3" {
+		scheduled = newSQLTaskStore(db)
+	}
+	if tasks, err = newTaskScheduler(scheduled); err != nil {
+		log.Fatalf("%s: %v", "failed to create task scheduler", err)
+	}
+	// Runs cut short by a crash are retried rather than left running
+	if requeued, err := scheduled.Requeue(ctx); err != nil {
+		log.Fatalf("%s: %v", "failed to requeue scheduled tasks", err)
+	} else if requeued > 0 {
+		log.Warnf("requeued %d scheduled tasks left running by the last process", requeued)
+	}
+	// Inject faults only once the schema is set up
+	if dbChaos != nil {
+		if err := dbChaos.configure(chaosConfigFromEnv()); err != nil {
+			log.Fatalf("%s: %v", "failed to configure database chaos", err)
+		}
+		log.WithField("chaos", chaosConfigFromEnv()).Warn("injecting faults into the database calls")
+	}
+	// Collapse concurrent reads of the same name into one query
+	if repository, err = newSingleflightRepository(repository, requestTimeout()); err != nil {
+		log.Fatalf("%s: %v", "failed to create singleflight repository", err)
+	}
+	// Time the repository calls for the Server-Timing header
+	repository = timedRepository{repository}
+	if path := os.Getenv("RULES_FILE"); path != "" {
+		greetingRuleSet, err = loadGreetingRules(path)
+		if err != nil {
+			log.Fatalf("%s: %v", "failed to load greeting rules", err)
+		}
+	}
+	if path := os.Getenv("EXPERIMENTS_FILE"); path != "" {
+		experimentSet, err = loadExperiments(path)
+		if err != nil {
+			log.Fatalf("%s: %v", "failed to load experiments", err)
+		}
+	}
+}
+
+// shutdownTelemetry flushes and stops the telemetry pipeline set up by
+// initTelemetry.
+var shutdownTelemetry = func(context.Context) error { return nil }
 
-	if strings.IndexFunc(name, func(r rune) bool { return r >= unicode.MaxASCII }) >= 0 {
-		panic("non-ASCII name!")
+// deploymentEnvironment is read from DEPLOYMENT_ENVIRONMENT, development
+// when unset.
+func deploymentEnvironment() string {
+	if environment := os.Getenv("DEPLOYMENT_ENVIRONMENT"); environment != "" {
+		return environment
 	}
-	tx, err := db.BeginTx(ctx, nil)
+	return "development"
+}
+
+// initTelemetry sets up the telemetry providers and the exporter probe.
+func initTelemetry(ctx context.Context) {
+	// OpenTelemetry agent connectivity data
+	endpoint := exporterEndpoint()
+	headersMap, err := exporterHeaders()
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to configure exporter headers", err)
+	}
+
+	environment := deploymentEnvironment()
+
+	// Surface dropped spans and SDK errors instead of losing them silently
+	drops, err := newDropMonitor()
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to create drop monitor", err)
+	}
+	go drops.run(ctx, envInterval("SPAN_DROP_CHECK_INTERVAL", 30*time.Second))
+
+	exporter, err := exporterOptions()
 	if err != nil {
-		return -1, err
+		log.Fatalf("%s: %v", "failed to configure exporter", err)
 	}
-	row := tx.QueryRowContext(ctx, "SELECT count FROM stats WHERE name=?", name)
-	var count int
-	switch err := row.Scan(&count); err {
-	case nil:
-		count++
-		if _, err := tx.ExecContext(ctx, "UPDATE stats SET count=? WHERE name=?", count, name); err != nil {
-			return -1, err
+
+	tracePropagator, err := newTracePropagator()
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to create propagator", err)
+	}
+
+	opts := otelboot.Options{
+		ServiceName:    serviceName,
+		ServiceVersion: serviceVersion,
+		Environment:    environment,
+		Disabled:       telemetryDisabled,
+		Attributes: append([]attribute.KeyValue{
+			semconv.TelemetrySDKVersionKey.String("v1.4.1"),
+			semconv.TelemetrySDKLanguageGo,
+		}, buildAttributes()...),
+		Protocol:   exporter.Protocol,
+		Endpoint:   exporter.Endpoint,
+		PathPrefix: exporter.PathPrefix,
+		Headers:    exporter.Headers,
+		Insecure:   exporter.Insecure,
+		TLSConfig:  exporter.TLSConfig,
+		// Short runs such as the demo need a shorter interval to export
+		// metrics before they end
+		MetricInterval: envDuration("METRIC_EXPORT_INTERVAL", time.Minute),
+		// High-throughput deployments need a larger span queue, demos a
+		// shorter wait before their spans show up
+		SpanBatch: otelboot.SpanBatchOptions{
+			MaxQueueSize:       int(envInt("SPAN_QUEUE_SIZE", 0)),
+			MaxExportBatchSize: int(envInt("SPAN_BATCH_SIZE", 0)),
+			BatchTimeout:       envDuration("SPAN_BATCH_TIMEOUT", 0),
+			ExportTimeout:      envDuration("SPAN_EXPORT_TIMEOUT", 0),
+		},
+		WrapLogExporter: func(next sdklog.Exporter) (sdklog.Exporter, error) {
+			var fallback io.Writer
+			if !logStderr {
+				fallback = os.Stderr
+			}
+			return newLogExportMonitor(next, fallback)
+		},
+		WrapSpanProcessor: func(next sdktrace.SpanProcessor) (sdktrace.SpanProcessor, error) {
+			// Account for the telemetry volume that is actually exported
+			usage, err := newUsageProcessor(next)
+			if err != nil {
+				return nil, err
+			}
+			telemetryUsage = usage
+			// Drop the attributes that must not leave this environment
+			filter, err := newAttributeFilterProcessor(recentSpans.wrap(usage), environment)
+			if err != nil {
+				return nil, err
+			}
+			// Forward recorded exceptions to Sentry when configured
+			exceptions, err := newSentryProcessor(filter, environment)
+			if err != nil {
+				return nil, err
+			}
+			// Record or check the shape of the traces against golden files
+			mode := os.Getenv("TRACE_FIXTURES")
+			if mode == "" {
+				return exceptions, nil
+			}
+			dir := os.Getenv("TRACE_FIXTURES_DIR")
+			if dir == "" {
+				dir = "testdata/traces"
+			}
+			traceFixtures, err = newFixtureProcessor(exceptions, mode, dir)
+			return traceFixtures, err
+		},
+		Propagator: propagation.NewCompositeTextMapPropagator(
+			propagation.Baggage{},
+			tracePropagator,
+		),
+	}
+	otlpMetrics, prometheusMetrics, err := metricsExporters()
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to configure metrics exporters", err)
+	}
+	opts.DisableOTLPMetrics = !otlpMetrics
+	if prometheusMetrics {
+		// Registered with the default registry served at /metrics
+		reader, err := otelprometheus.New()
+		if err != nil {
+			log.Fatalf("%s: %v", "failed to create Prometheus exporter", err)
 		}
-		log.WithField("name", name).Infof("updated count to %d", count)
-	case sql.ErrNoRows:
-		count = 1
-		if _, err := tx.ExecContext(ctx, "INSERT INTO stats (name, count) VALUES (?, ?)", name, count); err != nil {
-			return -1, err
+		opts.MetricReaders = append(opts.MetricReaders, reader)
+	}
+	switch exporterType := os.Getenv("EXPORTER_TYPE"); exporterType {
+	case "", "otlp":
+	case "apm-intake":
+		// Talk to the APM Server intake API directly when OTLP is unavailable
+		opts.NewSpanExporter = func(_ context.Context, res0urce *resource.Resource) (sdktrace.SpanExporter, error) {
+			return newAPMIntakeExporter(endpoint, headersMap, res0urce), nil
 		}
-		log.WithField("name", name).Info("initialised count to 1")
+		opts.DisableMetrics = true
+		opts.DisableLogs = true
 	default:
-		return -1, err
+		log.Fatalf("unknown EXPORTER_TYPE %q", exporterType)
 	}
-	return count, tx.Commit()
+
+	shutdownTelemetry, err = otelboot.Setup(ctx, opts)
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to set up telemetry", err)
+	}
+	telemetryReady.Store(true)
+	tracer = otel.Tracer("io.opentelemetry.traces.hello")
+
+	numberOfExec, err = metrics.NumberOfExec.New(meter)
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to create execution counter", err)
+	}
+	if responseJSON, err = newJSONEncoder(); err != nil {
+		log.Fatalf("%s: %v", "failed to create JSON encoder", err)
+	}
+	// Goroutines, garbage collections and memory of the Go runtime
+	err = otelruntime.Start(otelruntime.WithMinimumReadMemStatsInterval(
+		envDuration("RUNTIME_METRICS_INTERVAL", otelruntime.DefaultMinimumReadMemStatsInterval)))
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to start runtime metrics", err)
+	}
+	// CPU, memory and network of the host, for the infrastructure
+	// view next to the traces without running a separate agent
+	if envBool("HOST_METRICS_ENABLED", false) {
+		if err := host.Start(); err != nil {
+			log.Fatalf("%s: %v", "failed to start host metrics", err)
+		}
+	}
+
+	// Track the round-trip time to the OTLP endpoint
+	if telemetryDisabled {
+		return
+	}
+	probe, err := newExporterProbe(endpoint, opts.Protocol, opts.Insecure, opts.TLSConfig)
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to create exporter probe", err)
+	}
+	go probe.run(ctx)
 }
 
-func buildResponse(writer http.ResponseWriter, requestCount int) response {
+// openDB opens the database at dsn with the driver registered as
+// driverName, instrumented with otelsql and recording system as db.system.
+func openDB(driverName, dsn string, system attribute.KeyValue) *sql.DB {
+	// Trace the queries as children of the request spans, and with
+	// SQL_COMMENTER=true append their trace context to the statements
+	// so the database logs can be joined back to the traces
+	options := []otelsql.Option{
+		otelsql.WithAttributes(system),
+		otelsql.WithSQLCommenter(envBool("SQL_COMMENTER", false)),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			DisableErrSkip:       true,
+			OmitConnResetSession: true,
+			OmitRows:             true,
+			// Queries outside of a trace, such as the polls of the
+			// task scheduler, would each start a trace of their own,
+			// and requests traced at the minimal verbosity keep only
+			// their server span
+			SpanFilter: func(ctx context.Context, _ otelsql.Method, _ string, _ []sqldriver.NamedValue) bool {
+				return trace.SpanContextFromContext(ctx).IsValid() && verbosityAtLeast(ctx, verbosityNormal)
+			},
+		}),
+	}
+	var db *sql.DB
+	var err error
+	// With DB_CHAOS=true, inject faults below the instrumentation, to
+	// practice diagnosing database problems from the telemetry
+	if envBool("DB_CHAOS", false) {
+		// Every connection to an in-memory database opens an empty
+		// one, so the extra connections that latency and drops cause
+		// would find no tables
+		if driverName == "sqlite3" && sqliteInMemory(dsn) {
+			log.Fatal("DB_CHAOS needs a database file in DB_DSN")
+		}
+		if dbChaos, err = newChaosInjector(); err != nil {
+			log.Fatalf("%s: %v", "failed to create database chaos injector", err)
+		}
+		connector, err := openChaosConnector(driverName, dsn, dbChaos)
+		if err != nil {
+			log.Fatal(err)
+		}
+		db = otelsql.OpenDB(connector, options...)
+	} else if db, err = otelsql.Open(driverName, dsn, options...); err != nil {
+		log.Fatal(err)
+	}
+	if err := otelsql.RegisterDBStatsMetrics(db, otelsql.WithAttributes(system)); err != nil {
+		log.Fatalf("%s: %v", "failed to register database metrics", err)
+	}
+	return db
+}
 
-	writer.WriteHeader(http.StatusOK)
-	writer.Header().Add("Content-Type",
-		"application/json")
+// openSQLite opens the SQLite database dsn. Every connection to an
+// in-memory database opens an empty one, so such a database is kept to a
+// single connection, which the requests wait for in turn.
+func openSQLite(dsn string) *sql.DB {
+	db := openDB("sqlite3", dsn, semconv.DBSystemSqlite)
+	if sqliteInMemory(dsn) {
+		db.SetMaxOpenConns(1)
+	}
+	return db
+}
 
-	response := response{fmt.Sprintf("Hello World %d", requestCount)}
-	bytes, _ := json.Marshal(response)
-	writer.Write(bytes)
-	return response
+// sqliteInMemory reports whether dsn opens a SQLite database that lives
+// only as long as its connection.
+func sqliteInMemory(dsn string) bool {
+	path, query, _ := strings.Cut(strings.TrimPrefix(dsn, "file:"), "?")
+	return path == "" || path == ":memory:" || strings.Contains(query, "mode=memory")
 }
 
-type response struct {
-	Message string `json:"Message"`
+// sqliteDSN returns the SQLite database to open: DB_DSN, such as
+// data/hello.db or file:/var/lib/hello-app/hello.db?_journal_mode=WAL, or
+// else one in memory, whose counts are lost on restart. It creates the
+// directory of a database file, and makes concurrent writers wait up to
+// five seconds for the lock unless DB_DSN sets _busy_timeout, taking it
+// when their transaction begins unless DB_DSN sets _txlock.
+func sqliteDSN() (string, error) {
+	dsn := os.Getenv("DB_DSN")
+	if dsn == "" {
+		return ":memory:", nil
+	}
+	if sqliteInMemory(dsn) {
+		return dsn, nil
+	}
+	path, query, _ := strings.Cut(strings.TrimPrefix(dsn, "file:"), "?")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	// A deferred transaction reads under a shared lock and fails with
+	// SQLITE_BUSY, without waiting, when it then has to write while
+	// another connection holds the lock, so take the write lock at BEGIN
+	for _, param := range []string{"_busy_timeout=5000", "_txlock=immediate"} {
+		key, _, _ := strings.Cut(param, "=")
+		if strings.Contains(query, key) {
+			continue
+		}
+		separator := "?"
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+		dsn += separator + param
+	}
+	log.WithField("db_file", path).Info("keeping the counts in a SQLite database file")
+	return dsn, nil
+}
+
+// parseHeaders turns "key1=value1,key2=value2" into a header map. Values
+// are split at their first "=", so they may contain more, such as base64
+// keys; blank entries are skipped, and those without "=" or a key fail.
+func parseHeaders(headers string) (map[string]string, error) {
+	headersMap := make(map[string]string)
+	for _, headerItem := range strings.Split(headers, ",") {
+		if strings.TrimSpace(headerItem) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(headerItem, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("malformed header %q, want key=value", headerItem)
+		}
+		headersMap[key] = strings.TrimSpace(value)
+	}
+	return headersMap, nil
 }
 
-func initTracer(ctx context.Context, endpoint string,
-	headersMap map[string]string, res0urce *resource.Resource) {
+func hello(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	logger.FromContext(ctx).Debug("handling hello request")
+	name, err := normalizeName(requestcontext.UserName(ctx))
+	if err != nil {
+		failRequest(writer, request, http.StatusBadRequest, err)
+		return
+	}
+	experiment := experimentSet.assign(name)
+	trace.SpanFromContext(ctx).SetAttributes(experiment.attributes()...)
+	numberOfExec.Add(ctx, 1, spanDimensions(ctx, experiment.attributes()...))
+
+	_, validateSpan := startSpan(ctx, verbosityVerbose, "validate name")
+	rule := experiment.apply(greetingRuleSet.match(name))
+	validateSpan.End()
+	trace.SpanFromContext(ctx).SetAttributes(rule.attributes()...)
+	if rule.blocked {
+		http.Error(writer, "name is blocked", http.StatusForbidden)
+		return
+	}
 
-	traceOpts := []otlptracegrpc.Option{
-		otlptracegrpc.WithTimeout(5 * time.Second),
+	// Count in the background when the client prefers to poll for the result
+	if strings.Contains(request.Header.Get("Prefer"), respondAsync) {
+		accepted, err := jobs.start(ctx, "hello", func(ctx context.Context) (string, error) {
+			requestCount, err := updateRequestCount(ctx, name, rule.factor)
+			if err != nil {
+				return "", err
+			}
+			return rule.greeting(requestCount), nil
+		})
+		if err != nil {
+			writer.Header().Set("Retry-After", "1")
+			failRequest(writer, request, http.StatusServiceUnavailable, err)
+			return
+		}
+		acceptJob(writer, accepted)
+		return
 	}
-	//traceOpts = append(traceOpts, otlptracegrpc.WithHeaders(headersMap))
-	traceOpts = append(traceOpts, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(&tls.Config{})))
-	traceOpts = append(traceOpts, otlptracegrpc.WithEndpoint(endpoint))
 
-	traceExporter, err := otlptracegrpc.New(ctx, traceOpts...)
+	requestCount, err := updateRequestCount(ctx, name, rule.factor)
 	if err != nil {
-		log.Fatalf("%s: %v", "failed to create exporter", err)
+		failRequest(writer, request, http.StatusInternalServerError, err)
+		return
 	}
+	buildResponse(ctx, writer, request.Header.Get("Accept"), rule.greeting(requestCount))
+}
 
-	otel.SetTracerProvider(sdktrace.NewTracerProvider(
-		sdktrace.WithSampler(sdktrace.AlwaysSample()),
-		sdktrace.WithResource(res0urce),
-		sdktrace.WithSpanProcessor(
-			sdktrace.NewBatchSpanProcessor(traceExporter)),
-	))
+func updateRequestCount(ctx context.Context, name string, increment int) (int, error) {
+	ctx, updateSpan := startSpan(ctx, verbosityNormal, "updateRequestCount",
+		trace.WithAttributes(requestcontext.Attributes(ctx)...),
+		trace.WithAttributes(remainingBudget(ctx)...))
+	defer updateSpan.End()
 
-	otel.SetTextMapPropagator(
-		propagation.NewCompositeTextMapPropagator(
-			propagation.Baggage{},
-			propagation.TraceContext{},
-		),
+	name, err := normalizeName(name)
+	if err != nil {
+		updateSpan.RecordError(err)
+		updateSpan.SetStatus(codes.Error, err.Error())
+		return 0, err
+	}
+	count, err := repository.Increment(ctx, name, increment)
+	if err != nil {
+		updateSpan.RecordError(err)
+		updateSpan.SetStatus(codes.Error, err.Error())
+		return 0, err
+	}
+	watchers.notify(name, count)
+	webhooks.deliver(ctx, name, count)
+	return count, nil
+}
+
+// errInvalidName is returned for the names the counts cannot be kept for.
+var errInvalidName = errors.New("invalid name")
+
+// maxNameLength is the most characters a name may have, once normalized.
+var maxNameLength = int(envInt("NAME_MAX_LENGTH", 64))
+
+// normalizeName returns name in Unicode normalization form C, so that a
+// name such as "José" is counted once whether its accent was sent
+// precomposed or as a combining character. It returns errInvalidName
+// unless name is valid UTF-8, between 1 and maxNameLength characters,
+// without control characters.
+func normalizeName(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("%w: must be valid UTF-8", errInvalidName)
+	}
+	name = norm.NFC.String(name)
+	if length := utf8.RuneCountInString(name); length == 0 || length > maxNameLength {
+		return "", fmt.Errorf("%w: must have between 1 and %d characters", errInvalidName, maxNameLength)
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return "", fmt.Errorf("%w: must not contain control characters", errInvalidName)
+	}
+	return name, nil
+}
+
+func buildResponse(ctx context.Context, writer http.ResponseWriter,
+	accept string, message string) response {
+
+	ctx, span := startSpan(ctx, verbosityNormal, "buildResponse",
+		trace.WithAttributes(remainingBudget(ctx)...))
+	defer span.End()
+
+	response := response{message}
+	contentType := "application/json"
+	var bytes []byte
+	_, serializeSpan := startSpan(ctx, verbosityVerbose, "serialize response")
+	if strings.Contains(accept, protobufContentType) {
+		contentType = protobufContentType
+		bytes, _ = proto.Marshal(&hellopb.HelloResponse{Message: response.Message})
+	} else {
+		bytes, _ = responseJSON.Marshal(ctx, response)
+	}
+	serializeSpan.End()
+	span.SetAttributes(
+		attribute.String("http.response.content_type", contentType),
+		attribute.Int("http.response.body.size", len(bytes)),
 	)
 
-	tracer = otel.Tracer("io.opentelemetry.traces.hello")
+	writer.Header().Add("Content-Type", contentType)
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(bytes)
+	return response
+}
 
+type response struct {
+	Message string `json:"Message"`
 }
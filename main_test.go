@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+// TestMain gives the package the tracer initTelemetry would, on the global
+// provider, which records nothing unless a test installs one.
+func TestMain(m *testing.M) {
+	tracer = otel.Tracer("io.opentelemetry.traces.hello")
+	os.Exit(m.Run())
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/metrics"
+)
+
+// newTracePropagator returns the propagator for the trace context. By
+// default that is W3C Trace Context. With MESH_COMPAT=true, B3 headers as
+// sent by Envoy and Istio are understood and written too, and when a
+// request carries both, MESH_PRECEDENCE ("w3c" or "b3") decides which one
+// to continue. The mesh's x-request-id is echoed by requestcontext.
+func newTracePropagator() (propagation.TextMapPropagator, error) {
+	w3c := propagation.TraceContext{}
+	if !envBool("MESH_COMPAT", false) {
+		return w3c, nil
+	}
+	conflicts, err := metrics.PropagationConflicts.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	b3Propagator := b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader | b3.B3SingleHeader))
+	propagator := &precedencePropagator{primary: w3c, secondary: b3Propagator,
+		winner: attribute.String("propagation.winner", "w3c"), conflicts: conflicts}
+	if os.Getenv("MESH_PRECEDENCE") == "b3" {
+		propagator.primary, propagator.secondary = b3Propagator, w3c
+		propagator.winner = attribute.String("propagation.winner", "b3")
+	}
+	return propagator, nil
+}
+
+// precedencePropagator writes both formats and, on extraction, prefers the
+// primary one whenever it yields a valid span context.
+type precedencePropagator struct {
+	primary   propagation.TextMapPropagator
+	secondary propagation.TextMapPropagator
+	winner    attribute.KeyValue
+	conflicts metric.Int64Counter
+}
+
+func (p *precedencePropagator) Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	p.secondary.Inject(ctx, carrier)
+	p.primary.Inject(ctx, carrier)
+}
+
+func (p *precedencePropagator) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	primary := p.primary.Extract(ctx, carrier)
+	secondary := p.secondary.Extract(ctx, carrier)
+	primarySC := trace.SpanContextFromContext(primary)
+	secondarySC := trace.SpanContextFromContext(secondary)
+	if !primarySC.IsValid() {
+		return secondary
+	}
+	if secondarySC.IsValid() && secondarySC.TraceID() != primarySC.TraceID() {
+		p.conflicts.Add(ctx, 1, metric.WithAttributes(p.winner))
+	}
+	return primary
+}
+
+func (p *precedencePropagator) Fields() []string {
+	return append(p.primary.Fields(), p.secondary.Fields()...)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/requestcontext"
+)
+
+var statusClassKey = attribute.Key("http.status_class")
+
+// tenantBaggageKey is the baggage member naming the tenant when the
+// request did not carry the tenant header.
+const tenantBaggageKey = "tenant"
+
+// spanDimensions returns the attributes of a measurement made while
+// handling a request, derived the same way for every metric so they can be
+// joined with the traces in Kibana: the http.route of the current span,
+// the tenant of the request or its baggage, and the class of the response
+// status once it is written, such as "5xx". extra is added as is.
+func spanDimensions(ctx context.Context, extra ...attribute.KeyValue) metric.MeasurementOption {
+	var attrs []attribute.KeyValue
+	if span, ok := trace.SpanFromContext(ctx).(sdktrace.ReadOnlySpan); ok {
+		for _, kv := range span.Attributes() {
+			if kv.Key == semconv.HTTPRouteKey {
+				attrs = append(attrs, kv)
+			}
+		}
+	}
+	if tenant := requestTenant(ctx); tenant != "" {
+		attrs = append(attrs, requestcontext.TenantAttribute.String(tenant))
+	}
+	if status := responseStatus(ctx); status != 0 {
+		attrs = append(attrs, statusClassKey.String(statusClass(status)))
+	}
+	return metric.WithAttributes(append(attrs, extra...)...)
+}
+
+// requestTenant returns the tenant of the request in ctx, from its header
+// or else its baggage, or "" when it has none.
+func requestTenant(ctx context.Context) string {
+	if tenant := requestcontext.Tenant(ctx); tenant != "" {
+		return tenant
+	}
+	return baggage.FromContext(ctx).Member(tenantBaggageKey).Value()
+}
+
+// statusClass returns the class of an HTTP status, such as "5xx".
+func statusClass(status int) string {
+	return fmt.Sprintf("%dxx", status/100)
+}
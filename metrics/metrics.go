@@ -0,0 +1,181 @@
+// Package metrics declares every instrument of the service once, with its
+// name, unit and description, so the code recording a measurement cannot
+// create a duplicate or misspelled instrument, or one of the wrong kind.
+package metrics
+
+import (
+	"fmt"
+
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Prefix starts the name of every instrument of the service.
+const Prefix = "custom.metric."
+
+// Definition describes an instrument.
+type Definition struct {
+	Name        string
+	Description string
+	Unit        string
+}
+
+var definitions []Definition
+
+// define records an instrument, panicking when its name is taken, so a
+// duplicate fails as soon as the binary starts.
+func define(name, description, unit string) Definition {
+	for _, existing := range definitions {
+		if existing.Name == Prefix+name {
+			panic(fmt.Sprintf("metric %s defined twice", existing.Name))
+		}
+	}
+	definition := Definition{Name: Prefix + name, Description: description, Unit: unit}
+	definitions = append(definitions, definition)
+	return definition
+}
+
+// All returns the definitions of all instruments, in declaration order.
+func All() []Definition {
+	return append([]Definition(nil), definitions...)
+}
+
+// Int64Counter defines a counter of int64 values.
+type Int64Counter struct{ Definition }
+
+// New creates the counter with meter.
+func (d Int64Counter) New(meter metric.Meter) (metric.Int64Counter, error) {
+	return meter.Int64Counter(d.Name, metric.WithDescription(d.Description), metric.WithUnit(d.Unit))
+}
+
+// Int64UpDownCounter defines an up-down counter of int64 values.
+type Int64UpDownCounter struct{ Definition }
+
+// New creates the up-down counter with meter.
+func (d Int64UpDownCounter) New(meter metric.Meter) (metric.Int64UpDownCounter, error) {
+	return meter.Int64UpDownCounter(d.Name, metric.WithDescription(d.Description), metric.WithUnit(d.Unit))
+}
+
+// Float64Histogram defines a histogram of float64 values.
+type Float64Histogram struct{ Definition }
+
+// New creates the histogram with meter.
+func (d Float64Histogram) New(meter metric.Meter) (metric.Float64Histogram, error) {
+	return meter.Float64Histogram(d.Name, metric.WithDescription(d.Description), metric.WithUnit(d.Unit))
+}
+
+// Int64Gauge defines an observable gauge of int64 values.
+type Int64Gauge struct{ Definition }
+
+// New creates the gauge with meter, reporting what callback observes.
+func (d Int64Gauge) New(meter metric.Meter, callback metric.Int64Callback) (metric.Int64ObservableGauge, error) {
+	return meter.Int64ObservableGauge(d.Name, metric.WithDescription(d.Description), metric.WithUnit(d.Unit),
+		metric.WithInt64Callback(callback))
+}
+
+// Int64ObservableCounter defines an observable counter of int64 values.
+type Int64ObservableCounter struct{ Definition }
+
+// New creates the counter with meter, reporting the totals callback
+// observes.
+func (d Int64ObservableCounter) New(meter metric.Meter, callback metric.Int64Callback) (metric.Int64ObservableCounter, error) {
+	return meter.Int64ObservableCounter(d.Name, metric.WithDescription(d.Description), metric.WithUnit(d.Unit),
+		metric.WithInt64Callback(callback))
+}
+
+// Float64ObservableCounter defines an observable counter of float64 values.
+type Float64ObservableCounter struct{ Definition }
+
+// New creates the counter with meter, reporting the totals callback
+// observes.
+func (d Float64ObservableCounter) New(meter metric.Meter, callback metric.Float64Callback) (metric.Float64ObservableCounter, error) {
+	return meter.Float64ObservableCounter(d.Name, metric.WithDescription(d.Description), metric.WithUnit(d.Unit),
+		metric.WithFloat64Callback(callback))
+}
+
+// The instruments of the service.
+var (
+	NumberOfExec = Int64Counter{define("number.of.exec",
+		"Count the number of executions.", "")}
+
+	LogEntries = Int64Counter{define("log.entries",
+		"Count log entries by level and component.", "")}
+	PropagationConflicts = Int64Counter{define("propagation.conflicts",
+		"Count requests whose W3C and B3 headers named different traces.", "")}
+	DroppedAttributes = Int64Counter{define("dropped.attributes",
+		"Count span attributes removed by the attribute filter.", "")}
+	LogExports = Int64Counter{define("log.exports",
+		"Count the log records handed to the OTLP log exporter, by outcome.", "")}
+	LogPending = Int64Gauge{define("log.pending",
+		"Log records emitted to the OTLP pipeline and not exported yet, including those dropped by a full queue.", "")}
+	LogConversionErrors = Int64Counter{define("log.conversion.errors",
+		"Count the log fields of a type OTLP has no counterpart for, sent as strings.", "")}
+
+	DependencyLatency = Float64Histogram{define("dependency.latency",
+		"Time taken by the health probe of a dependency in milliseconds.", "ms")}
+	DependencyUp = Int64Gauge{define("dependency.up",
+		"Reports 1 when the last probe of a dependency succeeded, 0 otherwise.", "")}
+
+	CollapsedReads = Int64Counter{define("collapsed.reads",
+		"Count the reads answered by a query already in flight for the same name.", "")}
+	DBConnectionAcquire = Float64Histogram{define("db.connection.acquire",
+		"Time spent waiting for a database connection from the pool, in milliseconds.", "ms")}
+	DBChaosInjected = Int64Counter{define("db.chaos.injected",
+		"Count the faults injected into database calls by the chaos driver, by kind.", "")}
+
+	HTTPRequests = Int64Counter{define("http.requests",
+		"Count the requests by route, method and status class.", "")}
+	HTTPErrors = Int64Counter{define("http.errors",
+		"Count the requests answered with a 5xx status, by route and method.", "")}
+	HTTPDuration = Float64Histogram{define("http.duration",
+		"Request duration in milliseconds by route, method and status class.", "ms")}
+	TaskLateness = Float64Histogram{define("task.lateness",
+		"How long after their due time scheduled tasks started, in milliseconds.", "ms")}
+	TaskExecutions = Int64Counter{define("task.executions",
+		"Count the runs of scheduled tasks by outcome.", "")}
+	TasksOverdue = Int64Gauge{define("tasks.overdue",
+		"Scheduled tasks past their due time and not started yet.", "")}
+
+	TenantRequests = Int64ObservableCounter{define("tenant.requests",
+		"Requests served for each tenant, for chargeback.", "")}
+	TenantDBTime = Float64ObservableCounter{define("tenant.db.time",
+		"Database time spent for each tenant, in milliseconds, for chargeback.", "ms")}
+	TenantDownstreamTime = Float64ObservableCounter{define("tenant.downstream.time",
+		"Time spent calling downstream services for each tenant, in milliseconds, for chargeback.", "ms")}
+
+	MiddlewareDuration = Float64Histogram{define("middleware.duration",
+		"Time spent in each middleware, excluding the layers below it, in milliseconds.", "ms")}
+	FrameworkOverhead = Float64Histogram{define("framework.overhead",
+		"Time spent in middleware and routing outside the handler, in milliseconds.", "ms")}
+	PriorityLatency = Float64Histogram{define("priority.latency",
+		"Request latency in milliseconds by priority class.", "ms")}
+	OversizedRequests = Int64Counter{define("oversized.requests",
+		"Count the number of requests rejected for an oversized body.", "")}
+	LatencyAnomalies = Int64Counter{define("latency.anomalies",
+		"Count requests whose latency deviates from the route baseline.", "")}
+	SerializationDuration = Float64Histogram{define("serialization.duration",
+		"Time spent encoding JSON responses, in milliseconds, by encoder.", "ms")}
+
+	ConnectionsAccepted = Int64Counter{define("connections.accepted",
+		"Count the TCP connections accepted.", "")}
+	ConnectionsClosed = Int64Counter{define("connections.closed",
+		"Count the TCP connections closed.", "")}
+	ConnectionsActive = Int64UpDownCounter{define("connections.active",
+		"Number of open TCP connections.", "")}
+	ConnectionLifetime = Float64Histogram{define("connection.lifetime",
+		"How long TCP connections stayed open, in milliseconds.", "ms")}
+	TLSHandshakeFailures = Int64Counter{define("tls.handshake.failures",
+		"Count the TLS handshakes that failed.", "")}
+
+	ExporterRTT = Float64Histogram{define("exporter.rtt",
+		"Round-trip time to the OTLP endpoint in milliseconds.", "ms")}
+	ExporterUp = Int64Gauge{define("exporter.up",
+		"Reports 1 when the OTLP endpoint is reachable, 0 otherwise.", "")}
+	ExportedSpans = Int64Counter{define("telemetry.spans",
+		"Count the spans handed to the exporter.", "")}
+	ExportedBytes = Int64Counter{define("telemetry.bytes",
+		"Estimated serialized size of the spans handed to the exporter.", "By")}
+	DroppedSpans = Int64Counter{define("dropped.spans",
+		"Count the spans dropped because the batch span processor queue was full.", "")}
+	TelemetryErrors = Int64Counter{define("telemetry.errors",
+		"Count the errors reported by the OpenTelemetry SDK.", "")}
+)
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/metrics"
+)
+
+// middleware is one named layer of the request pipeline.
+type middleware struct {
+	name string
+	wrap func(http.Handler) http.Handler
+}
+
+// pipeline lists the middlewares of the router, outermost first.
+type pipeline []middleware
+
+// apply installs the pipeline on router. With timing enabled, every layer
+// also records its own cost, that is the time between entering it and
+// entering the next one plus the time after the next one returns: on the
+// middleware.duration histogram, and as app.middleware.<name>.ms on the
+// server span for the layers that run inside it.
+func (p pipeline) apply(router *mux.Router, timing bool) error {
+	if !timing {
+		for _, m := range p {
+			router.Use(m.wrap)
+		}
+		return nil
+	}
+	duration, err := metrics.MiddlewareDuration.New(meter)
+	if err != nil {
+		return err
+	}
+	for i, m := range p {
+		router.Use(timedMiddleware(i, len(p), m, duration))
+	}
+	// The innermost layer times the handler, so the last middleware can
+	// subtract it
+	router.Use(timedMiddleware(len(p), len(p), middleware{"handler", identity}, nil))
+	return nil
+}
+
+// handler lists the pipeline, outermost first.
+func (p pipeline) handler(writer http.ResponseWriter, request *http.Request) {
+	names := make([]string, len(p))
+	for i, m := range p {
+		names[i] = m.name
+	}
+	writer.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(names)
+}
+
+type middlewareTimingsKey struct{}
+
+// middlewareTimings holds how long the subtree below each layer took.
+type middlewareTimings struct {
+	totals []time.Duration
+}
+
+func timedMiddleware(index, layers int, m middleware,
+	duration metric.Float64Histogram) func(http.Handler) http.Handler {
+
+	return func(next http.Handler) http.Handler {
+		wrapped := m.wrap(next)
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			ctx := request.Context()
+			timings, ok := ctx.Value(middlewareTimingsKey{}).(*middlewareTimings)
+			if !ok {
+				timings = &middlewareTimings{totals: make([]time.Duration, layers+1)}
+				ctx = context.WithValue(ctx, middlewareTimingsKey{}, timings)
+				request = request.WithContext(ctx)
+			}
+
+			start := clk.Now()
+			wrapped.ServeHTTP(writer, request)
+			timings.totals[index] = clk.Since(start)
+			if duration == nil {
+				return
+			}
+
+			self := timings.totals[index] - timings.totals[index+1]
+			ms := float64(self) / float64(time.Millisecond)
+			duration.Record(ctx, ms, metric.WithAttributes(attribute.String("middleware", m.name)))
+			trace.SpanFromContext(ctx).SetAttributes(
+				attribute.Float64("app.middleware."+m.name+".ms", ms))
+		})
+	}
+}
+
+func identity(next http.Handler) http.Handler {
+	return next
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// migrationFiles holds the schema of each database, as numbered SQL files
+// such as migrations/sqlite/0001_create_stats.sql applied in order.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+var (
+	migrationVersionKey = attribute.Key("db.migration.version")
+	migrationNameKey    = attribute.Key("db.migration.name")
+	migrationCountKey   = attribute.Key("db.migration.count")
+)
+
+// createMigrationsTable records the migrations applied, in a form every
+// supported database takes.
+const createMigrationsTable = "CREATE TABLE IF NOT EXISTS schema_migrations " +
+	"(version BIGINT PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at VARCHAR(64) NOT NULL)"
+
+// migrationDialect is where the migrations of a DB_DRIVER are and how
+// their application is recorded.
+type migrationDialect struct {
+	dir    string
+	record string
+}
+
+var migrationDialects = map[string]migrationDialect{
+	"sqlite3": {"migrations/sqlite",
+		"INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"},
+	"postgres": {"migrations/postgres",
+		"INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)"},
+	"mysql": {"migrations/mysql",
+		"INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"},
+}
+
+// migration is one file of migrationFiles.
+type migration struct {
+	version int64
+	name    string
+	file    string
+}
+
+// id is the file name of m without its extension, such as
+// 0001_create_stats.
+func (m migration) id() string {
+	return strings.TrimSuffix(path.Base(m.file), ".sql")
+}
+
+// loadMigrations returns the migrations in dir, ordered by version.
+func loadMigrations(dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	var migrations []migration
+	seen := make(map[int64]string)
+	for _, entry := range entries {
+		base, ok := strings.CutSuffix(entry.Name(), ".sql")
+		if !ok {
+			continue
+		}
+		prefix, name, _ := strings.Cut(base, "_")
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s does not start with a version number", entry.Name())
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", other, entry.Name())
+		}
+		seen[version] = entry.Name()
+		migrations = append(migrations, migration{version: version, name: name, file: path.Join(dir, entry.Name())})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+// pendingMigrations returns the migrations of driver not applied to db yet.
+func pendingMigrations(ctx context.Context, db *sql.DB, driver string) ([]migration, error) {
+	migrations, err := loadMigrations(migrationDialects[driver].dir)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.ExecContext(ctx, createMigrationsTable); err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int64]bool)
+	for rows.Next() {
+		var version int64
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var pending []migration
+	for _, m := range migrations {
+		if !applied[m.version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// migrateDatabase applies the pending migrations of driver to db, each in
+// a transaction and a span of its own under a "migrate" trace, and
+// returns how many it applied.
+func migrateDatabase(ctx context.Context, db *sql.DB, driver string) (int, error) {
+	ctx, span := tracer.Start(ctx, "migrate", trace.WithNewRoot())
+	defer span.End()
+
+	pending, err := pendingMigrations(ctx, db, driver)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return 0, err
+	}
+	span.SetAttributes(migrationCountKey.Int(len(pending)))
+	for i, m := range pending {
+		if err := applyMigration(ctx, db, migrationDialects[driver], m); err != nil {
+			err = fmt.Errorf("migration %s: %w", m.id(), err)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return i, err
+		}
+		log.WithField("migration", m.id()).Info("applied migration")
+	}
+	return len(pending), nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, dialect migrationDialect, m migration) error {
+	ctx, span := tracer.Start(ctx, "migration "+m.id(),
+		trace.WithAttributes(migrationVersionKey.Int64(m.version), migrationNameKey.String(m.name)))
+	defer span.End()
+
+	err := func() error {
+		script, err := migrationFiles.ReadFile(m.file)
+		if err != nil {
+			return err
+		}
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for _, statement := range migrationStatements(string(script)) {
+			if _, err := tx.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, dialect.record, m.version, m.name, clk.Now().UTC().Format(time.RFC3339)); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// migrationStatements splits script into its statements, which end with a
+// semicolon at the end of a line, dropping the comment lines and the
+// semicolons, which not every driver takes.
+func migrationStatements(script string) []string {
+	var statements []string
+	var statement strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		statement.WriteString(line)
+		statement.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSuffix(strings.TrimSpace(statement.String()), ";"))
+			statement.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(statement.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+	return statements
+}
+
+// migrateOnStart is unset by DB_MIGRATE=false, for deployments that apply
+// the migrations once with the migrate command rather than from every
+// replica as it starts.
+var migrateOnStart = envBool("DB_MIGRATE", true)
+
+// migrateOnStartup applies the pending migrations of driver to db, unless
+// they are left to the migrate command.
+func migrateOnStartup(ctx context.Context, driver string) {
+	if !migrateOnStart {
+		log.Info("leaving the database migrations to the migrate command")
+		return
+	}
+	applied, err := migrateDatabase(ctx, db, driver)
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to migrate the database", err)
+	}
+	log.WithField("applied", applied).Info("database schema is up to date")
+}
+
+// runMigrate applies the pending migrations of the database configured by
+// DB_DRIVER and DB_DSN, then exits.
+func runMigrate(ctx context.Context) {
+	migrateOnStart = true
+	initTelemetry(ctx)
+	initStorage(ctx)
+	if db == nil {
+		log.Warn("no database to migrate with DB_DRIVER=memory")
+	}
+
+	// Export the migration traces before the process exits
+	flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout())
+	defer cancel()
+	if err := shutdownTelemetry(flushCtx); err != nil {
+		log.Warnf("failed to flush telemetry: %v", err)
+	}
+}
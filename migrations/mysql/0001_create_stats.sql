@@ -0,0 +1,2 @@
+-- MySQL cannot index TEXT, and the counts can outgrow 32 bits
+CREATE TABLE IF NOT EXISTS stats (name VARCHAR(255) PRIMARY KEY, count BIGINT NOT NULL);
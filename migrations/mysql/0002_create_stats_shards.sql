@@ -0,0 +1,3 @@
+-- Hot counts spread over several rows with COUNTER_SHARDS, so concurrent
+-- increments of one name lock different rows
+CREATE TABLE IF NOT EXISTS stats_shards (name VARCHAR(255), shard INT, count BIGINT NOT NULL, PRIMARY KEY (name, shard));
@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS stats (name VARCHAR(255) PRIMARY KEY, count BIGINT NOT NULL);
@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS stats (name TEXT PRIMARY KEY, count INTEGER);
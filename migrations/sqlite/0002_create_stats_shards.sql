@@ -0,0 +1,2 @@
+-- Hot counts spread over several rows with COUNTER_SHARDS
+CREATE TABLE IF NOT EXISTS stats_shards (name TEXT, shard INTEGER, count INTEGER, PRIMARY KEY (name, shard));
@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS webhooks (name TEXT, url TEXT, PRIMARY KEY (name, url));
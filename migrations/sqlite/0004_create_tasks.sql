@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS tasks (id TEXT PRIMARY KEY, name TEXT, status TEXT, due INTEGER,
+    attempts INTEGER, max_attempts INTEGER, message TEXT, error TEXT, created INTEGER, finished INTEGER,
+    traceparent TEXT);
+-- The scheduler polls for the pending tasks that are due
+CREATE INDEX IF NOT EXISTS tasks_due ON tasks (status, due);
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestMigrationStatements(t *testing.T) {
+	script := `-- The counts of each name
+CREATE TABLE stats (name TEXT PRIMARY KEY,
+    count INTEGER);
+
+-- Looked up by count
+CREATE INDEX stats_count ON stats (count);
+INSERT INTO stats (name, count) VALUES ('a;b', 1)`
+	want := []string{
+		"CREATE TABLE stats (name TEXT PRIMARY KEY,\n    count INTEGER)",
+		"CREATE INDEX stats_count ON stats (count)",
+		"INSERT INTO stats (name, count) VALUES ('a;b', 1)",
+	}
+	if got := migrationStatements(script); !slices.Equal(got, want) {
+		t.Errorf("migrationStatements = %q, want %q", got, want)
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	for driver, dialect := range migrationDialects {
+		migrations, err := loadMigrations(dialect.dir)
+		if err != nil {
+			t.Fatalf("%s: %v", driver, err)
+		}
+		if len(migrations) == 0 {
+			t.Fatalf("%s: no migrations in %s", driver, dialect.dir)
+		}
+		for i, m := range migrations {
+			if m.version != int64(i+1) {
+				t.Errorf("%s: migration %s has version %d, want %d", driver, m.id(), m.version, i+1)
+			}
+		}
+	}
+}
+
+func TestMigrateDatabaseAppliesEachMigrationOnce(t *testing.T) {
+	db := openTestSQLite(t)
+	migrations, err := loadMigrations(migrationDialects["sqlite3"].dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recorded int
+	if err := db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&recorded); err != nil {
+		t.Fatal(err)
+	}
+	if recorded != len(migrations) {
+		t.Errorf("%d migrations recorded, want %d", recorded, len(migrations))
+	}
+
+	applied, err := migrateDatabase(context.Background(), db, "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != 0 {
+		t.Errorf("applied %d migrations again, want none", applied)
+	}
+	if _, err := db.Exec("INSERT INTO stats (name, count) VALUES (?, ?)", "zoe", 1); err != nil {
+		t.Errorf("the stats table was not created: %v", err)
+	}
+}
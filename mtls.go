@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var clientSubjectKey = attribute.Key("tls.client.subject")
+
+// serverTLSConfig returns the TLS configuration of the listeners serving
+// TLS, with the certificate from TLS_CERT_FILE and TLS_KEY_FILE. When
+// TLS_CLIENT_CA_FILE is set, clients must present a certificate signed by
+// one of the CAs in that file; handshakes without one fail and are counted
+// in tls.handshake.failures.
+func serverTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE are required to serve TLS")
+	}
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{certificate},
+	}
+	caFile := os.Getenv("TLS_CLIENT_CA_FILE")
+	if caFile == "" {
+		return config, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// recordClientCertificate records the subject of the verified client
+// certificate on the server span.
+func recordClientCertificate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.TLS != nil && len(request.TLS.PeerCertificates) > 0 {
+			trace.SpanFromContext(request.Context()).SetAttributes(
+				clientSubjectKey.String(request.TLS.PeerCertificates[0].Subject.String()))
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// testCertificate is a certificate and its key, with the PEM files of both
+// written to a directory of the test.
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certFile    string
+	keyFile     string
+}
+
+// newTestCertificate creates a certificate from template, signed by parent
+// or self-signed when parent is nil.
+func newTestCertificate(t *testing.T, name string, template *x509.Certificate, parent *testCertificate) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	c := &testCertificate{
+		certificate: certificate,
+		key:         key,
+		certFile:    filepath.Join(dir, name+".crt"),
+		keyFile:     filepath.Join(dir, name+".key"),
+	}
+	writePEM(t, c.certFile, "CERTIFICATE", der)
+	writePEM(t, c.keyFile, "EC PRIVATE KEY", keyDER)
+	return c
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newMutualTLSServer serves recordClientCertificate under a span of its
+// own with the configuration of serverTLSConfig, requiring certificates
+// signed by ca, and returns the server with the spans it ended.
+func newMutualTLSServer(t *testing.T, ca *testCertificate) (*httptest.Server, *tracetest.SpanRecorder) {
+	t.Helper()
+	server := newTestCertificate(t, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "hello-app"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	t.Setenv("TLS_CERT_FILE", server.certFile)
+	t.Setenv("TLS_KEY_FILE", server.keyFile)
+	t.Setenv("TLS_CLIENT_CA_FILE", ca.certFile)
+	config, err := serverTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	handler := recordClientCertificate(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {}))
+	httpServer := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx, span := provider.Tracer("test").Start(request.Context(), "request")
+		defer span.End()
+		handler.ServeHTTP(writer, request.WithContext(ctx))
+	}))
+	httpServer.TLS = config
+	httpServer.StartTLS()
+	t.Cleanup(httpServer.Close)
+	return httpServer, recorder
+}
+
+func TestServerTLSConfigRequiresClientCertificates(t *testing.T) {
+	ca := newTestCertificate(t, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	client := newTestCertificate(t, "client", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "client", Organization: []string{"tests"}},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	server, recorder := newMutualTLSServer(t, ca)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+	get := func(certificates ...tls.Certificate) error {
+		httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: certificates,
+		}}}
+		response, err := httpClient.Get(server.URL)
+		if err != nil {
+			return err
+		}
+		return response.Body.Close()
+	}
+
+	if err := get(); err == nil {
+		t.Error("a client without a certificate was served")
+	}
+	keyPair, err := tls.LoadX509KeyPair(client.certFile, client.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get(keyPair); err != nil {
+		t.Fatalf("the client with a certificate was refused: %v", err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want the one of the served request", len(spans))
+	}
+	want := attribute.String(string(clientSubjectKey), "CN=client,O=tests")
+	for _, attr := range spans[0].Attributes() {
+		if attr == want {
+			return
+		}
+	}
+	t.Errorf("span attributes %v lack %v", spans[0].Attributes(), want)
+}
+
+func TestServerTLSConfigWithoutClientCA(t *testing.T) {
+	t.Setenv("TLS_CERT_FILE", "")
+	if _, err := serverTLSConfig(); err == nil {
+		t.Error("serverTLSConfig accepted a missing TLS_CERT_FILE")
+	}
+
+	certificate := newTestCertificate(t, "server", &x509.Certificate{
+		Subject: pkix.Name{CommonName: "hello-app"},
+	}, nil)
+	t.Setenv("TLS_CERT_FILE", certificate.certFile)
+	t.Setenv("TLS_KEY_FILE", certificate.keyFile)
+	t.Setenv("TLS_CLIENT_CA_FILE", "")
+	config, err := serverTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.NoClientCert || config.ClientCAs != nil {
+		t.Errorf("client certificates are requested without TLS_CLIENT_CA_FILE")
+	}
+}
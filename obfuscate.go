@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/requestcontext"
+)
+
+const nameTokenPrefix = "u_"
+
+// nameObfuscator replaces user names in telemetry with tokens. A token is
+// the name encrypted with AES-GCM under a key derived from
+// NAME_OBFUSCATION_KEY, with a nonce derived from the name itself, so the
+// same name always gets the same token and traces of one user can still be
+// correlated. Only someone holding the key can turn a token back into the
+// name, with the reveal-name command.
+type nameObfuscator struct {
+	aead   cipher.AEAD
+	macKey []byte
+}
+
+func newNameObfuscator(secret string) (*nameObfuscator, error) {
+	encryption := sha256.Sum256([]byte("encryption:" + secret))
+	block, err := aes.NewCipher(encryption[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	macKey := sha256.Sum256([]byte("nonce:" + secret))
+	return &nameObfuscator{aead: aead, macKey: macKey[:]}, nil
+}
+
+// obfuscate returns the token of name.
+func (o *nameObfuscator) obfuscate(name string) string {
+	mac := hmac.New(sha256.New, o.macKey)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:o.aead.NonceSize()]
+	sealed := o.aead.Seal(append([]byte(nil), nonce...), nonce, []byte(name), nil)
+	return nameTokenPrefix + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// reveal returns the name a token was made from.
+func (o *nameObfuscator) reveal(token string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, nameTokenPrefix))
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < o.aead.NonceSize() {
+		return "", fmt.Errorf("token too short")
+	}
+	nonce, ciphertext := sealed[:o.aead.NonceSize()], sealed[o.aead.NonceSize():]
+	name, err := o.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("token was not made with this key")
+	}
+	return string(name), nil
+}
+
+// obfuscatorFromEnv returns the obfuscator keyed by NAME_OBFUSCATION_KEY.
+func obfuscatorFromEnv() (*nameObfuscator, error) {
+	secret := os.Getenv("NAME_OBFUSCATION_KEY")
+	if secret == "" {
+		return nil, fmt.Errorf("NAME_OBFUSCATION_KEY is required to obfuscate user names")
+	}
+	return newNameObfuscator(secret)
+}
+
+// initNameObfuscation makes telemetry carry tokens instead of user names
+// when NAME_OBFUSCATION is set, which it is by default in production.
+func initNameObfuscation() error {
+	if !envBool("NAME_OBFUSCATION", deploymentEnvironment() == "production") {
+		return nil
+	}
+	obfuscator, err := obfuscatorFromEnv()
+	if err != nil {
+		return err
+	}
+	requestcontext.SetObfuscator(obfuscator.obfuscate)
+	return nil
+}
+
+// nameRoutes match the paths of the service that carry a user name, for
+// the proxy and the demo, which see the paths without routing them.
+var nameRoutes = func() *mux.Router {
+	router := mux.NewRouter()
+	for _, template := range []string{"/hello/{name}", "/stats/{name}", "/stats/{name}/watch", "/stats/{name}/webhooks"} {
+		router.NewRoute().Path(template)
+	}
+	return router
+}()
+
+// obfuscatedTarget returns the path and query of target with the user name
+// in it replaced by its token, as requestcontext.Middleware records them
+// for the service, or false when there is no name to replace.
+func obfuscatedTarget(target *url.URL) (string, bool) {
+	var match mux.RouteMatch
+	routed := &http.Request{Method: http.MethodGet, URL: &url.URL{Path: strings.TrimPrefix(target.Path, basePath)}}
+	if !nameRoutes.Match(routed, &match) {
+		return "", false
+	}
+	name := match.Vars["name"]
+	token := requestcontext.Obfuscate(name)
+	if token == name {
+		return "", false
+	}
+	return strings.ReplaceAll(target.RequestURI(), url.PathEscape(name), token), true
+}
+
+// obfuscateTarget replaces the http.target the instrumentation recorded on
+// the server span of a request with its obfuscatedTarget.
+func obfuscateTarget(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if target, ok := obfuscatedTarget(request.URL); ok {
+			trace.SpanFromContext(request.Context()).SetAttributes(attribute.String("http.target", target))
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// obfuscatingTransport replaces the http.url the instrumentation recorded on
+// the client span of a request with one holding its obfuscatedTarget. It
+// goes under otelhttp.NewTransport, which passes the request on with its
+// span.
+type obfuscatingTransport struct {
+	base http.RoundTripper
+}
+
+func (t obfuscatingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if target, ok := obfuscatedTarget(request.URL); ok {
+		trace.SpanFromContext(request.Context()).SetAttributes(
+			attribute.String("http.url", request.URL.Scheme+"://"+request.URL.Host+target))
+	}
+	return t.base.RoundTrip(request)
+}
+
+// revealNames prints the names behind the tokens given as arguments.
+func revealNames(tokens []string) error {
+	obfuscator, err := obfuscatorFromEnv()
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		name, err := obfuscator.reveal(token)
+		if err != nil {
+			return fmt.Errorf("%s: %w", token, err)
+		}
+		fmt.Printf("%s\t%s\n", token, name)
+	}
+	return nil
+}
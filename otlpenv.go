@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"otel-with-golang/pkg/otelboot"
+)
+
+// The ports of OTEL_EXPORTER_OTLP_ENDPOINT when its URL does not name one.
+const (
+	defaultOTLPGRPCPort = "4317"
+	defaultOTLPHTTPPort = "4318"
+)
+
+// telemetryDisabled is set by TELEMETRY_DISABLED=true for air-gapped
+// environments: the providers are no-ops, so the instrumentation still runs
+// but nothing is exported, and nothing probes the exporter endpoint.
+var telemetryDisabled = envBool("TELEMETRY_DISABLED", false)
+
+// exporterProtocol returns the OTLP protocol, grpc or http/protobuf, from
+// EXPORTER_PROTOCOL or else the standard OTEL_EXPORTER_OTLP_PROTOCOL.
+func exporterProtocol() string {
+	for _, key := range []string{"EXPORTER_PROTOCOL", "OTEL_EXPORTER_OTLP_PROTOCOL"} {
+		if protocol := os.Getenv(key); protocol != "" {
+			return protocol
+		}
+	}
+	return otelboot.ProtocolGRPC
+}
+
+// exporterEndpoint returns the host:port of the OTLP endpoint, from the
+// standard OTEL_EXPORTER_OTLP_ENDPOINT URL or else the legacy
+// EXPORTER_ENDPOINT.
+func exporterEndpoint() string {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if endpoint == "" {
+		return os.Getenv("EXPORTER_ENDPOINT")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return endpoint
+	}
+	if u.Port() == "" {
+		if exporterProtocol() == otelboot.ProtocolHTTP {
+			return net.JoinHostPort(u.Hostname(), defaultOTLPHTTPPort)
+		}
+		return net.JoinHostPort(u.Hostname(), defaultOTLPGRPCPort)
+	}
+	return u.Host
+}
+
+// exporterHeaders returns the headers sent with every export, from the
+// standard OTEL_EXPORTER_OTLP_HEADERS, whose values are URL-encoded, or
+// else the legacy EXPORTER_HEADERS.
+func exporterHeaders() (map[string]string, error) {
+	headers := os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")
+	if headers == "" {
+		headersMap, err := parseHeaders(os.Getenv("EXPORTER_HEADERS"))
+		if err != nil {
+			return nil, fmt.Errorf("EXPORTER_HEADERS: %w", err)
+		}
+		return headersMap, nil
+	}
+	headersMap := make(map[string]string)
+	for _, headerItem := range strings.Split(headers, ",") {
+		key, value, ok := strings.Cut(headerItem, "=")
+		if !ok {
+			log.WithField("key", "OTEL_EXPORTER_OTLP_HEADERS").Warnf("ignoring malformed header %q", headerItem)
+			continue
+		}
+		if unescaped, err := url.QueryUnescape(value); err == nil {
+			value = unescaped
+		}
+		headersMap[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return headersMap, nil
+}
+
+// exporterOptions returns the exporter settings of the telemetry setup read
+// from the environment. The generated collector configuration starts from
+// the same settings, so the collector exports the way the service would.
+func exporterOptions() (otelboot.Options, error) {
+	tlsConfig, err := exporterTLSConfig()
+	if err != nil {
+		return otelboot.Options{}, err
+	}
+	opts := otelboot.Options{
+		// Some collectors and APM deployments only take OTLP/HTTP
+		Protocol:   exporterProtocol(),
+		PathPrefix: os.Getenv("EXPORTER_PATH"),
+		// Local collectors usually listen without TLS
+		Insecure:  envBool("EXPORTER_INSECURE", false),
+		TLSConfig: tlsConfig,
+	}
+	// The exporters read the standard OTEL_EXPORTER_OTLP_* variables
+	// themselves; the legacy ones are only a fallback
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		opts.Endpoint = exporterEndpoint()
+	}
+	if os.Getenv("OTEL_EXPORTER_OTLP_HEADERS") == "" {
+		if opts.Headers, err = exporterHeaders(); err != nil {
+			return otelboot.Options{}, err
+		}
+	}
+	return opts, nil
+}
+
+// exporterTLSFiles returns the CA bundle, client certificate and client
+// key files named by EXPORTER_CA_FILE, EXPORTER_CLIENT_CERT_FILE and
+// EXPORTER_CLIENT_KEY_FILE.
+func exporterTLSFiles() (caFile, certFile, keyFile string) {
+	return os.Getenv("EXPORTER_CA_FILE"), os.Getenv("EXPORTER_CLIENT_CERT_FILE"), os.Getenv("EXPORTER_CLIENT_KEY_FILE")
+}
+
+// exporterTLSConfig returns the TLS configuration of the exporters when
+// EXPORTER_CA_FILE or EXPORTER_CLIENT_CERT_FILE and EXPORTER_CLIENT_KEY_FILE
+// are set: the CA bundle replaces the system roots, for collectors behind a
+// private PKI, and the client certificate is presented to collectors
+// requiring mutual TLS. It returns nil otherwise, leaving the exporters to
+// the standard OTEL_EXPORTER_OTLP_CERTIFICATE and related variables.
+func exporterTLSConfig() (*tls.Config, error) {
+	caFile, certFile, keyFile := exporterTLSFiles()
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("EXPORTER_CLIENT_CERT_FILE and EXPORTER_CLIENT_KEY_FILE must be set together")
+		}
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	otellog "go.opentelemetry.io/otel/log"
+	"go.opentelemetry.io/otel/log/global"
+)
+
+// listenCounting accepts connections on a local port and closes them
+// straight away, counting them.
+func listenCounting(t *testing.T) (string, *atomic.Int64) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var accepted atomic.Int64
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String(), &accepted
+}
+
+func TestTelemetryDisabledMakesNoNetworkCalls(t *testing.T) {
+	endpoint, accepted := listenCounting(t)
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://"+endpoint)
+	t.Setenv("EXPORTER_INSECURE", "true")
+	t.Setenv("METRIC_EXPORT_INTERVAL", "10ms")
+	t.Setenv("SPAN_BATCH_TIMEOUT", "10ms")
+	previous, previousTracer := telemetryDisabled, tracer
+	telemetryDisabled = true
+	t.Cleanup(func() { telemetryDisabled, tracer = previous, previousTracer })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	initTelemetry(ctx)
+
+	// Use every signal, then flush them
+	_, span := tracer.Start(ctx, "air-gapped")
+	span.End()
+	numberOfExec.Add(ctx, 1)
+	var record otellog.Record
+	record.SetBody(otellog.StringValue("air-gapped"))
+	global.GetLoggerProvider().Logger("test").Emit(ctx, record)
+	time.Sleep(100 * time.Millisecond)
+	if err := shutdownTelemetry(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := dependencyChecks()["otlp"]; ok {
+		t.Error("the OTLP endpoint is checked as a dependency")
+	}
+	if n := accepted.Load(); n != 0 {
+		t.Errorf("%d connections were made to the OTLP endpoint, want none", n)
+	}
+}
+
+func TestExporterHeaders(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"", map[string]string{}, false},
+		{"Authorization=ApiKey YWJjOmRlZg==, X-Tenant = acme,", map[string]string{"Authorization": "ApiKey YWJjOmRlZg==", "X-Tenant": "acme"}, false},
+		{"Authorization=Basic dXNlcjpwYXNz", map[string]string{"Authorization": "Basic dXNlcjpwYXNz"}, false},
+		{"Authorization", nil, true},
+		{"=token", nil, true},
+		{"a=1,b", nil, true},
+	}
+	for _, test := range tests {
+		t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "")
+		t.Setenv("EXPORTER_HEADERS", test.value)
+		got, err := exporterHeaders()
+		if (err != nil) != test.wantErr {
+			t.Errorf("exporterHeaders() with EXPORTER_HEADERS=%q failed with %v", test.value, err)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("exporterHeaders() with EXPORTER_HEADERS=%q = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
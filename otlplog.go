@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	otellog "go.opentelemetry.io/otel/log"
+	"go.opentelemetry.io/otel/log/global"
+	"go.opentelemetry.io/otel/metric"
+
+	"otel-with-golang/metrics"
+)
+
+// otlpLogHook sends every log entry to the global LoggerProvider, which
+// exports them as OTLP log records with the resource of the service. The
+// entries logged with a context, through log.WithContext, carry the trace
+// and span they were written in.
+type otlpLogHook struct {
+	logger           otellog.Logger
+	conversionErrors metric.Int64Counter
+	// severities overrides the severity of some levels, read from
+	// LOG_SEVERITY_OVERRIDES
+	severities map[logrus.Level]otellog.Severity
+}
+
+func newOTLPLogHook() (*otlpLogHook, error) {
+	conversionErrors, err := metrics.LogConversionErrors.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	severities, err := parseSeverityOverrides(envPairs("LOG_SEVERITY_OVERRIDES"))
+	if err != nil {
+		return nil, fmt.Errorf("LOG_SEVERITY_OVERRIDES: %w", err)
+	}
+	return &otlpLogHook{
+		logger:           global.GetLoggerProvider().Logger("io.opentelemetry.logs.hello"),
+		conversionErrors: conversionErrors,
+		severities:       severities,
+	}, nil
+}
+
+// parseSeverityOverrides reads overrides such as "warn=WARN2,panic=FATAL",
+// from logrus level names to OTLP severity names.
+func parseSeverityOverrides(pairs map[string]string) (map[logrus.Level]otellog.Severity, error) {
+	severities := make(map[logrus.Level]otellog.Severity, len(pairs))
+	for name, severityName := range pairs {
+		level, err := logrus.ParseLevel(name)
+		if err != nil {
+			return nil, err
+		}
+		severity, ok := parseSeverity(severityName)
+		if !ok {
+			return nil, fmt.Errorf("unknown severity %q", severityName)
+		}
+		severities[level] = severity
+	}
+	return severities, nil
+}
+
+// parseSeverity returns the OTLP severity named name, such as "INFO" or
+// "WARN2", in any case.
+func parseSeverity(name string) (otellog.Severity, bool) {
+	for severity := otellog.SeverityTrace1; severity <= otellog.SeverityFatal4; severity++ {
+		if strings.EqualFold(severity.String(), name) {
+			return severity, true
+		}
+	}
+	return otellog.SeverityUndefined, false
+}
+
+// severity returns the OTLP severity of level, overridden or not.
+func (h *otlpLogHook) severity(level logrus.Level) otellog.Severity {
+	if severity, ok := h.severities[level]; ok {
+		return severity
+	}
+	return logSeverity(level)
+}
+
+func (h *otlpLogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *otlpLogHook) Fire(entry *logrus.Entry) error {
+	// Failures of the export pipeline are logged; sending those entries
+	// through the same pipeline would only produce more of them
+	if entry.Data[componentField] == "telemetry" {
+		return nil
+	}
+	if entry.Data[sampledOutField] == true {
+		return nil
+	}
+	var record otellog.Record
+	record.SetTimestamp(entry.Time)
+	record.SetObservedTimestamp(clk.Now())
+	record.SetBody(otellog.StringValue(entry.Message))
+	record.SetSeverity(h.severity(entry.Level))
+	record.SetSeverityText(entry.Level.String())
+	ctx := entry.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	for key, value := range entry.Data {
+		converted, ok := logValue(value)
+		if !ok {
+			h.conversionErrors.Add(ctx, 1, metric.WithAttributes(attribute.String("field", key)))
+		}
+		record.AddAttributes(otellog.KeyValue{Key: key, Value: converted})
+	}
+	if logExportsMonitored.Load() {
+		logsPending.Add(1)
+	}
+	h.logger.Emit(ctx, record)
+	return nil
+}
+
+// logSeverity maps the logrus levels to the base OTLP severities, and a
+// panic, the most severe, to the last fatal one.
+func logSeverity(level logrus.Level) otellog.Severity {
+	switch level {
+	case logrus.TraceLevel:
+		return otellog.SeverityTrace
+	case logrus.DebugLevel:
+		return otellog.SeverityDebug
+	case logrus.InfoLevel:
+		return otellog.SeverityInfo
+	case logrus.WarnLevel:
+		return otellog.SeverityWarn
+	case logrus.ErrorLevel:
+		return otellog.SeverityError
+	case logrus.FatalLevel:
+		return otellog.SeverityFatal
+	case logrus.PanicLevel:
+		return otellog.SeverityFatal4
+	default:
+		return otellog.SeverityUndefined
+	}
+}
+
+// logValue converts a log field to an OTLP value. It reports false when
+// the type has no OTLP counterpart and the value is sent as a string.
+func logValue(value interface{}) (otellog.Value, bool) {
+	switch v := value.(type) {
+	case string:
+		return otellog.StringValue(v), true
+	case bool:
+		return otellog.BoolValue(v), true
+	case int:
+		return otellog.IntValue(v), true
+	case int64:
+		return otellog.Int64Value(v), true
+	case float64:
+		return otellog.Float64Value(v), true
+	case error:
+		return otellog.StringValue(v.Error()), true
+	default:
+		return otellog.StringValue(fmt.Sprint(v)), false
+	}
+}
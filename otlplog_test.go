@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	otellog "go.opentelemetry.io/otel/log"
+)
+
+func TestLogSeverity(t *testing.T) {
+	for _, test := range []struct {
+		level logrus.Level
+		want  otellog.Severity
+	}{
+		{logrus.TraceLevel, otellog.SeverityTrace},
+		{logrus.DebugLevel, otellog.SeverityDebug},
+		{logrus.InfoLevel, otellog.SeverityInfo},
+		{logrus.WarnLevel, otellog.SeverityWarn},
+		{logrus.ErrorLevel, otellog.SeverityError},
+		{logrus.FatalLevel, otellog.SeverityFatal},
+		{logrus.PanicLevel, otellog.SeverityFatal4},
+	} {
+		if got := logSeverity(test.level); got != test.want {
+			t.Errorf("logSeverity(%s) = %s, want %s", test.level, got, test.want)
+		}
+	}
+}
+
+func TestLogSeverityOverrides(t *testing.T) {
+	severities, err := parseSeverityOverrides(map[string]string{"warn": "WARN3", "panic": "fatal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := &otlpLogHook{severities: severities}
+	for _, test := range []struct {
+		level logrus.Level
+		want  otellog.Severity
+	}{
+		{logrus.WarnLevel, otellog.SeverityWarn3},
+		{logrus.PanicLevel, otellog.SeverityFatal},
+		{logrus.InfoLevel, otellog.SeverityInfo},
+	} {
+		if got := hook.severity(test.level); got != test.want {
+			t.Errorf("severity(%s) = %s, want %s", test.level, got, test.want)
+		}
+	}
+
+	for _, invalid := range []map[string]string{
+		{"loud": "WARN"},
+		{"warn": "WARN5"},
+		{"warn": ""},
+	} {
+		if _, err := parseSeverityOverrides(invalid); err == nil {
+			t.Errorf("parseSeverityOverrides(%v) accepted", invalid)
+		}
+	}
+}
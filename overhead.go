@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"otel-with-golang/metrics"
+)
+
+// overheadTimer measures the cost of everything wrapped around the
+// handlers (routing, otelmux and the other middleware) by pairing an outer
+// timing taken around the whole router with an inner timing taken around
+// the handler alone.
+type overheadTimer struct {
+	overhead metric.Float64Histogram
+}
+
+// handlerTiming is filled in by the inner layer and read by the outer one.
+type handlerTiming struct {
+	route    string
+	duration time.Duration
+}
+
+type handlerTimingKey struct{}
+
+func newOverheadTimer() (*overheadTimer, error) {
+	overhead, err := metrics.FrameworkOverhead.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	return &overheadTimer{overhead: overhead}, nil
+}
+
+// outer wraps the router.
+func (t *overheadTimer) outer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		timing := &handlerTiming{}
+		ctx := context.WithValue(request.Context(), handlerTimingKey{}, timing)
+		start := clk.Now()
+		next.ServeHTTP(writer, request.WithContext(ctx))
+		total := clk.Since(start)
+
+		if timing.route == "" {
+			// no handler ran, e.g. the route did not match
+			return
+		}
+		t.overhead.Record(ctx, float64(total-timing.duration)/float64(time.Millisecond),
+			metric.WithAttributes(attribute.String("http.route", timing.route)))
+	})
+}
+
+// inner wraps a single handler.
+func (t *overheadTimer) inner(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		start := clk.Now()
+		handler(writer, request)
+		timing, ok := request.Context().Value(handlerTimingKey{}).(*handlerTiming)
+		if !ok {
+			return
+		}
+		timing.duration = clk.Since(start)
+		timing.route = routeTemplate(request)
+	}
+}
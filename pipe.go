@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/logger"
+	"otel-with-golang/requestcontext"
+)
+
+var (
+	batchIndexKey    = attribute.Key("app.batch.index")
+	batchSizeKey     = attribute.Key("app.batch.size")
+	batchFailedKey   = attribute.Key("app.batch.failed")
+	recordIndexKey   = attribute.Key("app.record.index")
+	recordOutcomeKey = attribute.Key("app.record.outcome")
+	recordCountKey   = attribute.Key("app.record.count")
+	recordErrorKey   = attribute.Key("app.record.error")
+)
+
+// runPipe greets the names read from stdin, one per line, through the same
+// repository as the HTTP handlers, and writes a greeting per name to
+// stdout. The names are processed in batches of PIPE_BATCH_SIZE, each with
+// a trace of its own and an event per record, so batch jobs show up in
+// Elastic APM next to the requests. It exits with status 1 when a record
+// failed.
+func runPipe(ctx context.Context) {
+	batchSize := int(envInt("PIPE_BATCH_SIZE", 100))
+	if batchSize < 1 {
+		log.Fatalf("PIPE_BATCH_SIZE must be positive, got %d", batchSize)
+	}
+	if err := initNameObfuscation(); err != nil {
+		log.Fatalf("%s: %v", "failed to set up name obfuscation", err)
+	}
+	initTelemetry(ctx)
+	initStorage(ctx)
+
+	out := bufio.NewWriter(os.Stdout)
+	failed, err := pipeNames(ctx, os.Stdin, out, batchSize)
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		log.Errorf("failed to pipe names: %v", err)
+	}
+
+	// Export the batch traces before the process exits
+	flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout())
+	defer cancel()
+	if err := shutdownTelemetry(flushCtx); err != nil {
+		log.Warnf("failed to flush telemetry: %v", err)
+	}
+	if err != nil || failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// pipeNames reads the names from in and writes their greetings to out,
+// batchSize at a time, and returns how many records failed. Blank lines are
+// skipped.
+func pipeNames(ctx context.Context, in io.Reader, out io.Writer, batchSize int) (int, error) {
+	scanner := bufio.NewScanner(in)
+	var batch []string
+	failed := 0
+	for index := 0; ; index++ {
+		batch = batch[:0]
+		for len(batch) < batchSize && scanner.Scan() {
+			if name := strings.TrimSpace(scanner.Text()); name != "" {
+				batch = append(batch, name)
+			}
+		}
+		if len(batch) == 0 {
+			return failed, scanner.Err()
+		}
+		batchFailed, err := pipeBatch(ctx, index, batch, out)
+		failed += batchFailed
+		if err != nil {
+			return failed, err
+		}
+	}
+}
+
+// pipeBatch greets the names of one batch in a trace of its own, adding
+// an event per record to the batch span.
+func pipeBatch(ctx context.Context, index int, names []string, out io.Writer) (int, error) {
+	ctx, span := tracer.Start(ctx, "pipe batch",
+		trace.WithNewRoot(),
+		trace.WithAttributes(batchIndexKey.Int(index), batchSizeKey.Int(len(names))))
+	defer span.End()
+	ctx = logger.WithTransaction(ctx)
+
+	failed := 0
+	for i, name := range names {
+		recordCtx := requestcontext.WithUserName(ctx, name)
+		attrs := append(requestcontext.Attributes(recordCtx), recordIndexKey.Int(i))
+		rule := greetingRuleSet.match(name)
+		if rule.blocked {
+			span.AddEvent("record", trace.WithAttributes(append(attrs, recordOutcomeKey.String("blocked"))...))
+			continue
+		}
+		message, err := runJob(recordCtx, func(ctx context.Context) (string, error) {
+			count, err := updateRequestCount(ctx, name, rule.factor)
+			if err != nil {
+				return "", err
+			}
+			attrs = append(attrs, recordCountKey.Int(count))
+			return rule.greeting(count), nil
+		})
+		if err != nil {
+			failed++
+			span.AddEvent("record", trace.WithAttributes(append(attrs,
+				recordOutcomeKey.String("failed"), recordErrorKey.String(err.Error()))...))
+			logger.FromContext(recordCtx).WithField("record", i).Warnf("failed to greet: %v", err)
+			continue
+		}
+		span.AddEvent("record", trace.WithAttributes(append(attrs, recordOutcomeKey.String("done"))...))
+		if _, err := fmt.Fprintln(out, message); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return failed, err
+		}
+	}
+	span.SetAttributes(batchFailedKey.Int(failed))
+	if failed > 0 {
+		span.SetStatus(codes.Error, fmt.Sprintf("%d of %d records failed", failed, len(names)))
+	}
+	return failed, nil
+}
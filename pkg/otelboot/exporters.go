@@ -0,0 +1,123 @@
+package otelboot
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc/credentials"
+)
+
+// The protocols of Options.Protocol, named as in OTEL_EXPORTER_OTLP_PROTOCOL.
+const (
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http/protobuf"
+)
+
+func newSpanExporter(ctx context.Context, opts Options) (sdktrace.SpanExporter, error) {
+	if opts.Protocol == ProtocolHTTP {
+		options := exporterOptions(opts,
+			otlptracehttp.WithEndpoint,
+			otlptracehttp.WithHeaders,
+			otlptracehttp.WithTLSClientConfig,
+			otlptracehttp.WithInsecure,
+			otlptracehttp.WithTimeout)
+		if opts.PathPrefix != "" {
+			options = append(options, otlptracehttp.WithURLPath(opts.PathPrefix+"/v1/traces"))
+		}
+		return otlptracehttp.New(ctx, options...)
+	}
+	return otlptracegrpc.New(ctx, exporterOptions(opts,
+		otlptracegrpc.WithEndpoint,
+		otlptracegrpc.WithHeaders,
+		grpcTLS(otlptracegrpc.WithTLSCredentials),
+		otlptracegrpc.WithInsecure,
+		otlptracegrpc.WithTimeout)...)
+}
+
+func newMetricExporter(ctx context.Context, opts Options) (sdkmetric.Exporter, error) {
+	if opts.Protocol == ProtocolHTTP {
+		options := exporterOptions(opts,
+			otlpmetrichttp.WithEndpoint,
+			otlpmetrichttp.WithHeaders,
+			otlpmetrichttp.WithTLSClientConfig,
+			otlpmetrichttp.WithInsecure,
+			otlpmetrichttp.WithTimeout)
+		if opts.PathPrefix != "" {
+			options = append(options, otlpmetrichttp.WithURLPath(opts.PathPrefix+"/v1/metrics"))
+		}
+		return otlpmetrichttp.New(ctx, options...)
+	}
+	return otlpmetricgrpc.New(ctx, exporterOptions(opts,
+		otlpmetricgrpc.WithEndpoint,
+		otlpmetricgrpc.WithHeaders,
+		grpcTLS(otlpmetricgrpc.WithTLSCredentials),
+		otlpmetricgrpc.WithInsecure,
+		otlpmetricgrpc.WithTimeout)...)
+}
+
+func newLogExporter(ctx context.Context, opts Options) (sdklog.Exporter, error) {
+	if opts.Protocol == ProtocolHTTP {
+		options := exporterOptions(opts,
+			otlploghttp.WithEndpoint,
+			otlploghttp.WithHeaders,
+			otlploghttp.WithTLSClientConfig,
+			otlploghttp.WithInsecure,
+			otlploghttp.WithTimeout)
+		if opts.PathPrefix != "" {
+			options = append(options, otlploghttp.WithURLPath(opts.PathPrefix+"/v1/logs"))
+		}
+		return otlploghttp.New(ctx, options...)
+	}
+	return otlploggrpc.New(ctx, exporterOptions(opts,
+		otlploggrpc.WithEndpoint,
+		otlploggrpc.WithHeaders,
+		grpcTLS(otlploggrpc.WithTLSCredentials),
+		otlploggrpc.WithInsecure,
+		otlploggrpc.WithTimeout)...)
+}
+
+// grpcTLS adapts the TLS credentials option of a gRPC exporter to take a
+// TLS configuration, like the HTTP exporters do.
+func grpcTLS[O any](withCredentials func(credentials.TransportCredentials) O) func(*tls.Config) O {
+	return func(config *tls.Config) O {
+		return withCredentials(credentials.NewTLS(config))
+	}
+}
+
+// exporterOptions turns the connection settings of opts into the options
+// of one of the OTLP exporters, leaving out the unset ones so the exporter
+// reads them from the environment.
+func exporterOptions[O any](opts Options,
+	endpoint func(string) O,
+	headers func(map[string]string) O,
+	tlsConfig func(*tls.Config) O,
+	insecure func() O,
+	timeout func(time.Duration) O) []O {
+
+	var options []O
+	if opts.Endpoint != "" {
+		options = append(options, endpoint(opts.Endpoint))
+	}
+	if len(opts.Headers) > 0 {
+		options = append(options, headers(opts.Headers))
+	}
+	if opts.Insecure {
+		options = append(options, insecure())
+	} else if opts.TLSConfig != nil {
+		options = append(options, tlsConfig(opts.TLSConfig))
+	}
+	if opts.Timeout != 0 {
+		options = append(options, timeout(opts.Timeout))
+	}
+	return options
+}
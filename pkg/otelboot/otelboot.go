@@ -0,0 +1,311 @@
+// Package otelboot sets up OpenTelemetry for a service in one call:
+// the resource, the tracer, meter and logger providers exporting over OTLP
+// gRPC or HTTP, and the propagators. It installs everything as the global
+// providers, so instrumentation libraries pick it up without further
+// wiring, and returns a function that flushes and shuts it all down.
+package otelboot
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/log/global"
+	lognoop "go.opentelemetry.io/otel/log/noop"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/propagation"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+// Options configures Setup. Only ServiceName is required: the exporters
+// take the connection settings left unset from the standard
+// OTEL_EXPORTER_OTLP_* environment variables, including the
+// signal-specific ones such as OTEL_EXPORTER_OTLP_TRACES_ENDPOINT.
+type Options struct {
+	ServiceName    string
+	ServiceVersion string
+	// Environment is recorded as deployment.environment.
+	Environment string
+	// Attributes are added to the resource.
+	Attributes []attribute.KeyValue
+
+	// Protocol is ProtocolGRPC or ProtocolHTTP. It defaults to
+	// OTEL_EXPORTER_OTLP_PROTOCOL, or gRPC.
+	Protocol string
+	// Endpoint is the host:port of the OTLP receiver.
+	Endpoint string
+	// PathPrefix is put before the /v1/traces, /v1/metrics and /v1/logs
+	// paths of the OTLP/HTTP receiver, for receivers behind a proxy.
+	PathPrefix string
+	// Headers are sent with every export, typically for authorization.
+	Headers map[string]string
+	// TLSConfig secures the connection to the endpoint. When nil, the
+	// certificate and insecure variables apply, and the system roots are
+	// trusted by default.
+	TLSConfig *tls.Config
+	// Insecure sends telemetry in plaintext, for local collectors. It
+	// takes precedence over TLSConfig.
+	Insecure bool
+	// Timeout bounds each export. It defaults to OTEL_EXPORTER_OTLP_TIMEOUT,
+	// or 5 seconds.
+	Timeout time.Duration
+
+	// NewSpanExporter replaces the OTLP trace exporter, for backends that
+	// take spans in another format.
+	NewSpanExporter func(ctx context.Context, res *resource.Resource) (sdktrace.SpanExporter, error)
+	// SpanBatch tunes the batch span processor.
+	SpanBatch SpanBatchOptions
+	// WrapSpanProcessor wraps the batch span processor, to filter or
+	// account for spans before they are exported.
+	WrapSpanProcessor func(next sdktrace.SpanProcessor) (sdktrace.SpanProcessor, error)
+	// WrapLogExporter wraps the OTLP log exporter, to account for the
+	// records exported or to handle failed exports.
+	WrapLogExporter func(next sdklog.Exporter) (sdklog.Exporter, error)
+	// Sampler defaults to the one named by OTEL_TRACES_SAMPLER, with its
+	// OTEL_TRACES_SAMPLER_ARG, or to sampling every trace.
+	Sampler sdktrace.Sampler
+	// Propagator defaults to W3C Baggage and Trace Context.
+	Propagator propagation.TextMapPropagator
+
+	// MetricInterval is how often metrics are exported. It defaults to
+	// one minute.
+	MetricInterval time.Duration
+	// MetricReaders are added to the OTLP one, such as a Prometheus
+	// exporter for environments that scrape metrics.
+	MetricReaders []sdkmetric.Reader
+	// DisableOTLPMetrics leaves out the OTLP metric exporter, so metrics
+	// only go to MetricReaders.
+	DisableOTLPMetrics bool
+	// DisableMetrics and DisableLogs leave the respective global provider
+	// alone.
+	DisableMetrics bool
+	DisableLogs    bool
+	// Disabled installs no-op providers instead, so the instrumentation
+	// still runs but nothing is recorded or sent anywhere, for
+	// environments without network access to a backend. Only the
+	// propagator is set up as usual. It defaults to OTEL_SDK_DISABLED.
+	Disabled bool
+}
+
+// SpanBatchOptions tunes the buffering of spans before export: a larger
+// queue and batches for high-throughput services, a shorter timeout for
+// short runs that need their spans out quickly. Fields left zero take the
+// OTEL_BSP_* variables, then the SDK defaults.
+type SpanBatchOptions struct {
+	// MaxQueueSize is how many spans wait for export before new ones are
+	// dropped.
+	MaxQueueSize int
+	// MaxExportBatchSize is the most spans sent in one export.
+	MaxExportBatchSize int
+	// BatchTimeout is the longest a span waits for its batch to fill.
+	BatchTimeout time.Duration
+	// ExportTimeout bounds each export of a batch.
+	ExportTimeout time.Duration
+}
+
+func (o SpanBatchOptions) options() []sdktrace.BatchSpanProcessorOption {
+	var options []sdktrace.BatchSpanProcessorOption
+	if o.MaxQueueSize > 0 {
+		options = append(options, sdktrace.WithMaxQueueSize(o.MaxQueueSize))
+	}
+	if o.MaxExportBatchSize > 0 {
+		options = append(options, sdktrace.WithMaxExportBatchSize(o.MaxExportBatchSize))
+	}
+	if o.BatchTimeout > 0 {
+		options = append(options, sdktrace.WithBatchTimeout(o.BatchTimeout))
+	}
+	if o.ExportTimeout > 0 {
+		options = append(options, sdktrace.WithExportTimeout(o.ExportTimeout))
+	}
+	return options
+}
+
+// Setup installs the global tracer, meter and logger providers and the
+// propagator described by opts. The returned function flushes pending
+// telemetry and shuts the providers down; it must be called before the
+// process exits. When Setup fails, whatever it had set up is shut down.
+func Setup(ctx context.Context, opts Options) (shutdown func(context.Context) error, err error) {
+	var shutdowns []func(context.Context) error
+	shutdown = func(ctx context.Context) error {
+		var errs []error
+		// Shut down in reverse order, so logs about the shutdown of the
+		// other providers still go out
+		for i := len(shutdowns) - 1; i >= 0; i-- {
+			errs = append(errs, shutdowns[i](ctx))
+		}
+		return errors.Join(errs...)
+	}
+	defer func() {
+		if err != nil {
+			err = errors.Join(err, shutdown(ctx))
+		}
+	}()
+
+	if opts.Propagator == nil {
+		opts.Propagator = propagation.NewCompositeTextMapPropagator(
+			propagation.Baggage{},
+			propagation.TraceContext{},
+		)
+	}
+	otel.SetTextMapPropagator(opts.Propagator)
+
+	if opts.Disabled || os.Getenv("OTEL_SDK_DISABLED") == "true" {
+		otel.SetTracerProvider(tracenoop.NewTracerProvider())
+		if !opts.DisableMetrics {
+			otel.SetMeterProvider(metricnoop.NewMeterProvider())
+		}
+		if !opts.DisableLogs {
+			global.SetLoggerProvider(lognoop.NewLoggerProvider())
+		}
+		return shutdown, nil
+	}
+
+	if opts.Timeout == 0 && os.Getenv("OTEL_EXPORTER_OTLP_TIMEOUT") == "" {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.Protocol == "" {
+		opts.Protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	switch opts.Protocol {
+	case "":
+		opts.Protocol = ProtocolGRPC
+	case ProtocolGRPC, ProtocolHTTP:
+	default:
+		return shutdown, fmt.Errorf("unsupported OTLP protocol %q, want %s or %s",
+			opts.Protocol, ProtocolGRPC, ProtocolHTTP)
+	}
+	if opts.Sampler == nil {
+		if opts.Sampler, err = samplerFromEnv(); err != nil {
+			return shutdown, err
+		}
+	}
+	res, err := newResource(ctx, opts)
+	if err != nil {
+		return shutdown, err
+	}
+
+	tracerProvider, err := newTracerProvider(ctx, opts, res)
+	if err != nil {
+		return shutdown, err
+	}
+	shutdowns = append(shutdowns, tracerProvider.Shutdown)
+	otel.SetTracerProvider(tracerProvider)
+
+	if !opts.DisableMetrics {
+		meterProvider, err := newMeterProvider(ctx, opts, res)
+		if err != nil {
+			return shutdown, err
+		}
+		shutdowns = append(shutdowns, meterProvider.Shutdown)
+		otel.SetMeterProvider(meterProvider)
+	}
+
+	if !opts.DisableLogs {
+		loggerProvider, err := newLoggerProvider(ctx, opts, res)
+		if err != nil {
+			return shutdown, err
+		}
+		shutdowns = append(shutdowns, loggerProvider.Shutdown)
+		global.SetLoggerProvider(loggerProvider)
+	}
+
+	return shutdown, nil
+}
+
+func newResource(ctx context.Context, opts Options) (*resource.Resource, error) {
+	attrs := []attribute.KeyValue{semconv.ServiceNameKey.String(opts.ServiceName)}
+	if opts.ServiceVersion != "" {
+		attrs = append(attrs, semconv.ServiceVersionKey.String(opts.ServiceVersion))
+	}
+	if opts.Environment != "" {
+		attrs = append(attrs, semconv.DeploymentEnvironmentKey.String(opts.Environment))
+	}
+	return resource.New(ctx,
+		resource.WithAttributes(attrs...),
+		resource.WithAttributes(opts.Attributes...),
+	)
+}
+
+func newTracerProvider(ctx context.Context, opts Options,
+	res *resource.Resource) (*sdktrace.TracerProvider, error) {
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	if opts.NewSpanExporter != nil {
+		exporter, err = opts.NewSpanExporter(ctx, res)
+	} else {
+		exporter, err = newSpanExporter(ctx, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	processor := sdktrace.NewBatchSpanProcessor(exporter, opts.SpanBatch.options()...)
+	if opts.WrapSpanProcessor != nil {
+		wrapped, err := opts.WrapSpanProcessor(processor)
+		if err != nil {
+			processor.Shutdown(ctx)
+			return nil, err
+		}
+		processor = wrapped
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(opts.Sampler),
+		sdktrace.WithResource(res),
+		sdktrace.WithSpanProcessor(processor),
+	), nil
+}
+
+func newMeterProvider(ctx context.Context, opts Options,
+	res *resource.Resource) (*sdkmetric.MeterProvider, error) {
+
+	options := []sdkmetric.Option{sdkmetric.WithResource(res)}
+	for _, reader := range opts.MetricReaders {
+		options = append(options, sdkmetric.WithReader(reader))
+	}
+	if !opts.DisableOTLPMetrics {
+		exporter, err := newMetricExporter(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		interval := opts.MetricInterval
+		if interval == 0 {
+			interval = time.Minute
+		}
+		options = append(options, sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter,
+			sdkmetric.WithInterval(interval))))
+	}
+	return sdkmetric.NewMeterProvider(options...), nil
+}
+
+func newLoggerProvider(ctx context.Context, opts Options,
+	res *resource.Resource) (*sdklog.LoggerProvider, error) {
+
+	exporter, err := newLogExporter(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.WrapLogExporter != nil {
+		wrapped, err := opts.WrapLogExporter(exporter)
+		if err != nil {
+			exporter.Shutdown(ctx)
+			return nil, err
+		}
+		exporter = wrapped
+	}
+	return sdklog.NewLoggerProvider(
+		sdklog.WithResource(res),
+		sdklog.WithProcessor(sdklog.NewBatchProcessor(exporter)),
+	), nil
+}
@@ -0,0 +1,91 @@
+package otelboot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/log/global"
+	lognoop "go.opentelemetry.io/otel/log/noop"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+// restoreGlobals puts the global providers and propagator back once the
+// test is over, since Setup replaces them.
+func restoreGlobals(t *testing.T) {
+	t.Helper()
+	tracerProvider, meterProvider := otel.GetTracerProvider(), otel.GetMeterProvider()
+	loggerProvider, propagator := global.GetLoggerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(tracerProvider)
+		otel.SetMeterProvider(meterProvider)
+		global.SetLoggerProvider(loggerProvider)
+		otel.SetTextMapPropagator(propagator)
+	})
+}
+
+func TestSetupDisabled(t *testing.T) {
+	restoreGlobals(t)
+	// Invalid settings are not even looked at
+	t.Setenv("OTEL_TRACES_SAMPLER", "bogus")
+	shutdown, err := Setup(context.Background(), Options{ServiceName: "test", Disabled: true, Protocol: "bogus"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := otel.GetTracerProvider().(tracenoop.TracerProvider); !ok {
+		t.Errorf("tracer provider is %T, want the no-op one", otel.GetTracerProvider())
+	}
+	if _, ok := otel.GetMeterProvider().(metricnoop.MeterProvider); !ok {
+		t.Errorf("meter provider is %T, want the no-op one", otel.GetMeterProvider())
+	}
+	if _, ok := global.GetLoggerProvider().(lognoop.LoggerProvider); !ok {
+		t.Errorf("logger provider is %T, want the no-op one", global.GetLoggerProvider())
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+}
+
+func TestSetupRejectsInvalidSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     Options
+		protocol string
+		sampler  string
+	}{
+		{name: "protocol option", opts: Options{Protocol: "grpcs"}},
+		{name: "protocol variable", protocol: "http/json"},
+		{name: "sampler", sampler: "sometimes"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			restoreGlobals(t)
+			t.Setenv("OTEL_SDK_DISABLED", "")
+			t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", test.protocol)
+			t.Setenv("OTEL_TRACES_SAMPLER", test.sampler)
+			test.opts.ServiceName = "test"
+			shutdown, err := Setup(context.Background(), test.opts)
+			if err == nil {
+				shutdown(context.Background())
+				t.Fatal("Setup succeeded")
+			}
+		})
+	}
+}
+
+func TestSpanBatchOptions(t *testing.T) {
+	if options := (SpanBatchOptions{}).options(); len(options) != 0 {
+		t.Errorf("zero options give %d processor options, want none so OTEL_BSP_* apply", len(options))
+	}
+	options := SpanBatchOptions{
+		MaxQueueSize:       4096,
+		MaxExportBatchSize: 1024,
+		BatchTimeout:       time.Second,
+		ExportTimeout:      10 * time.Second,
+	}.options()
+	if len(options) != 4 {
+		t.Errorf("got %d processor options, want 4", len(options))
+	}
+}
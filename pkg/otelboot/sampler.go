@@ -0,0 +1,76 @@
+package otelboot
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// samplerFromEnv returns the sampler named by OTEL_TRACES_SAMPLER, with the
+// ratio of the traceidratio ones in OTEL_TRACES_SAMPLER_ARG, defaulting to
+// 1. It samples every trace when the variable is unset. Unlike the SDK,
+// which falls back to the default on invalid values, it fails, so a typo
+// does not silently change what is sampled.
+func samplerFromEnv() (sdktrace.Sampler, error) {
+	name, ratio, err := samplerSettings()
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "", "always_on":
+		return sdktrace.AlwaysSample(), nil
+	case "always_off":
+		return sdktrace.NeverSample(), nil
+	case "traceidratio":
+		return sdktrace.TraceIDRatioBased(ratio), nil
+	case "parentbased_always_on":
+		return sdktrace.ParentBased(sdktrace.AlwaysSample()), nil
+	case "parentbased_always_off":
+		return sdktrace.ParentBased(sdktrace.NeverSample()), nil
+	default:
+		return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio)), nil
+	}
+}
+
+// SamplingRatio returns the share of the root traces that the sampler
+// configured by OTEL_TRACES_SAMPLER keeps, between 0 and 1, so other
+// samplers, such as that of a collector, can be set up alike. It fails on
+// the settings Setup fails on.
+func SamplingRatio() (float64, error) {
+	name, ratio, err := samplerSettings()
+	if err != nil {
+		return 0, err
+	}
+	switch strings.TrimPrefix(name, "parentbased_") {
+	case "", "always_on":
+		return 1, nil
+	case "always_off":
+		return 0, nil
+	default:
+		return ratio, nil
+	}
+}
+
+// samplerSettings reads and checks OTEL_TRACES_SAMPLER and
+// OTEL_TRACES_SAMPLER_ARG.
+func samplerSettings() (name string, ratio float64, err error) {
+	name = os.Getenv("OTEL_TRACES_SAMPLER")
+	ratio = 1.0
+	if arg := os.Getenv("OTEL_TRACES_SAMPLER_ARG"); arg != "" {
+		// Written so that NaN, which parses, is out of range too
+		if ratio, err = strconv.ParseFloat(arg, 64); err != nil || !(ratio >= 0 && ratio <= 1) {
+			return "", 0, fmt.Errorf("invalid OTEL_TRACES_SAMPLER_ARG %q, want a ratio between 0 and 1", arg)
+		}
+	}
+	switch name {
+	case "", "always_on", "always_off", "traceidratio",
+		"parentbased_always_on", "parentbased_always_off", "parentbased_traceidratio":
+		return name, ratio, nil
+	default:
+		return "", 0, fmt.Errorf("unsupported OTEL_TRACES_SAMPLER %q, want always_on, always_off, "+
+			"traceidratio or their parentbased_ variants", name)
+	}
+}
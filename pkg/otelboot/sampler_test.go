@@ -0,0 +1,77 @@
+package otelboot
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSamplerFromEnv(t *testing.T) {
+	tests := []struct {
+		sampler, arg string
+		// want is the start of the description of the sampler, or "" for
+		// an error
+		want string
+	}{
+		{"", "", "AlwaysOnSampler"},
+		{"always_on", "", "AlwaysOnSampler"},
+		{"always_off", "", "AlwaysOffSampler"},
+		{"traceidratio", "0.25", "TraceIDRatioBased{0.25}"},
+		// The ratio defaults to 1, which samples everything
+		{"traceidratio", "", "AlwaysOnSampler"},
+		{"traceidratio", "0", "TraceIDRatioBased{0}"},
+		{"parentbased_always_on", "", "ParentBased{root:AlwaysOnSampler,"},
+		{"parentbased_always_off", "", "ParentBased{root:AlwaysOffSampler,"},
+		{"parentbased_traceidratio", "0.5", "ParentBased{root:TraceIDRatioBased{0.5},"},
+		{"traceidratio", "1.5", ""},
+		{"traceidratio", "-0.1", ""},
+		{"traceidratio", "half", ""},
+		{"parentbased_traceidratio", "NaN", ""},
+		{"always-on", "", ""},
+		{"jaeger_remote", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.sampler+"/"+test.arg, func(t *testing.T) {
+			t.Setenv("OTEL_TRACES_SAMPLER", test.sampler)
+			t.Setenv("OTEL_TRACES_SAMPLER_ARG", test.arg)
+			sampler, err := samplerFromEnv()
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("got %s, want an error", sampler.Description())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if description := sampler.Description(); !strings.HasPrefix(description, test.want) {
+				t.Errorf("got %s, want %s", description, test.want)
+			}
+		})
+	}
+}
+
+func TestSamplingRatio(t *testing.T) {
+	tests := []struct {
+		sampler, arg string
+		want         float64
+		wantErr      bool
+	}{
+		{"", "", 1, false},
+		{"always_off", "", 0, false},
+		{"parentbased_always_on", "", 1, false},
+		{"traceidratio", "0.25", 0.25, false},
+		{"parentbased_traceidratio", "0.5", 0.5, false},
+		{"traceidratio", "1.5", 0, true},
+		{"always-on", "", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.sampler+"/"+test.arg, func(t *testing.T) {
+			t.Setenv("OTEL_TRACES_SAMPLER", test.sampler)
+			t.Setenv("OTEL_TRACES_SAMPLER_ARG", test.arg)
+			ratio, err := SamplingRatio()
+			if (err != nil) != test.wantErr || ratio != test.want {
+				t.Errorf("SamplingRatio() = %v, %v, want %v", ratio, err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/metrics"
+)
+
+const (
+	priorityHeader = "X-Priority"
+	apiKeyHeader   = "X-API-Key"
+)
+
+var (
+	priorityKey          = attribute.Key("app.priority")
+	priorityQueueWaitKey = attribute.Key("app.priority.queue_wait_ms")
+)
+
+// priorityClasses lists the request classes, highest priority first.
+var priorityClasses = []string{"high", "normal", "low"}
+
+const defaultPriority = 1
+
+// errQueueFull is returned to requests arriving with MAX_QUEUED_REQUESTS
+// already waiting.
+var errQueueFull = errors.New("too many requests queued")
+
+// priorityAdmission classifies requests and, when MAX_CONCURRENT_REQUESTS
+// is set, admits at most that many at a time. Waiting requests are let in
+// highest class first, in arrival order within a class. The class comes
+// from the API key tier configured in API_KEY_TIERS ("key=high,key=low").
+// The X-Priority header can only lower it, and requests without a known
+// key get the default class whatever they ask for. At most
+// MAX_QUEUED_REQUESTS wait, and further requests are turned away at once.
+type priorityAdmission struct {
+	limit     int
+	maxQueued int
+	tiers     map[string]int
+	latency   metric.Float64Histogram
+
+	mu      sync.Mutex
+	active  int
+	waiting [][]chan struct{}
+}
+
+func newPriorityAdmission() (*priorityAdmission, error) {
+	latency, err := metrics.PriorityLatency.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	tiers := make(map[string]int)
+	for key, tier := range envPairs("API_KEY_TIERS") {
+		class, ok := priorityClass(tier)
+		if !ok {
+			return nil, fmt.Errorf("unknown tier %q in API_KEY_TIERS, want one of %v", tier, priorityClasses)
+		}
+		tiers[key] = class
+	}
+	return &priorityAdmission{
+		limit:     int(envInt("MAX_CONCURRENT_REQUESTS", 0)),
+		maxQueued: int(envInt("MAX_QUEUED_REQUESTS", 100)),
+		tiers:     tiers,
+		latency:   latency,
+		waiting:   make([][]chan struct{}, len(priorityClasses)),
+	}, nil
+}
+
+func (a *priorityAdmission) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		span := trace.SpanFromContext(ctx)
+		class := a.classify(request)
+		classAttr := priorityKey.String(priorityClasses[class])
+		span.SetAttributes(classAttr)
+
+		start := clk.Now()
+		if a.limit > 0 {
+			if err := a.acquire(ctx, class); errors.Is(err, errQueueFull) {
+				http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+				return
+			} else if err != nil {
+				http.Error(writer, "timed out waiting for a free slot", http.StatusServiceUnavailable)
+				return
+			}
+			defer a.release()
+			span.SetAttributes(priorityQueueWaitKey.Int64(clk.Since(start).Milliseconds()))
+		}
+		next.ServeHTTP(writer, request)
+		a.latency.Record(ctx, float64(clk.Since(start))/float64(time.Millisecond),
+			spanDimensions(ctx, classAttr))
+	})
+}
+
+func (a *priorityAdmission) classify(request *http.Request) int {
+	class, ok := a.tiers[request.Header.Get(apiKeyHeader)]
+	if !ok {
+		return defaultPriority
+	}
+	// Clients may yield to others, such as for batch jobs, but not
+	// jump ahead of their tier
+	if requested, ok := priorityClass(request.Header.Get(priorityHeader)); ok && requested > class {
+		return requested
+	}
+	return class
+}
+
+// acquire waits for a free slot, or for ctx to end. It fails at once
+// when the queue is full.
+func (a *priorityAdmission) acquire(ctx context.Context, class int) error {
+	a.mu.Lock()
+	if a.active < a.limit {
+		a.active++
+		a.mu.Unlock()
+		return nil
+	}
+	queued := 0
+	for _, waiters := range a.waiting {
+		queued += len(waiters)
+	}
+	if queued >= a.maxQueued {
+		a.mu.Unlock()
+		return errQueueFull
+	}
+	admitted := make(chan struct{})
+	a.waiting[class] = append(a.waiting[class], admitted)
+	a.mu.Unlock()
+
+	select {
+	case <-admitted:
+		return nil
+	case <-ctx.Done():
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, waiter := range a.waiting[class] {
+		if waiter == admitted {
+			a.waiting[class] = append(a.waiting[class][:i], a.waiting[class][i+1:]...)
+			return ctx.Err()
+		}
+	}
+	// Admitted while giving up; pass the slot on
+	a.releaseLocked()
+	return ctx.Err()
+}
+
+// release hands the slot to the highest priority waiter, if any.
+func (a *priorityAdmission) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.releaseLocked()
+}
+
+func (a *priorityAdmission) releaseLocked() {
+	for class, waiters := range a.waiting {
+		if len(waiters) > 0 {
+			close(waiters[0])
+			a.waiting[class] = waiters[1:]
+			return
+		}
+	}
+	a.active--
+}
+
+func priorityClass(name string) (int, bool) {
+	for class, candidate := range priorityClasses {
+		if strings.EqualFold(strings.TrimSpace(name), candidate) {
+			return class, true
+		}
+	}
+	return 0, false
+}
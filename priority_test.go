@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPriorityAdmissionClassify(t *testing.T) {
+	admission := &priorityAdmission{tiers: map[string]int{"gold": 0, "bronze": 2}}
+	for _, test := range []struct {
+		key, priority string
+		want          string
+	}{
+		{"", "", "normal"},
+		{"", "high", "normal"},
+		{"unknown", "high", "normal"},
+		{"gold", "", "high"},
+		{"gold", "low", "low"},
+		{"bronze", "high", "low"},
+		{"bronze", "bogus", "low"},
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/hello/zoe", nil)
+		if test.key != "" {
+			request.Header.Set(apiKeyHeader, test.key)
+		}
+		if test.priority != "" {
+			request.Header.Set(priorityHeader, test.priority)
+		}
+		if got := priorityClasses[admission.classify(request)]; got != test.want {
+			t.Errorf("key %q with X-Priority %q: got %s, want %s", test.key, test.priority, got, test.want)
+		}
+	}
+}
+
+func TestPriorityAdmissionRejectsUnknownTiers(t *testing.T) {
+	t.Setenv("API_KEY_TIERS", "gold=high,silver=prmium")
+	if _, err := newPriorityAdmission(); err == nil {
+		t.Error("an unknown tier was accepted")
+	}
+}
+
+func TestPriorityAdmissionBoundsTheQueue(t *testing.T) {
+	t.Setenv("MAX_CONCURRENT_REQUESTS", "1")
+	t.Setenv("MAX_QUEUED_REQUESTS", "1")
+	admission, err := newPriorityAdmission()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := admission.acquire(context.Background(), defaultPriority); err != nil {
+		t.Fatal(err)
+	}
+	// The second request waits for the slot
+	waiting, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	admitted := make(chan error, 1)
+	go func() { admitted <- admission.acquire(waiting, defaultPriority) }()
+	eventually(t, func() bool {
+		admission.mu.Lock()
+		defer admission.mu.Unlock()
+		return len(admission.waiting[defaultPriority]) == 1
+	})
+
+	// The third is turned away without waiting for its context to end
+	ctx, stop := context.WithTimeout(context.Background(), time.Minute)
+	defer stop()
+	if err := admission.acquire(ctx, 0); !errors.Is(err, errQueueFull) {
+		t.Errorf("acquire with a full queue returned %v, want %v", err, errQueueFull)
+	}
+
+	admission.release()
+	if err := <-admitted; err != nil {
+		t.Errorf("the waiting request was not admitted: %v", err)
+	}
+}
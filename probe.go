@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"otel-with-golang/metrics"
+	"otel-with-golang/pkg/otelboot"
+)
+
+// exporterProbe periodically makes a gRPC health check round trip to the
+// OTLP endpoint and records how long it takes, so slowness of the
+// telemetry backend can be told apart from slowness of the application
+// itself. Endpoints that speak OTLP/HTTP are only dialed.
+type exporterProbe struct {
+	endpoint  string
+	conn      *grpc.ClientConn
+	interval  time.Duration
+	threshold time.Duration
+	up        atomic.Int64
+	degraded  bool
+	rtt       metric.Float64Histogram
+}
+
+func newExporterProbe(endpoint, protocol string, insecureTransport bool, tlsConfig *tls.Config) (*exporterProbe, error) {
+	probe := &exporterProbe{
+		endpoint:  endpoint,
+		interval:  envInterval("EXPORTER_PROBE_INTERVAL", 30*time.Second),
+		threshold: envDuration("EXPORTER_RTT_THRESHOLD", 500*time.Millisecond),
+	}
+	var err error
+	if protocol == otelboot.ProtocolGRPC {
+		// The same transport security as the exporters, so the probe
+		// measures what they go through
+		creds := insecure.NewCredentials()
+		if !insecureTransport {
+			creds = credentials.NewTLS(tlsConfig)
+		}
+		probe.conn, err = grpc.NewClient(endpoint, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, err
+		}
+	}
+	probe.rtt, err = metrics.ExporterRTT.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	_, err = metrics.ExporterUp.New(meter, func(_ context.Context, o metric.Int64Observer) error {
+		o.Observe(probe.up.Load())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return probe, nil
+}
+
+// run probes the endpoint every interval until ctx is cancelled.
+func (p *exporterProbe) run(ctx context.Context) {
+	ticker := clk.NewTicker(p.interval)
+	defer ticker.Stop()
+	if p.conn != nil {
+		defer p.conn.Close()
+	}
+	for {
+		p.probe(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+func (p *exporterProbe) probe(ctx context.Context) {
+	start := clk.Now()
+	err := p.roundTrip(ctx)
+	elapsed := clk.Since(start)
+	if err != nil {
+		p.up.Store(0)
+		p.setDegraded(true)
+		telemetryLog.WithField("endpoint", p.endpoint).Warnf("OTLP endpoint unreachable: %v", err)
+		return
+	}
+	p.up.Store(1)
+	p.rtt.Record(ctx, float64(elapsed)/float64(time.Millisecond))
+
+	if elapsed > p.threshold {
+		p.setDegraded(true)
+		telemetryLog.WithField("endpoint", p.endpoint).
+			Warnf("OTLP endpoint round-trip time %v exceeds %v", elapsed, p.threshold)
+		return
+	}
+	if p.setDegraded(false) {
+		telemetryLog.WithField("endpoint", p.endpoint).
+			Infof("OTLP endpoint round-trip time back to %v", elapsed)
+	}
+}
+
+// roundTrip asks the endpoint for its health over gRPC, or only dials it
+// for OTLP/HTTP. Collectors that do not serve the health service still
+// answered, which is all the probe needs.
+func (p *exporterProbe) roundTrip(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, p.interval)
+	defer cancel()
+	if p.conn == nil {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", p.endpoint)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	_, err := grpc_health_v1.NewHealthClient(p.conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if status.Code(err) == codes.Unimplemented {
+		return nil
+	}
+	return err
+}
+
+// setDegraded updates the degraded flag and reports whether it changed.
+func (p *exporterProbe) setDegraded(degraded bool) bool {
+	changed := p.degraded != degraded
+	p.degraded = degraded
+	return changed
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsExporters reads OTEL_METRICS_EXPORTER, a comma-separated list of
+// otlp, prometheus and none, which defaults to otlp.
+func metricsExporters() (otlp, prometheus bool, err error) {
+	names := os.Getenv("OTEL_METRICS_EXPORTER")
+	if names == "" {
+		return true, false, nil
+	}
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "otlp":
+			otlp = true
+		case "prometheus":
+			prometheus = true
+		case "none":
+		default:
+			return false, false, fmt.Errorf("unknown OTEL_METRICS_EXPORTER %q, want otlp, prometheus or none", name)
+		}
+	}
+	return otlp, prometheus, nil
+}
+
+// servePrometheus exposes the metrics for scraping when the Prometheus
+// exporter is enabled: on a dedicated server at PROMETHEUS_ADDR when set,
+// otherwise at /metrics of the main server, answered ahead of the startup
+// gate and the router so scrapes are not traced. It returns the handler to
+// serve instead of next, and a function that shuts the dedicated server
+// down.
+func servePrometheus(next http.Handler) (http.Handler, func(ctx context.Context) error) {
+	noServer := func(context.Context) error { return nil }
+	if _, enabled, err := metricsExporters(); err != nil {
+		log.Fatalf("%s: %v", "failed to configure metrics exporters", err)
+	} else if !enabled {
+		return next, noServer
+	}
+
+	addr := os.Getenv("PROMETHEUS_ADDR")
+	if addr == "" {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if request.URL.Path == basePath+"/metrics" {
+				promhttp.Handler().ServeHTTP(writer, request)
+				return
+			}
+			next.ServeHTTP(writer, request)
+		}), noServer
+	}
+
+	listener, err := listen(addr, "prometheus")
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to listen", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Handler: mux, ErrorLog: listener.errorLog()}
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	log.Infof("serving Prometheus metrics on %s", addr)
+	return next, server.Shutdown
+}
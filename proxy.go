@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+
+	"otel-with-golang/requestcontext"
+)
+
+var cacheHitKey = attribute.Key("app.cache.hit")
+
+// runProxy runs the binary as a caching reverse proxy in front of another
+// instance named by PROXY_UPSTREAM. Incoming requests get server spans,
+// forwarded ones client spans with the trace context injected, and cache
+// lookups and stores get spans of their own.
+func runProxy(ctx context.Context) {
+	upstream, err := url.Parse(os.Getenv("PROXY_UPSTREAM"))
+	if err != nil || upstream.Host == "" {
+		log.Fatalf("PROXY_UPSTREAM must be an absolute URL, got %q", os.Getenv("PROXY_UPSTREAM"))
+	}
+	addr := os.Getenv("PROXY_LISTEN_ADDR")
+	if addr == "" {
+		addr = ":9001"
+	}
+
+	if err := initNameObfuscation(); err != nil {
+		log.Fatalf("%s: %v", "failed to set up name obfuscation", err)
+	}
+	initTelemetry(ctx)
+
+	log.WithField("upstream", upstream.String()).Infof("proxying on %s", addr)
+	listener, err := listen(addr, "proxy")
+	if err != nil {
+		log.Fatalf("%s: %v", "failed to listen", err)
+	}
+	server := &http.Server{Handler: newProxyHandler(upstream), ErrorLog: listener.errorLog()}
+	if err := serveUntilSignal(ctx, server, func() error { return server.Serve(listener) }); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newProxyHandler forwards to upstream through the cache, tracing the
+// requests it serves and forwards with the user names in their paths
+// obfuscated like the service does.
+func newProxyHandler(upstream *url.URL) http.Handler {
+	reverseProxy := httputil.NewSingleHostReverseProxy(upstream)
+	reverseProxy.Transport = otelhttp.NewTransport(obfuscatingTransport{http.DefaultTransport})
+	proxy := newCachingProxy(reverseProxy,
+		envDuration("PROXY_CACHE_TTL", 5*time.Second), int(envInt("PROXY_CACHE_MAX_ENTRIES", 1000)))
+	return otelhttp.NewHandler(obfuscateTarget(traceVerbosity(defaultVerbosity())(proxy)), "proxy")
+}
+
+// cacheKeyHeaders are the request headers the cache key is made of. Responses
+// that vary on any other header are not cached.
+var cacheKeyHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language"}
+
+// perRequestHeaders describe the request that was forwarded rather than the
+// resource, so they are not replayed from the cache.
+var perRequestHeaders = []string{requestcontext.RequestIDHeader, "traceresponse", "Server-Timing"}
+
+// credentialHeaders carry credentials. Requests with any of them, or with
+// one of PROXY_CREDENTIAL_HEADERS, are not served from the cache.
+var credentialHeaders = []string{"Authorization", "Cookie", adminKeyHeader, apiKeyHeader}
+
+// cachingProxy serves anonymous GET requests from a short-lived cache and
+// forwards everything else. The cache holds at most maxEntries responses, evicting
+// the least recently used, so clients requesting ever new URIs cannot grow
+// it without bound.
+type cachingProxy struct {
+	next              http.Handler
+	ttl               time.Duration
+	maxEntries        int
+	credentialHeaders []string
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// recent orders the entries from the most to the least recently used
+	recent *list.List
+}
+
+type cachedResponse struct {
+	key     string
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newCachingProxy(next http.Handler, ttl time.Duration, maxEntries int) *cachingProxy {
+	if maxEntries < 1 {
+		maxEntries = 1
+	}
+	credentials := slices.Clone(credentialHeaders)
+	for _, name := range strings.Split(os.Getenv("PROXY_CREDENTIAL_HEADERS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			credentials = append(credentials, name)
+		}
+	}
+	return &cachingProxy{
+		next:              next,
+		ttl:               ttl,
+		maxEntries:        maxEntries,
+		credentialHeaders: credentials,
+		entries:           make(map[string]*list.Element),
+		recent:            list.New(),
+	}
+}
+
+// credentialed reports whether request carries credentials.
+func (p *cachingProxy) credentialed(request *http.Request) bool {
+	for _, name := range p.credentialHeaders {
+		if request.Header.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *cachingProxy) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	// A response to credentials belongs to whoever sent them
+	if request.Method != http.MethodGet || p.credentialed(request) {
+		p.next.ServeHTTP(writer, request)
+		return
+	}
+	key := cacheKey(request)
+
+	ctx, lookupSpan := startSpan(request.Context(), verbosityVerbose, "cache.lookup")
+	entry, hit := p.lookup(key)
+	lookupSpan.SetAttributes(cacheHitKey.Bool(hit))
+	lookupSpan.End()
+	if hit {
+		for name, values := range entry.header {
+			writer.Header()[name] = values
+		}
+		writer.WriteHeader(http.StatusOK)
+		writer.Write(entry.body)
+		return
+	}
+
+	recorder := &responseRecorder{ResponseWriter: writer, status: http.StatusOK}
+	p.next.ServeHTTP(recorder, request.WithContext(ctx))
+	if recorder.status != http.StatusOK || !cacheable(writer.Header()) {
+		return
+	}
+	header := writer.Header().Clone()
+	for _, name := range perRequestHeaders {
+		header.Del(name)
+	}
+	_, storeSpan := startSpan(ctx, verbosityVerbose, "cache.store")
+	p.store(cachedResponse{
+		key:     key,
+		header:  header,
+		body:    recorder.body.Bytes(),
+		expires: clk.Now().Add(p.ttl),
+	})
+	storeSpan.End()
+}
+
+// cacheKey returns the key of the cached response to request.
+func cacheKey(request *http.Request) string {
+	key := request.URL.RequestURI()
+	for _, name := range cacheKeyHeaders {
+		key += "\n" + request.Header.Get(name)
+	}
+	return key
+}
+
+// cacheable reports whether a response with header may be served to other
+// requests for the same key: it sets no cookie, is not marked private or
+// no-store, and varies on no header outside the key.
+func cacheable(header http.Header) bool {
+	if header.Get("Set-Cookie") != "" {
+		return false
+	}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive, _, _ = strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(directive) {
+			case "private", "no-store", "no-cache":
+				return false
+			}
+		}
+	}
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" && !slices.Contains(cacheKeyHeaders, name) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (p *cachingProxy) lookup(key string) (cachedResponse, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	element, ok := p.entries[key]
+	if !ok {
+		return cachedResponse{}, false
+	}
+	entry := element.Value.(cachedResponse)
+	if clk.Now().After(entry.expires) {
+		p.remove(element)
+		return cachedResponse{}, false
+	}
+	p.recent.MoveToFront(element)
+	return entry, true
+}
+
+func (p *cachingProxy) store(entry cachedResponse) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if element, ok := p.entries[entry.key]; ok {
+		p.remove(element)
+	}
+	p.entries[entry.key] = p.recent.PushFront(entry)
+	for p.recent.Len() > p.maxEntries {
+		p.remove(p.recent.Back())
+	}
+}
+
+// remove forgets the entry of element. The caller holds p.mu.
+func (p *cachingProxy) remove(element *list.Element) {
+	p.recent.Remove(element)
+	delete(p.entries, element.Value.(cachedResponse).key)
+}
+
+// responseRecorder passes a response through while keeping a copy of the
+// status and body for the cache.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
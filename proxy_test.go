@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/requestcontext"
+)
+
+func TestCachingProxyEvictsLeastRecentlyUsed(t *testing.T) {
+	forwarded := 0
+	proxy := newCachingProxy(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		forwarded++
+		writer.Write([]byte(request.URL.Path))
+	}), time.Minute, 2)
+	get := func(path string) {
+		proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	get("/a")
+	get("/b")
+	get("/a") // hit, so /b is now the least recently used
+	get("/c") // evicts /b
+	if forwarded != 3 {
+		t.Fatalf("forwarded %d requests, want 3", forwarded)
+	}
+	if len(proxy.entries) != 2 || proxy.recent.Len() != 2 {
+		t.Fatalf("cache holds %d entries, want 2", len(proxy.entries))
+	}
+	get("/a")
+	if forwarded != 3 {
+		t.Errorf("/a was evicted instead of /b")
+	}
+	get("/b")
+	if forwarded != 4 {
+		t.Errorf("/b was still cached")
+	}
+}
+
+func TestCachingProxyKeepsResponsesPrivate(t *testing.T) {
+	t.Setenv("PROXY_CREDENTIAL_HEADERS", "X-Session-Token")
+	forwarded := 0
+	proxy := newCachingProxy(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		forwarded++
+		writer.Header().Set("X-Request-ID", fmt.Sprint(forwarded))
+		writer.Header().Set("Server-Timing", "app;dur=1")
+		switch request.URL.Path {
+		case "/varies":
+			writer.Header().Set("Vary", "X-Tenant")
+		case "/no-store":
+			writer.Header().Set("Cache-Control", "no-store")
+		case "/private-cache":
+			writer.Header().Set("Cache-Control", "max-age=60, private")
+		case "/cookie":
+			writer.Header().Set("Set-Cookie", "session=dave")
+		}
+		writer.Write([]byte(request.Header.Get("Authorization")))
+	}), time.Minute, 10)
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		request.Header = header
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	for _, header := range []http.Header{
+		{"Authorization": {"Bearer alice"}},
+		{"Authorization": {"Bearer bob"}},
+		{"Cookie": {"session=carol"}},
+		{http.CanonicalHeaderKey(adminKeyHeader): {"operator-key"}},
+		{http.CanonicalHeaderKey(apiKeyHeader): {"tier-key"}},
+		{"X-Session-Token": {"erin"}},
+	} {
+		get("/private", header)
+	}
+	if forwarded != 6 || len(proxy.entries) != 0 {
+		t.Fatalf("forwarded %d requests and cached %d, want 6 and none", forwarded, len(proxy.entries))
+	}
+
+	// An admin key GET is forwarded, and its response not replayed to
+	// anonymous clients
+	get("/admin/features", http.Header{http.CanonicalHeaderKey(adminKeyHeader): {"operator-key"}})
+	get("/admin/features", http.Header{})
+	if forwarded != 8 {
+		t.Errorf("response to an admin key was served from the cache")
+	}
+
+	for _, path := range []string{"/varies", "/no-store", "/private-cache", "/cookie"} {
+		get(path, http.Header{})
+		get(path, http.Header{})
+	}
+	if forwarded != 16 {
+		t.Errorf("forwarded %d requests, want 16: a response that must not be shared was cached", forwarded)
+	}
+
+	get("/public", http.Header{"Accept": {"text/plain"}})
+	get("/public", http.Header{"Accept": {"application/json"}})
+	if forwarded != 18 {
+		t.Errorf("responses for different Accept headers were shared")
+	}
+	hit := get("/public", http.Header{"Accept": {"text/plain"}})
+	if forwarded != 18 {
+		t.Fatalf("response was not cached")
+	}
+	for _, name := range []string{"X-Request-ID", "Server-Timing"} {
+		if value := hit.Header().Get(name); value != "" {
+			t.Errorf("cached response replayed %s: %q", name, value)
+		}
+	}
+}
+
+func TestProxySpansObfuscateNames(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+	obfuscator, err := newNameObfuscator("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestcontext.SetObfuscator(obfuscator.obfuscate)
+	t.Cleanup(func() { requestcontext.SetObfuscator(nil) })
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := httptest.NewRecorder()
+	newProxyHandler(upstreamURL).ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/hello/alice", nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("GET /hello answered %d", response.Code)
+	}
+
+	attributes := map[trace.SpanKind]string{}
+	for _, span := range recorder.Ended() {
+		for _, attribute := range span.Attributes() {
+			if attribute.Key == "http.target" || attribute.Key == "http.url" {
+				attributes[span.SpanKind()] = attribute.Value.AsString()
+			}
+		}
+	}
+	for _, kind := range []trace.SpanKind{trace.SpanKindServer, trace.SpanKindClient} {
+		if value := attributes[kind]; !strings.Contains(value, "/hello/u_") || strings.Contains(value, "alice") {
+			t.Errorf("%s span records %q, want the name obfuscated", kind, value)
+		}
+	}
+}
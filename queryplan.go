@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// queryer is what *sql.Conn and *sql.Tx have in common for running the
+// plan query on the connection the slow statement used.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// planDialect is how the plan of a statement is asked for on a database.
+type planDialect struct {
+	// system is the db.system attribute of the explain spans.
+	system string
+	// explain is the prefix turning a statement into the query for its
+	// plan, which none of them runs.
+	explain string
+}
+
+// planDialects are the plan dialects of each DB_DRIVER.
+var planDialects = map[string]planDialect{
+	"sqlite3":  {system: "sqlite", explain: "EXPLAIN QUERY PLAN "},
+	"postgres": {system: "postgresql", explain: "EXPLAIN "},
+	"mysql":    {system: "mysql", explain: "EXPLAIN "},
+}
+
+// planCapture explains statements that took longer than SLOW_QUERY_THRESHOLD,
+// at most once per PLAN_CAPTURE_INTERVAL, and attaches the plan to the
+// current span as a db.query.plan event.
+type planCapture struct {
+	dialect   planDialect
+	threshold time.Duration
+	interval  time.Duration
+	last      atomic.Int64
+}
+
+// newPlanCapture returns a planCapture for the statements of driver, a
+// DB_DRIVER.
+func newPlanCapture(driver string) *planCapture {
+	return &planCapture{
+		dialect:   planDialects[driver],
+		threshold: envDuration("SLOW_QUERY_THRESHOLD", 100*time.Millisecond),
+		interval:  envDuration("PLAN_CAPTURE_INTERVAL", 10*time.Second),
+	}
+}
+
+// observe explains query when it started too long ago.
+func (p *planCapture) observe(ctx context.Context, q queryer, start time.Time,
+	query string, args ...interface{}) {
+
+	elapsed := clk.Since(start)
+	if elapsed < p.threshold || !p.allow() {
+		return
+	}
+	explainCtx, span := tracer.Start(ctx, "explain query plan", trace.WithAttributes(
+		attribute.String("db.system", p.dialect.system),
+		attribute.String("db.statement", query)))
+	defer span.End()
+
+	plan, err := explainQueryPlan(explainCtx, q, p.dialect.explain+query, args...)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+	trace.SpanFromContext(ctx).AddEvent("db.query.plan", trace.WithAttributes(
+		attribute.String("db.statement", query),
+		attribute.Int64("db.duration_ms", elapsed.Milliseconds()),
+		attribute.String("db.query.plan", plan)))
+}
+
+// allow reports whether a plan may be captured now.
+func (p *planCapture) allow() bool {
+	now := clk.Now().UnixNano()
+	last := p.last.Load()
+	if now-last < int64(p.interval) {
+		return false
+	}
+	return p.last.CompareAndSwap(last, now)
+}
+
+// explainQueryPlan runs explain, the plan query of a statement, and
+// returns its rows one per line, their columns separated by spaces. The
+// databases each answer with columns of their own, such as the id, parent,
+// unused column and detail of the steps of SQLite.
+func explainQueryPlan(ctx context.Context, q queryer, explain string,
+	args ...interface{}) (string, error) {
+
+	rows, err := q.QueryContext(ctx, explain, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	var plan strings.Builder
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return "", err
+		}
+		fields := make([]string, 0, len(values))
+		for _, value := range values {
+			if value.Valid {
+				fields = append(fields, value.String)
+			}
+		}
+		plan.WriteString(strings.Join(fields, " ") + "\n")
+	}
+	return plan.String(), rows.Err()
+}
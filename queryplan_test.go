@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestPlanCaptureExplainsSlowStatements(t *testing.T) {
+	db := openTestSQLite(t)
+	// SQLite also answers the plain EXPLAIN of the servers, with columns
+	// of its own
+	for driver, system := range map[string]string{"sqlite3": "sqlite", "postgres": "postgresql"} {
+		t.Run(driver, func(t *testing.T) {
+			recorder := tracetest.NewSpanRecorder()
+			provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+			previousTracer := tracer
+			tracer = provider.Tracer("test")
+			t.Cleanup(func() { tracer = previousTracer })
+
+			plans := newPlanCapture(driver)
+			plans.threshold = 0
+			ctx, span := tracer.Start(context.Background(), "increment")
+			plans.observe(ctx, db, clk.Now(), selectCountQuery, "zoe")
+			span.End()
+
+			var explain, increment sdktrace.ReadOnlySpan
+			for _, ended := range recorder.Ended() {
+				switch ended.Name() {
+				case "explain query plan":
+					explain = ended
+				case "increment":
+					increment = ended
+				}
+			}
+			if explain == nil || increment == nil {
+				t.Fatal("missing the explain or the increment span")
+			}
+			attrs := attribute.NewSet(explain.Attributes()...)
+			if got, _ := attrs.Value("db.system"); got.AsString() != system {
+				t.Errorf("db.system = %q, want %q", got.AsString(), system)
+			}
+			if events := increment.Events(); len(events) != 1 || events[0].Name != "db.query.plan" {
+				t.Fatalf("events %v, want a db.query.plan", events)
+			}
+			attrs = attribute.NewSet(increment.Events()[0].Attributes...)
+			if plan, _ := attrs.Value("db.query.plan"); plan.AsString() == "" {
+				t.Error("empty plan")
+			}
+		})
+	}
+}
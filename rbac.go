@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/logger"
+)
+
+// authzDecisionKey records on the span of an admin request whether it was
+// allowed.
+var authzDecisionKey = attribute.Key("authz.decision")
+
+// role is what a caller may do with the admin endpoints. Each role may do
+// what the ones before it may.
+type role int
+
+const (
+	roleNone role = iota
+	// roleViewer may read the admin endpoints.
+	roleViewer
+	// roleOperator may also change them, such as to flush telemetry or
+	// switch features.
+	roleOperator
+	// roleAdmin may also read what could leak secrets, such as the support
+	// bundle.
+	roleAdmin
+)
+
+var roleNames = map[string]role{"viewer": roleViewer, "operator": roleOperator, "admin": roleAdmin}
+
+func (r role) String() string {
+	for name, named := range roleNames {
+		if named == r {
+			return name
+		}
+	}
+	return "none"
+}
+
+var (
+	errNoCredentials      = errors.New("missing credentials")
+	errInvalidCredentials = errors.New("invalid credentials")
+)
+
+// adminKeyHeader carries the admin API keys, apart from the X-API-Key of
+// the priority tiers so a tier key never doubles as an admin key.
+const adminKeyHeader = "X-Admin-Key"
+
+// adminAuthorization protects the /admin/ endpoints with roles, taken
+// from the API key in the X-Admin-Key header, as mapped by ADMIN_API_KEYS
+// ("key=role,key=role"), or from the "roles" or "role" claim of a bearer
+// JWT signed with HS256 and ADMIN_JWT_SECRET. Without either setting the
+// endpoints deny every request, unless ADMIN_OPEN opens them for local
+// development.
+type adminAuthorization struct {
+	keys      map[string]role
+	jwtSecret []byte
+	open      bool
+}
+
+func newAdminAuthorization() (*adminAuthorization, error) {
+	keys, err := parseAdminKeys(os.Getenv("ADMIN_API_KEYS"))
+	if err != nil {
+		return nil, err
+	}
+	a := &adminAuthorization{keys: keys, jwtSecret: []byte(os.Getenv("ADMIN_JWT_SECRET"))}
+	if envBool("ADMIN_OPEN", false) {
+		if a.enabled() {
+			return nil, errors.New("ADMIN_OPEN cannot be combined with ADMIN_API_KEYS or ADMIN_JWT_SECRET")
+		}
+		a.open = true
+		log.Warn("the admin endpoints are open to every caller")
+	} else if !a.enabled() {
+		log.Warn("neither ADMIN_API_KEYS nor ADMIN_JWT_SECRET is set, the admin endpoints deny every request")
+	}
+	return a, nil
+}
+
+// parseAdminKeys parses ADMIN_API_KEYS. Each entry is split at its last
+// "=", as the roles never contain one while the keys may.
+func parseAdminKeys(list string) (map[string]role, error) {
+	keys := make(map[string]role)
+	if strings.TrimSpace(list) == "" {
+		return keys, nil
+	}
+	for _, item := range strings.Split(list, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		i := strings.LastIndex(item, "=")
+		if i < 0 || strings.TrimSpace(item[:i]) == "" {
+			return nil, errors.New("malformed entry in ADMIN_API_KEYS, want key=role")
+		}
+		name := strings.TrimSpace(item[i+1:])
+		r, ok := roleNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown role %q in ADMIN_API_KEYS", name)
+		}
+		keys[strings.TrimSpace(item[:i])] = r
+	}
+	return keys, nil
+}
+
+func (a *adminAuthorization) enabled() bool {
+	return len(a.keys) > 0 || len(a.jwtSecret) > 0
+}
+
+// requiredRole returns the role needed to call the admin endpoint at template
+// with method.
+func requiredRole(method, template string) role {
+	switch {
+	case template == "/admin/support-bundle":
+		return roleAdmin
+	case method == http.MethodGet || method == http.MethodHead:
+		return roleViewer
+	default:
+		return roleOperator
+	}
+}
+
+// middleware answers 401 to admin requests without valid credentials and
+// 403 to those whose role is not enough, recording and logging each
+// decision.
+func (a *adminAuthorization) middleware(next http.Handler) http.Handler {
+	if a.open {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		template := routeTemplate(request)
+		if !strings.HasPrefix(template, "/admin/") {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		ctx := request.Context()
+		required := requiredRole(request.Method, template)
+		granted, err := a.role(request)
+		decision := "allow"
+		if err != nil || granted < required {
+			decision = "deny"
+		}
+		trace.SpanFromContext(ctx).SetAttributes(
+			semconv.EnduserRoleKey.String(granted.String()),
+			authzDecisionKey.String(decision))
+		entry := logger.FromContext(ctx).WithFields(logrus.Fields{
+			"role":          granted.String(),
+			"required_role": required.String(),
+			"decision":      decision,
+		})
+		switch {
+		case err != nil:
+			entry.Warnf("denied admin request: %v", err)
+			writer.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(writer, request, http.StatusUnauthorized, err.Error())
+		case granted < required:
+			entry.Warn("denied admin request")
+			writeError(writer, request, http.StatusForbidden, fmt.Sprintf("requires the %s role", required))
+		default:
+			entry.Info("allowed admin request")
+			next.ServeHTTP(writer, request)
+		}
+	})
+}
+
+// role returns the role granted by the credentials of request.
+func (a *adminAuthorization) role(request *http.Request) (role, error) {
+	if key := request.Header.Get(adminKeyHeader); key != "" {
+		for known, r := range a.keys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(known)) == 1 {
+				return r, nil
+			}
+		}
+		return roleNone, errInvalidCredentials
+	}
+	token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return roleNone, errNoCredentials
+	}
+	if len(a.jwtSecret) == 0 {
+		return roleNone, errInvalidCredentials
+	}
+	return a.tokenRole(token)
+}
+
+type adminClaims struct {
+	Role  string   `json:"role"`
+	Roles []string `json:"roles"`
+	Exp   int64    `json:"exp"`
+}
+
+// tokenRole verifies the HS256 signature and expiry of token, and returns
+// the highest role among its claims.
+func (a *adminAuthorization) tokenRole(token string) (role, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return roleNone, errInvalidCredentials
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return roleNone, errInvalidCredentials
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return roleNone, errInvalidCredentials
+	}
+	mac := hmac.New(sha256.New, a.jwtSecret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return roleNone, errInvalidCredentials
+	}
+	var claims adminClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return roleNone, errInvalidCredentials
+	}
+	if claims.Exp != 0 && clk.Now().Unix() >= claims.Exp {
+		return roleNone, errors.New("expired credentials")
+	}
+	granted := roleNone
+	for _, name := range append(claims.Roles, claims.Role) {
+		if r := roleNames[name]; r > granted {
+			granted = r
+		}
+	}
+	return granted, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
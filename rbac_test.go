@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const testJWTSecret = "test-secret"
+
+// signToken returns a JWT with claims, signed with secret and labelled
+// with alg.
+func signToken(t *testing.T, alg, secret string, claims map[string]interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	unsigned := encode(map[string]string{"alg": alg, "typ": "JWT"}) + "." + encode(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// adminRouter serves a few admin endpoints behind the authorization
+// configured by the environment.
+func adminRouter(t *testing.T) http.Handler {
+	t.Helper()
+	authorization, err := newAdminAuthorization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	router.Use(authorization.middleware)
+	ok := func(writer http.ResponseWriter, request *http.Request) {}
+	router.HandleFunc("/admin/log-level", ok).Methods(http.MethodGet, http.MethodPut)
+	router.HandleFunc("/admin/support-bundle", ok).Methods(http.MethodPost)
+	router.HandleFunc("/hello/{name}", ok)
+	return router
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	clock := useManualClock(t)
+	t.Setenv("ADMIN_API_KEYS", "v1=viewer, op=operator,c2VjcmV0==admin")
+	t.Setenv("ADMIN_JWT_SECRET", testJWTSecret)
+	router := adminRouter(t)
+	expiry := clock.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		key           string
+		authorization string
+		want          int
+	}{
+		{"no credentials", http.MethodGet, "/admin/log-level", "", "", http.StatusUnauthorized},
+		{"not an admin endpoint", http.MethodGet, "/hello/zoe", "", "", http.StatusOK},
+		{"viewer reads", http.MethodGet, "/admin/log-level", "v1", "", http.StatusOK},
+		{"viewer changes", http.MethodPut, "/admin/log-level", "v1", "", http.StatusForbidden},
+		{"operator changes", http.MethodPut, "/admin/log-level", "op", "", http.StatusOK},
+		{"operator downloads the bundle", http.MethodPost, "/admin/support-bundle", "op", "", http.StatusForbidden},
+		{"admin key with =", http.MethodPost, "/admin/support-bundle", "c2VjcmV0=", "", http.StatusOK},
+		{"unknown key", http.MethodGet, "/admin/log-level", "nope", "", http.StatusUnauthorized},
+		{"operator token", http.MethodPut, "/admin/log-level", "",
+			"Bearer " + signToken(t, "HS256", testJWTSecret, map[string]interface{}{"roles": []string{"viewer", "operator"}, "exp": expiry}),
+			http.StatusOK},
+		{"admin token", http.MethodPost, "/admin/support-bundle", "",
+			"Bearer " + signToken(t, "HS256", testJWTSecret, map[string]interface{}{"role": "admin", "exp": expiry}),
+			http.StatusOK},
+		{"expired token", http.MethodGet, "/admin/log-level", "",
+			"Bearer " + signToken(t, "HS256", testJWTSecret, map[string]interface{}{"role": "admin", "exp": clock.Now().Unix()}),
+			http.StatusUnauthorized},
+		{"wrong algorithm", http.MethodGet, "/admin/log-level", "",
+			"Bearer " + signToken(t, "none", testJWTSecret, map[string]interface{}{"role": "admin", "exp": expiry}),
+			http.StatusUnauthorized},
+		{"bad signature", http.MethodGet, "/admin/log-level", "",
+			"Bearer " + signToken(t, "HS256", "other-secret", map[string]interface{}{"role": "admin", "exp": expiry}),
+			http.StatusUnauthorized},
+		{"unknown role", http.MethodGet, "/admin/log-level", "",
+			"Bearer " + signToken(t, "HS256", testJWTSecret, map[string]interface{}{"role": "root", "exp": expiry}),
+			http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(test.method, test.path, nil)
+			if test.key != "" {
+				request.Header.Set(adminKeyHeader, test.key)
+			}
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, request)
+			if response.Code != test.want {
+				t.Errorf("answered %d, want %d", response.Code, test.want)
+			}
+		})
+	}
+}
+
+func TestAdminAuthorizationDeniesByDefault(t *testing.T) {
+	t.Setenv("ADMIN_API_KEYS", "")
+	t.Setenv("ADMIN_JWT_SECRET", "")
+	router := adminRouter(t)
+
+	// A priority tier key is no admin key
+	request := httptest.NewRequest(http.MethodPut, "/admin/log-level", nil)
+	request.Header.Set(apiKeyHeader, "tier-key")
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	if response.Code != http.StatusUnauthorized {
+		t.Errorf("answered %d without admin credentials configured, want 401", response.Code)
+	}
+
+	t.Setenv("ADMIN_OPEN", "true")
+	response = httptest.NewRecorder()
+	adminRouter(t).ServeHTTP(response, httptest.NewRequest(http.MethodPut, "/admin/log-level", nil))
+	if response.Code != http.StatusOK {
+		t.Errorf("answered %d with ADMIN_OPEN, want 200", response.Code)
+	}
+}
+
+func TestParseAdminKeys(t *testing.T) {
+	for _, list := range []string{"k1", "=admin", "k1=root", "k1=viewer,k2"} {
+		if _, err := parseAdminKeys(list); err == nil {
+			t.Errorf("parseAdminKeys(%q) succeeded", list)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/logger"
+)
+
+// recoverPanics answers 500 when a handler panics, instead of letting the
+// server drop the connection, and records the panic as an exception with
+// its stack trace on the span of the request, so it shows up as an error
+// in the APM UI. Installed last, the middlewares around it see the 500
+// like any other response.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// The server's way to abort a response without logging
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			err, ok := recovered.(error)
+			if !ok {
+				err = fmt.Errorf("%v", recovered)
+			}
+			ctx := request.Context()
+			span := trace.SpanFromContext(ctx)
+			span.RecordError(err, trace.WithStackTrace(true))
+			span.SetStatus(codes.Error, err.Error())
+			logger.FromContext(ctx).Errorf("recovered from panic: %v", err)
+			writeError(writer, request, http.StatusInternalServerError, "internal server error")
+		}()
+		next.ServeHTTP(writer, request)
+	})
+}
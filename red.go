@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+
+	"otel-with-golang/metrics"
+)
+
+// redMetrics records the rate, errors and duration of the requests by
+// route and method, so dashboards and alerts can be built on the metrics
+// alone, without deriving them from the sampled traces.
+type redMetrics struct {
+	requests metric.Int64Counter
+	errors   metric.Int64Counter
+	duration metric.Float64Histogram
+}
+
+func newREDMetrics() (*redMetrics, error) {
+	requests, err := metrics.HTTPRequests.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	errors, err := metrics.HTTPErrors.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	duration, err := metrics.HTTPDuration.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	return &redMetrics{requests: requests, errors: errors, duration: duration}, nil
+}
+
+// middleware must run inside serverTiming, which captures the response
+// status.
+func (m *redMetrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := clk.Now()
+		next.ServeHTTP(writer, request)
+		latency := milliseconds(clk.Since(start))
+
+		ctx := request.Context()
+		status := responseStatus(ctx)
+		if status == 0 {
+			status = http.StatusOK
+		}
+		attrs := metric.WithAttributes(
+			semconv.HTTPRouteKey.String(routeTemplate(request)),
+			semconv.HTTPMethodKey.String(request.Method),
+			statusClassKey.String(statusClass(status)),
+		)
+		m.requests.Add(ctx, 1, attrs)
+		if status >= http.StatusInternalServerError {
+			m.errors.Add(ctx, 1, attrs)
+		}
+		m.duration.Record(ctx, latency, attrs)
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/logger"
+	"otel-with-golang/metrics"
+)
+
+// StatsRepository stores how many times each name was greeted.
+type StatsRepository interface {
+	// Increment adds increment to the count of name and returns the new
+	// count, creating the entry when it does not exist yet.
+	Increment(ctx context.Context, name string, increment int) (int, error)
+	// Count returns the count of name, zero when it was never greeted.
+	Count(ctx context.Context, name string) (int, error)
+}
+
+const (
+	selectCountQuery = "SELECT count FROM stats WHERE name=?"
+	updateCountQuery = "UPDATE stats SET count=? WHERE name=?"
+	insertCountQuery = "INSERT INTO stats (name, count) VALUES (?, ?)"
+)
+
+// sqlStatsRepository keeps the counts in the stats table.
+type sqlStatsRepository struct {
+	db          *sql.DB
+	acquireWait metric.Float64Histogram
+	plans       *planCapture
+}
+
+func newSQLStatsRepository(db *sql.DB) (*sqlStatsRepository, error) {
+	acquireWait, err := metrics.DBConnectionAcquire.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlStatsRepository{db: db, acquireWait: acquireWait, plans: newPlanCapture("sqlite3")}, nil
+}
+
+func (r *sqlStatsRepository) conn(ctx context.Context) (*sql.Conn, error) {
+	return acquireConn(ctx, r.db, r.acquireWait)
+}
+
+// acquireConn takes a connection from the pool of db in a span of its own,
+// recording the wait in acquireWait, so time spent waiting for a free
+// connection is not mistaken for a slow query.
+func acquireConn(ctx context.Context, db *sql.DB, acquireWait metric.Float64Histogram) (*sql.Conn, error) {
+	stats := db.Stats()
+	ctx, span := startSpan(ctx, verbosityNormal, "acquire connection", trace.WithAttributes(
+		attribute.Int("db.pool.in_use", stats.InUse),
+		attribute.Int("db.pool.idle", stats.Idle),
+		attribute.Int("db.pool.max_open", stats.MaxOpenConnections)))
+	defer span.End()
+
+	start := clk.Now()
+	conn, err := db.Conn(ctx)
+	acquireWait.Record(ctx, float64(clk.Since(start))/float64(time.Millisecond))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return conn, err
+}
+
+func (r *sqlStatsRepository) Increment(ctx context.Context, name string, increment int) (int, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+	var count int
+	start := clk.Now()
+	err = tx.QueryRowContext(ctx, selectCountQuery, name).Scan(&count)
+	r.plans.observe(ctx, tx, start, selectCountQuery, name)
+	switch err {
+	case nil:
+		count += increment
+		start = clk.Now()
+		if _, err := tx.ExecContext(ctx, updateCountQuery, count, name); err != nil {
+			return -1, err
+		}
+		r.plans.observe(ctx, tx, start, updateCountQuery, count, name)
+		logger.FromContext(ctx).Infof("updated count to %d", count)
+	case sql.ErrNoRows:
+		count = increment
+		start = clk.Now()
+		if _, err := tx.ExecContext(ctx, insertCountQuery, name, count); err != nil {
+			return -1, err
+		}
+		r.plans.observe(ctx, tx, start, insertCountQuery, name, count)
+		logger.FromContext(ctx).Infof("initialised count to %d", count)
+	default:
+		return -1, err
+	}
+	return count, tx.Commit()
+}
+
+func (r *sqlStatsRepository) Count(ctx context.Context, name string) (int, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+	var count int
+	start := clk.Now()
+	err = conn.QueryRowContext(ctx, selectCountQuery, name).Scan(&count)
+	r.plans.observe(ctx, conn, start, selectCountQuery, name)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return count, err
+}
+
+// memoryStatsRepository keeps the counts in a map. It is used when no
+// database driver is available, and emits the same kind of client spans a
+// database would so traces keep their shape across backends.
+type memoryStatsRepository struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newMemoryStatsRepository() *memoryStatsRepository {
+	return &memoryStatsRepository{counts: make(map[string]int)}
+}
+
+func (r *memoryStatsRepository) Increment(ctx context.Context, name string, increment int) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, selectSpan := startMemorySpan(ctx, "SELECT")
+	count, ok := r.counts[name]
+	selectSpan.End()
+
+	operation := "INSERT"
+	if ok {
+		operation = "UPDATE"
+	}
+	_, writeSpan := startMemorySpan(ctx, operation)
+	count += increment
+	r.counts[name] = count
+	writeSpan.End()
+
+	if ok {
+		logger.FromContext(ctx).Infof("updated count to %d", count)
+	} else {
+		logger.FromContext(ctx).Infof("initialised count to %d", count)
+	}
+	return count, nil
+}
+
+func (r *memoryStatsRepository) Count(ctx context.Context, name string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, selectSpan := startMemorySpan(ctx, "SELECT")
+	defer selectSpan.End()
+	return r.counts[name], nil
+}
+
+func startMemorySpan(ctx context.Context, operation string) (context.Context, trace.Span) {
+	return startSpan(ctx, verbosityNormal, operation+" stats",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "memory"),
+			attribute.String("db.operation", operation),
+			attribute.String("db.sql.table", "stats"),
+		))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"otel-with-golang/metrics"
+	"otel-with-golang/requestcontext"
+)
+
+func TestSQLStatsRepositoryCountsConcurrentIncrementsInAFile(t *testing.T) {
+	if !sqliteAvailable {
+		t.Skip("built without the SQLite driver")
+	}
+	t.Setenv("DB_DSN", filepath.Join(t.TempDir(), "hello.db"))
+	dsn, err := sqliteDSN()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	ctx := context.Background()
+	if _, err := migrateDatabase(ctx, db, "sqlite3"); err != nil {
+		t.Fatal(err)
+	}
+	repository, err := newSQLStatsRepository(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const requests = 80
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := repository.Increment(ctx, "same", 1); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if count, err := repository.Count(ctx, "same"); err != nil || count != requests {
+		t.Errorf("Count = %d, %v, want %d", count, err, requests)
+	}
+}
+
+func TestInMemorySQLiteServesConcurrentRequests(t *testing.T) {
+	if !sqliteAvailable {
+		t.Skip("built without the SQLite driver")
+	}
+	db := openSQLite(":memory:")
+	t.Cleanup(func() { db.Close() })
+	ctx := context.Background()
+	if _, err := migrateDatabase(ctx, db, "sqlite3"); err != nil {
+		t.Fatal(err)
+	}
+
+	previousRepository := repository
+	previousCounter, previousEncoder := numberOfExec, responseJSON
+	t.Cleanup(func() {
+		repository = previousRepository
+		numberOfExec, responseJSON = previousCounter, previousEncoder
+	})
+	var err error
+	if repository, err = newSQLStatsRepository(db); err != nil {
+		t.Fatal(err)
+	}
+	if numberOfExec, err = metrics.NumberOfExec.New(meter); err != nil {
+		t.Fatal(err)
+	}
+	if responseJSON, err = newJSONEncoder(); err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	router.Use(requestcontext.Middleware)
+	router.HandleFunc("/hello/{name}", hello)
+
+	const requests = 80
+	var wg sync.WaitGroup
+	codes := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/hello/x%d", i%6), nil))
+			codes <- recorder.Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Fatalf("GET /hello answered %d", code)
+		}
+	}
+
+	total := 0
+	for i := 0; i < 6; i++ {
+		count, err := repository.Count(ctx, fmt.Sprintf("x%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += count
+	}
+	if total != requests {
+		t.Errorf("the counts add up to %d, want %d", total, requests)
+	}
+}
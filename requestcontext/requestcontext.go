@@ -0,0 +1,159 @@
+// Package requestcontext carries the user name, tenant and request ID of
+// an incoming request through its context, so handlers and repositories
+// read them through typed accessors and tag telemetry the same way.
+package requestcontext
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Headers the middleware reads the tenant and request ID from.
+const (
+	TenantHeader    = "X-Tenant-ID"
+	RequestIDHeader = "X-Request-ID"
+)
+
+// Attribute keys used to record the values on spans.
+const (
+	UserNameAttribute  = attribute.Key("app.user.name")
+	TenantAttribute    = attribute.Key("app.tenant")
+	RequestIDAttribute = attribute.Key("app.request.id")
+)
+
+// obfuscate turns a user name into what is recorded in telemetry. It
+// returns the name itself unless SetObfuscator installed another function.
+var obfuscate = func(name string) string { return name }
+
+var obfuscating bool
+
+// SetObfuscator makes spans and log fields carry f(name) instead of user
+// names, for deployments where raw names must not reach telemetry. A nil f
+// makes them carry the names again.
+func SetObfuscator(f func(name string) string) {
+	if f == nil {
+		obfuscate, obfuscating = func(name string) string { return name }, false
+		return
+	}
+	obfuscate = f
+	obfuscating = true
+}
+
+// Obfuscate returns the form of name that may be recorded in telemetry.
+func Obfuscate(name string) string {
+	return obfuscate(name)
+}
+
+type contextKey int
+
+const (
+	userNameKey contextKey = iota
+	tenantKey
+	requestIDKey
+)
+
+// WithUserName returns a copy of ctx carrying the user name.
+func WithUserName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, userNameKey, name)
+}
+
+// UserName returns the user name carried by ctx, if any.
+func UserName(ctx context.Context) string {
+	name, _ := ctx.Value(userNameKey).(string)
+	return name
+}
+
+// WithTenant returns a copy of ctx carrying the tenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey, tenant)
+}
+
+// Tenant returns the tenant carried by ctx, if any.
+func Tenant(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey).(string)
+	return tenant
+}
+
+// WithRequestID returns a copy of ctx carrying the request ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request ID carried by ctx, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Attributes returns the values carried by ctx as span attributes,
+// skipping the ones that are not set.
+func Attributes(ctx context.Context) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	if name := UserName(ctx); name != "" {
+		attrs = append(attrs, UserNameAttribute.String(obfuscate(name)))
+	}
+	if tenant := Tenant(ctx); tenant != "" {
+		attrs = append(attrs, TenantAttribute.String(tenant))
+	}
+	if id := RequestID(ctx); id != "" {
+		attrs = append(attrs, RequestIDAttribute.String(id))
+	}
+	return attrs
+}
+
+// Fields returns the values carried by ctx as log fields, skipping the
+// ones that are not set.
+func Fields(ctx context.Context) logrus.Fields {
+	fields := logrus.Fields{}
+	for _, attr := range Attributes(ctx) {
+		fields[string(attr.Key)] = attr.Value.AsString()
+	}
+	return fields
+}
+
+// Middleware populates the request context from the route variables and
+// headers, generating a request ID when the caller did not send one. The
+// request ID is echoed back and all values are added to the active span.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		if name, ok := mux.Vars(request)["name"]; ok {
+			ctx = WithUserName(ctx, name)
+		}
+		if tenant := request.Header.Get(TenantHeader); tenant != "" {
+			ctx = WithTenant(ctx, tenant)
+		}
+		id := request.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		ctx = WithRequestID(ctx, id)
+		writer.Header().Set(RequestIDHeader, id)
+
+		span := trace.SpanFromContext(ctx)
+		span.SetAttributes(Attributes(ctx)...)
+		if name := UserName(ctx); obfuscating && name != "" {
+			// The instrumentation recorded the path, which contains the name
+			span.SetAttributes(attribute.String("http.target",
+				strings.ReplaceAll(request.URL.RequestURI(), url.PathEscape(name), obfuscate(name))))
+		}
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// basePath is the prefix the service is served under behind an ingress,
+// such as "/hello-app", read from BASE_PATH. It is empty when the service
+// is served at the root.
+var basePath = readBasePath()
+
+func readBasePath() string {
+	prefix := strings.Trim(os.Getenv("BASE_PATH"), "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// underBasePath serves next under basePath. The prefix is removed before
+// routing, so route templates, and the span names and metrics derived from
+// them, are the same whatever the prefix; requests outside of it get a 404.
+func underBasePath(next http.Handler) http.Handler {
+	if basePath == "" {
+		return next
+	}
+	return http.StripPrefix(basePath, next)
+}
+
+// routeTemplate returns the template of the matched route, such as
+// "/hello/{name}", falling back to the raw path outside of the router.
+func routeTemplate(request *http.Request) string {
+	if current := mux.CurrentRoute(request); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return request.URL.Path
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"gopkg.in/yaml.v3"
+
+	"otel-with-golang/requestcontext"
+)
+
+// defaultGreeting is the response message when no VIP rule matches.
+const defaultGreeting = "Hello World %d"
+
+var ruleMatchedKey = attribute.Key("app.rule.matched")
+
+// greetingRules are the business rules applied to every hello request,
+// loaded from the YAML file named by RULES_FILE. See rules.yaml.
+type greetingRules struct {
+	Blocked     []string         `yaml:"blocked"`
+	VIP         []vipRule        `yaml:"vip"`
+	Multipliers []multiplierRule `yaml:"multipliers"`
+}
+
+// vipRule replaces the greeting for a name. The first %d in Message is
+// replaced by the request count.
+type vipRule struct {
+	Name    string `yaml:"name"`
+	Message string `yaml:"message"`
+}
+
+// multiplierRule makes each request for a name count Factor times.
+type multiplierRule struct {
+	Name   string `yaml:"name"`
+	Factor int    `yaml:"factor"`
+}
+
+// ruleMatch is the outcome of evaluating the rules for one name.
+type ruleMatch struct {
+	blocked bool
+	message string
+	factor  int
+	matched []string
+}
+
+func loadGreetingRules(path string) (*greetingRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules greetingRules
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return &rules, nil
+}
+
+// match evaluates all rules for name. A nil receiver matches nothing.
+func (r *greetingRules) match(name string) ruleMatch {
+	match := ruleMatch{message: defaultGreeting, factor: 1}
+	if r == nil {
+		return match
+	}
+	for _, blocked := range r.Blocked {
+		if strings.EqualFold(blocked, name) {
+			match.blocked = true
+			match.matched = append(match.matched, "blocked:"+requestcontext.Obfuscate(blocked))
+		}
+	}
+	for _, vip := range r.VIP {
+		if strings.EqualFold(vip.Name, name) {
+			match.message = vip.Message
+			match.matched = append(match.matched, "vip:"+requestcontext.Obfuscate(vip.Name))
+		}
+	}
+	for _, multiplier := range r.Multipliers {
+		if strings.EqualFold(multiplier.Name, name) && multiplier.Factor > 0 {
+			match.factor = multiplier.Factor
+			match.matched = append(match.matched, "multiplier:"+requestcontext.Obfuscate(multiplier.Name))
+		}
+	}
+	return match
+}
+
+func (m ruleMatch) attributes() []attribute.KeyValue {
+	if len(m.matched) == 0 {
+		return []attribute.KeyValue{ruleMatchedKey.StringSlice([]string{"none"})}
+	}
+	return []attribute.KeyValue{ruleMatchedKey.StringSlice(m.matched)}
+}
+
+// greeting returns the message with its first %d replaced by
+// requestCount. It is not a format string, so other % signs are kept.
+func (m ruleMatch) greeting(requestCount int) string {
+	return strings.Replace(m.message, "%d", strconv.Itoa(requestCount), 1)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadGreetingRules(t *testing.T) {
+	rules, err := loadGreetingRules("rules.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules.Blocked) != 1 || len(rules.VIP) != 1 || len(rules.Multipliers) != 1 {
+		t.Errorf("loaded %+v, want one rule of each kind", rules)
+	}
+
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte("blocked: [mallory\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadGreetingRules(path); err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("loading malformed rules got %v, want an error naming the file", err)
+	}
+	if _, err := loadGreetingRules(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("loading a missing file succeeded")
+	}
+}
+
+func TestGreetingRulesMatch(t *testing.T) {
+	rules := &greetingRules{
+		Blocked:     []string{"mallory"},
+		VIP:         []vipRule{{Name: "alice", Message: "Welcome back, Alice! Visit %d"}},
+		Multipliers: []multiplierRule{{Name: "bob", Factor: 10}, {Name: "carol", Factor: 0}},
+	}
+	tests := []struct {
+		name     string
+		blocked  bool
+		greeting string
+		factor   int
+		matched  int
+	}{
+		{"zoe", false, "Hello World 3", 1, 0},
+		{"Mallory", true, "Hello World 3", 1, 1},
+		{"ALICE", false, "Welcome back, Alice! Visit 3", 1, 1},
+		{"bob", false, "Hello World 3", 10, 1},
+		// A factor below one is ignored
+		{"carol", false, "Hello World 3", 1, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			match := rules.match(test.name)
+			if match.blocked != test.blocked || match.factor != test.factor || len(match.matched) != test.matched {
+				t.Errorf("match = %+v, want blocked %v, factor %d and %d rules matched",
+					match, test.blocked, test.factor, test.matched)
+			}
+			if got := match.greeting(3); got != test.greeting {
+				t.Errorf("greeting(3) = %q, want %q", got, test.greeting)
+			}
+		})
+	}
+
+	var none *greetingRules
+	if match := none.match("zoe"); match.blocked || match.factor != 1 || match.message != defaultGreeting {
+		t.Errorf("nil rules matched %+v", match)
+	}
+}
+
+func TestGreetingKeepsPercentSigns(t *testing.T) {
+	tests := []struct {
+		message string
+		want    string
+	}{
+		{"100% for %d", "100% for 7"},
+		{"%d and %d", "7 and %d"},
+		{"no count, 50% off", "no count, 50% off"},
+	}
+	for _, test := range tests {
+		if got := (ruleMatch{message: test.message}).greeting(7); got != test.want {
+			t.Errorf("greeting of %q = %q, want %q", test.message, got, test.want)
+		}
+	}
+}
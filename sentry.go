@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+// sentryProcessor forwards the exceptions recorded on spans to Sentry,
+// tagged with the trace and span IDs, for teams that keep their errors in
+// Sentry while their traces are in Elastic.
+type sentryProcessor struct {
+	sdktrace.SpanProcessor
+}
+
+// newSentryProcessor initializes Sentry from SENTRY_DSN and wraps next. It
+// returns next unchanged when SENTRY_DSN is not set.
+func newSentryProcessor(next sdktrace.SpanProcessor, environment string) (sdktrace.SpanProcessor, error) {
+	dsn := os.Getenv("SENTRY_DSN")
+	if dsn == "" {
+		return next, nil
+	}
+	err := sentry.Init(sentry.ClientOptions{
+		Dsn:         dsn,
+		Environment: environment,
+		Release:     serviceName + "@" + serviceVersion,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sentryProcessor{SpanProcessor: next}, nil
+}
+
+func (p *sentryProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	for _, event := range s.Events() {
+		if event.Name != semconv.ExceptionEventName {
+			continue
+		}
+		exception := sentry.Exception{}
+		for _, kv := range event.Attributes {
+			switch kv.Key {
+			case semconv.ExceptionTypeKey:
+				exception.Type = kv.Value.AsString()
+			case semconv.ExceptionMessageKey:
+				exception.Value = kv.Value.AsString()
+			}
+		}
+		sentryEvent := sentry.NewEvent()
+		sentryEvent.Level = sentry.LevelError
+		sentryEvent.Message = exception.Value
+		sentryEvent.Timestamp = event.Time
+		sentryEvent.Transaction = s.Name()
+		sentryEvent.Exception = []sentry.Exception{exception}
+		sentryEvent.Tags = map[string]string{
+			"trace.id": s.SpanContext().TraceID().String(),
+			"span.id":  s.SpanContext().SpanID().String(),
+		}
+		sentryEvent.Contexts["trace"] = map[string]interface{}{
+			"trace_id": s.SpanContext().TraceID().String(),
+			"span_id":  s.SpanContext().SpanID().String(),
+		}
+		sentry.CaptureEvent(sentryEvent)
+	}
+	p.SpanProcessor.OnEnd(s)
+}
+
+func (p *sentryProcessor) Shutdown(ctx context.Context) error {
+	timeout := 2 * time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	sentry.Flush(timeout)
+	return p.SpanProcessor.Shutdown(ctx)
+}
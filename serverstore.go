@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+
+	"otel-with-golang/logger"
+	"otel-with-golang/metrics"
+)
+
+// serverDialect is how a database server is opened and spoken to.
+type serverDialect struct {
+	// driverName is the database/sql driver.
+	driverName string
+	// system is the db.system attribute of the query spans.
+	system attribute.KeyValue
+	// selectCount reads the count of a name.
+	selectCount string
+	// upsertCount adds to the count of a name, inserting it when missing,
+	// in a single statement. Its arguments are the name and the increment,
+	// repeated incrementArgs times.
+	upsertCount   string
+	incrementArgs int
+	// returning is set when upsertCount returns the new count, rather than
+	// it having to be read back.
+	returning bool
+	// upsertShard adds to a shard of a name, like upsertCount, with the
+	// shard as its second argument.
+	upsertShard string
+	// sumShards reads the count of a name kept in shards.
+	sumShards string
+}
+
+// serverDialects are the database servers selected by DB_DRIVER.
+var serverDialects = map[string]serverDialect{
+	"postgres": {
+		driverName:  "pgx",
+		system:      semconv.DBSystemPostgreSQL,
+		selectCount: "SELECT count FROM stats WHERE name=$1",
+		upsertCount: "INSERT INTO stats (name, count) VALUES ($1, $2) " +
+			"ON CONFLICT (name) DO UPDATE SET count = stats.count + EXCLUDED.count RETURNING count",
+		incrementArgs: 1,
+		returning:     true,
+		upsertShard: "INSERT INTO stats_shards (name, shard, count) VALUES ($1, $2, $3) " +
+			"ON CONFLICT (name, shard) DO UPDATE SET count = stats_shards.count + EXCLUDED.count",
+		sumShards: "SELECT CAST(COALESCE(SUM(count), 0) AS BIGINT) FROM stats_shards WHERE name=$1",
+	},
+	"mysql": {
+		driverName:  "mysql",
+		system:      semconv.DBSystemMySQL,
+		selectCount: "SELECT count FROM stats WHERE name=?",
+		upsertCount: "INSERT INTO stats (name, count) VALUES (?, ?) " +
+			"ON DUPLICATE KEY UPDATE count = count + ?",
+		incrementArgs: 2,
+		upsertShard: "INSERT INTO stats_shards (name, shard, count) VALUES (?, ?, ?) " +
+			"ON DUPLICATE KEY UPDATE count = count + ?",
+		sumShards: "SELECT CAST(COALESCE(SUM(count), 0) AS SIGNED) FROM stats_shards WHERE name=?",
+	},
+}
+
+// serverStatsRepository keeps the counts in a Postgres or MySQL database
+// that several replicas of the service share. Unlike the SQLite
+// repository, which reads then writes each count, it increments with one
+// upsert, so concurrent replicas never lose an increment. Its connections
+// and slow statements are traced like those of the SQLite repository.
+type serverStatsRepository struct {
+	db          *sql.DB
+	dialect     serverDialect
+	acquireWait metric.Float64Histogram
+	plans       *planCapture
+}
+
+// newServerStatsRepository returns a repository for driver, a DB_DRIVER
+// of serverDialects.
+func newServerStatsRepository(db *sql.DB, driver string) (*serverStatsRepository, error) {
+	acquireWait, err := metrics.DBConnectionAcquire.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	return &serverStatsRepository{
+		db:          db,
+		dialect:     serverDialects[driver],
+		acquireWait: acquireWait,
+		plans:       newPlanCapture(driver),
+	}, nil
+}
+
+func (r *serverStatsRepository) conn(ctx context.Context) (*sql.Conn, error) {
+	return acquireConn(ctx, r.db, r.acquireWait)
+}
+
+func (r *serverStatsRepository) Increment(ctx context.Context, name string, increment int) (int, error) {
+	args := []interface{}{name}
+	for i := 0; i < r.dialect.incrementArgs; i++ {
+		args = append(args, increment)
+	}
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+	var count int
+	if r.dialect.returning {
+		start := clk.Now()
+		if err := conn.QueryRowContext(ctx, r.dialect.upsertCount, args...).Scan(&count); err != nil {
+			return -1, err
+		}
+		r.plans.observe(ctx, conn, start, r.dialect.upsertCount, args...)
+	} else {
+		// Read the count back in the transaction of the upsert, whose
+		// lock on the row keeps other replicas from changing it meanwhile
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return -1, err
+		}
+		defer tx.Rollback()
+		start := clk.Now()
+		if _, err := tx.ExecContext(ctx, r.dialect.upsertCount, args...); err != nil {
+			return -1, err
+		}
+		r.plans.observe(ctx, tx, start, r.dialect.upsertCount, args...)
+		start = clk.Now()
+		if err := tx.QueryRowContext(ctx, r.dialect.selectCount, name).Scan(&count); err != nil {
+			return -1, err
+		}
+		r.plans.observe(ctx, tx, start, r.dialect.selectCount, name)
+		if err := tx.Commit(); err != nil {
+			return -1, err
+		}
+	}
+	if count == increment {
+		logger.FromContext(ctx).Infof("initialised count to %d", count)
+	} else {
+		logger.FromContext(ctx).Infof("updated count to %d", count)
+	}
+	return count, nil
+}
+
+func (r *serverStatsRepository) Count(ctx context.Context, name string) (int, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+	var count int
+	start := clk.Now()
+	err = conn.QueryRowContext(ctx, r.dialect.selectCount, name).Scan(&count)
+	r.plans.observe(ctx, conn, start, r.dialect.selectCount, name)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return count, err
+}
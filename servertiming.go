@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type serverTimingKey struct{}
+
+// phaseTimings accumulates the time a request spends in the database, and
+// keeps its response status once written.
+type phaseTimings struct {
+	start  time.Time
+	mu     sync.Mutex
+	db     time.Duration
+	status int
+}
+
+// addDBTime adds d to the database time of the request in ctx, if it is
+// timed.
+func addDBTime(ctx context.Context, d time.Duration) {
+	if timings, ok := ctx.Value(serverTimingKey{}).(*phaseTimings); ok {
+		timings.mu.Lock()
+		timings.db += d
+		timings.mu.Unlock()
+	}
+}
+
+// dbTime returns the database time of the request in ctx so far.
+func dbTime(ctx context.Context) time.Duration {
+	timings, ok := ctx.Value(serverTimingKey{}).(*phaseTimings)
+	if !ok {
+		return 0
+	}
+	timings.mu.Lock()
+	defer timings.mu.Unlock()
+	return timings.db
+}
+
+// responseStatus returns the status written for the request in ctx, or 0
+// while none is.
+func responseStatus(ctx context.Context) int {
+	timings, ok := ctx.Value(serverTimingKey{}).(*phaseTimings)
+	if !ok {
+		return 0
+	}
+	timings.mu.Lock()
+	defer timings.mu.Unlock()
+	return timings.status
+}
+
+// header returns the Server-Timing value of the request so far.
+func (t *phaseTimings) header() string {
+	total := clk.Since(t.start)
+	t.mu.Lock()
+	db := t.db
+	t.mu.Unlock()
+	return fmt.Sprintf("db;dur=%.2f, app;dur=%.2f, total;dur=%.2f",
+		milliseconds(db), milliseconds(total-db), milliseconds(total))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// serverTiming adds a Server-Timing header with the database, application
+// and total time of each request, so browser devtools show where the
+// backend spent it. The database time is what the repository calls took.
+func serverTiming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		timings := &phaseTimings{start: clk.Now()}
+		ctx := context.WithValue(request.Context(), serverTimingKey{}, timings)
+		next.ServeHTTP(&serverTimingWriter{ResponseWriter: writer, timings: timings},
+			request.WithContext(ctx))
+	})
+}
+
+// serverTimingWriter adds the Server-Timing header right before the
+// response headers are sent.
+type serverTimingWriter struct {
+	http.ResponseWriter
+	timings     *phaseTimings
+	wroteHeader bool
+}
+
+func (w *serverTimingWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Add("Server-Timing", w.timings.header())
+		w.timings.mu.Lock()
+		w.timings.status = status
+		w.timings.mu.Unlock()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *serverTimingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// timedRepository adds the time of every repository call to the database
+// time of the request.
+type timedRepository struct {
+	StatsRepository
+}
+
+func (r timedRepository) Increment(ctx context.Context, name string, increment int) (int, error) {
+	start := clk.Now()
+	defer func() { addDBTime(ctx, clk.Since(start)) }()
+	return r.StatsRepository.Increment(ctx, name, increment)
+}
+
+func (r timedRepository) Count(ctx context.Context, name string) (int, error) {
+	start := clk.Now()
+	defer func() { addDBTime(ctx, clk.Since(start)) }()
+	return r.StatsRepository.Count(ctx, name)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/logger"
+)
+
+var counterShardKey = attribute.Key("app.counter.shard")
+
+// shardedStatsRepository spreads the count of each name over several rows
+// of the stats_shards table, written round-robin and summed on read. On a
+// database with row-level locks, concurrent increments of one name would
+// not all wait for the same row. SQLite, the only database it runs on,
+// locks the whole database for every write, so the increments stay
+// serialized there and only the rows they go to change. The shard an
+// increment went to is recorded on the span.
+type shardedStatsRepository struct {
+	*sqlStatsRepository
+	shards int
+	next   atomic.Uint64
+}
+
+// newShardedStatsRepository returns a repository keeping the counts in
+// shards rows per name, first moving the counts kept unsharded into them.
+func newShardedStatsRepository(ctx context.Context, db *sql.DB, shards int) (*shardedStatsRepository, error) {
+	repository, err := newSQLStatsRepository(db)
+	if err != nil {
+		return nil, err
+	}
+	if err := moveCounts(ctx, db, moveCountsToShards); err != nil {
+		return nil, err
+	}
+	return &shardedStatsRepository{sqlStatsRepository: repository, shards: shards}, nil
+}
+
+func (r *shardedStatsRepository) Increment(ctx context.Context, name string, increment int) (int, error) {
+	shard := int(r.next.Add(1) % uint64(r.shards))
+	trace.SpanFromContext(ctx).SetAttributes(counterShardKey.Int(shard))
+
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "UPDATE stats_shards SET count=count+? WHERE name=? AND shard=?", increment, name, shard)
+	if err != nil {
+		return -1, err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return -1, err
+	} else if updated == 0 {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO stats_shards (name, shard, count) VALUES (?, ?, ?)", name, shard, increment); err != nil {
+			return -1, err
+		}
+	}
+	var count int
+	if err := tx.QueryRowContext(ctx, "SELECT SUM(count) FROM stats_shards WHERE name=?", name).Scan(&count); err != nil {
+		return -1, err
+	}
+	logger.FromContext(ctx).Infof("updated count to %d in shard %d", count, shard)
+	return count, tx.Commit()
+}
+
+func (r *shardedStatsRepository) Count(ctx context.Context, name string) (int, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+	var count sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT SUM(count) FROM stats_shards WHERE name=?", name).Scan(&count)
+	return int(count.Int64), err
+}
+
+// shardedServerStatsRepository spreads the counts of a Postgres or MySQL
+// database over the stats_shards table, like shardedStatsRepository. Those
+// databases lock the rows they write rather than the whole database, so
+// concurrent increments of one name going to different shards do not wait
+// for each other, while the increments of an unsharded count all wait for
+// its single row.
+type shardedServerStatsRepository struct {
+	*serverStatsRepository
+	shards int
+	next   atomic.Uint64
+}
+
+// newShardedServerStatsRepository returns a repository for driver keeping
+// the counts in shards rows per name, first moving the counts kept
+// unsharded into them.
+func newShardedServerStatsRepository(ctx context.Context, db *sql.DB, driver string,
+	shards int) (*shardedServerStatsRepository, error) {
+
+	repository, err := newServerStatsRepository(db, driver)
+	if err != nil {
+		return nil, err
+	}
+	if err := moveCounts(ctx, db, moveCountsToShards); err != nil {
+		return nil, err
+	}
+	return &shardedServerStatsRepository{serverStatsRepository: repository, shards: shards}, nil
+}
+
+func (r *shardedServerStatsRepository) Increment(ctx context.Context, name string, increment int) (int, error) {
+	shard := int(r.next.Add(1) % uint64(r.shards))
+	trace.SpanFromContext(ctx).SetAttributes(counterShardKey.Int(shard))
+
+	args := []interface{}{name, shard}
+	for i := 0; i < r.dialect.incrementArgs; i++ {
+		args = append(args, increment)
+	}
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+	start := clk.Now()
+	if _, err := tx.ExecContext(ctx, r.dialect.upsertShard, args...); err != nil {
+		return -1, err
+	}
+	r.plans.observe(ctx, tx, start, r.dialect.upsertShard, args...)
+	var count int
+	start = clk.Now()
+	if err := tx.QueryRowContext(ctx, r.dialect.sumShards, name).Scan(&count); err != nil {
+		return -1, err
+	}
+	r.plans.observe(ctx, tx, start, r.dialect.sumShards, name)
+	logger.FromContext(ctx).Infof("updated count to %d in shard %d", count, shard)
+	return count, tx.Commit()
+}
+
+func (r *shardedServerStatsRepository) Count(ctx context.Context, name string) (int, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+	var count int
+	start := clk.Now()
+	err = conn.QueryRowContext(ctx, r.dialect.sumShards, name).Scan(&count)
+	r.plans.observe(ctx, conn, start, r.dialect.sumShards, name)
+	return count, err
+}
+
+// moveCountsToShards adds the counts of the stats table to the first shard
+// of each name, for when sharding is turned on.
+var moveCountsToShards = []string{
+	"UPDATE stats_shards SET count=count+(SELECT count FROM stats WHERE stats.name=stats_shards.name) WHERE shard=0 AND name IN (SELECT name FROM stats)",
+	"INSERT INTO stats_shards (name, shard, count) SELECT name, 0, count FROM stats WHERE name NOT IN (SELECT name FROM stats_shards WHERE shard=0)",
+	"DELETE FROM stats",
+}
+
+// moveCountsFromShards adds the shards of each name back to the stats
+// table, for when sharding is turned off again.
+var moveCountsFromShards = []string{
+	"UPDATE stats SET count=count+(SELECT SUM(count) FROM stats_shards WHERE stats_shards.name=stats.name) WHERE name IN (SELECT name FROM stats_shards)",
+	"INSERT INTO stats (name, count) SELECT name, SUM(count) FROM stats_shards WHERE name NOT IN (SELECT name FROM stats) GROUP BY name",
+	"DELETE FROM stats_shards",
+}
+
+// moveCounts runs statements in one transaction, so no count is lost or
+// counted twice if the move fails halfway.
+func moveCounts(ctx context.Context, db *sql.DB, statements []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
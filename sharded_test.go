@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"testing"
+)
+
+// openTestSQLite opens a SQLite database in memory for the test, with the
+// schema of the migrations. It keeps to one connection, since every
+// connection to ":memory:" opens a database of its own.
+func openTestSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+	if !sqliteAvailable {
+		t.Skip("built without the SQLite driver")
+	}
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	if _, err := migrateDatabase(context.Background(), db, "sqlite3"); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestShardedStatsRepositorySumsConcurrentIncrements(t *testing.T) {
+	const shards, workers, increments = 4, 8, 25
+	db := openTestSQLite(t)
+	repository, err := newShardedStatsRepository(context.Background(), db, shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*increments)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				if _, err := repository.Increment(ctx, "zoe", 1); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if count, err := repository.Count(ctx, "zoe"); err != nil || count != workers*increments {
+		t.Errorf("Count = %d, %v, want %d", count, err, workers*increments)
+	}
+	var rows int
+	if err := db.QueryRow("SELECT COUNT(*) FROM stats_shards WHERE name=?", "zoe").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != shards {
+		t.Errorf("the count is kept in %d rows, want %d", rows, shards)
+	}
+	if count, err := repository.Count(ctx, "nobody"); err != nil || count != 0 {
+		t.Errorf("Count of a name never greeted = %d, %v, want 0", count, err)
+	}
+}
+
+func TestShardingKeepsExistingCounts(t *testing.T) {
+	ctx := context.Background()
+	db := openTestSQLite(t)
+	unsharded, err := newSQLStatsRepository(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"zoe", "zoe", "bob"} {
+		if _, err := unsharded.Increment(ctx, name, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sharded, err := newShardedStatsRepository(ctx, db, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := sharded.Increment(ctx, "zoe", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count, err := sharded.Count(ctx, "zoe"); err != nil || count != 5 {
+		t.Errorf("sharded Count = %d, %v, want 5", count, err)
+	}
+
+	// And back when sharding is turned off
+	if err := moveCounts(ctx, db, moveCountsFromShards); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]int{"zoe": 5, "bob": 1} {
+		if count, err := unsharded.Count(ctx, name); err != nil || count != want {
+			t.Errorf("unsharded Count(%q) = %d, %v, want %d", name, count, err, want)
+		}
+	}
+}
+
+// SQLite takes the shard upsert of Postgres, placeholders included, so the
+// sharded server repository can be checked without a database server.
+func TestShardedServerStatsRepositoryKeepsExistingCounts(t *testing.T) {
+	ctx := context.Background()
+	db := openTestSQLite(t)
+	if _, err := db.Exec("INSERT INTO stats (name, count) VALUES ('zoe', 2), ('bob', 1)"); err != nil {
+		t.Fatal(err)
+	}
+	unsharded, err := newServerStatsRepository(db, "postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sharded, err := newShardedServerStatsRepository(ctx, db, "postgres", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		if _, err := sharded.Increment(ctx, "zoe", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count, err := sharded.Increment(ctx, "zoe", 1); err != nil || count != 9 {
+		t.Errorf("sharded Increment = %d, %v, want 9", count, err)
+	}
+	var rows int
+	if err := db.QueryRow("SELECT COUNT(*) FROM stats_shards WHERE name=?", "zoe").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 4 {
+		t.Errorf("the count is kept in %d rows, want 4", rows)
+	}
+	if count, err := sharded.Count(ctx, "nobody"); err != nil || count != 0 {
+		t.Errorf("Count of a name never greeted = %d, %v, want 0", count, err)
+	}
+
+	// And back when sharding is turned off
+	if err := moveCounts(ctx, db, moveCountsFromShards); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]int{"zoe": 9, "bob": 1} {
+		if count, err := unsharded.Count(ctx, name); err != nil || count != want {
+			t.Errorf("unsharded Count(%q) = %d, %v, want %d", name, count, err, want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+var (
+	shutdownDrainKey    = attribute.Key("app.shutdown.drain_ms")
+	shutdownHooksKey    = attribute.Key("app.shutdown.hooks")
+	shutdownFlushKey    = attribute.Key("app.shutdown.flush")
+	shutdownExitCodeKey = attribute.Key("app.shutdown.exit_code")
+)
+
+// serveUntilSignal runs serve until it fails or the process receives
+// SIGINT or SIGTERM, then drains the service. Shutting down server, and
+// the other servers stopped by also, is the first phase of the drain.
+func serveUntilSignal(ctx context.Context, server *http.Server, serve func() error,
+	also ...func(ctx context.Context) error) error {
+
+	signalCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	served := make(chan error, 1)
+	go func() { served <- serve() }()
+	select {
+	case err := <-served:
+		// Deliver the last datapoints before exiting
+		ctx, cancel := context.WithTimeout(ctx, shutdownTimeout())
+		defer cancel()
+		if shutdownErr := shutdownTelemetry(ctx); shutdownErr != nil {
+			log.Warnf("failed to shut down telemetry: %v", shutdownErr)
+		}
+		return err
+	case <-signalCtx.Done():
+	}
+	stop()
+	log.Info("shutting down")
+	return drain(ctx, append([]func(context.Context) error{server.Shutdown}, also...))
+}
+
+// drain shuts the service down in order, within SHUTDOWN_TIMEOUT: it stops
+// accepting connections and waits for the requests in flight, stops the
+// task scheduler, then waits for the background jobs and webhook
+// deliveries they started, and finally flushes the telemetry of all of
+// that. Each phase is logged with its duration and
+// traced as a child of a shutdown span, which records how long the drain
+// took, the phases run, whether the pending telemetry could be flushed and
+// the exit code the drain leads to.
+func drain(ctx context.Context, servers []func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, shutdownTimeout())
+	defer cancel()
+
+	// The global tracer is unset when the signal arrives during startup
+	tracer := otel.Tracer("io.opentelemetry.traces.hello")
+	shutdownCtx, shutdownSpan := tracer.Start(ctx, "shutdown")
+	phases := []struct {
+		name string
+		run  func(ctx context.Context) error
+	}{
+		{"finish requests", func(ctx context.Context) error {
+			var errs []error
+			for _, shutdown := range servers {
+				errs = append(errs, shutdown(ctx))
+			}
+			return errors.Join(errs...)
+		}},
+		{"stop scheduler", func(ctx context.Context) error { return tasks.stop(ctx) }},
+		{"drain jobs", jobs.wait},
+		{"deliver webhooks", func(ctx context.Context) error { return webhooks.wait(ctx) }},
+	}
+	var errs []error
+	hooks := make([]string, 0, len(phases))
+	drainStart := clk.Now()
+	for _, phase := range phases {
+		hooks = append(hooks, phase.name)
+		phaseCtx, span := tracer.Start(shutdownCtx, "shutdown: "+phase.name)
+		start := clk.Now()
+		err := phase.run(phaseCtx)
+		logPhase(phase.name, clk.Since(start), err)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			errs = append(errs, err)
+		}
+		span.End()
+	}
+	drained := clk.Since(drainStart)
+
+	// Flush what the phases left pending while the shutdown span is
+	// still open, so it can tell whether the exporters answered
+	flushResult := "ok"
+	flushErr := forceFlushTelemetry(shutdownCtx)
+	if flushErr != nil {
+		flushResult = flushErr.Error()
+	}
+	exitCode := 0
+	if len(errs) > 0 || flushErr != nil {
+		exitCode = 1
+		shutdownSpan.SetStatus(codes.Error, "shutdown did not complete cleanly")
+	}
+	shutdownSpan.SetAttributes(
+		shutdownDrainKey.Int64(drained.Milliseconds()),
+		shutdownHooksKey.StringSlice(hooks),
+		shutdownFlushKey.String(flushResult),
+		shutdownExitCodeKey.Int(exitCode),
+	)
+	shutdownSpan.End()
+
+	// Telemetry goes last, so it exports the spans of the other phases
+	start := clk.Now()
+	err := shutdownTelemetry(ctx)
+	logPhase("flush telemetry", clk.Since(start), err)
+	return errors.Join(append(errs, err)...)
+}
+
+// shutdownTimeout bounds the drain, read from SHUTDOWN_TIMEOUT.
+func shutdownTimeout() time.Duration {
+	return envDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+}
+
+func logPhase(name string, elapsed time.Duration, err error) {
+	entry := log.WithField("shutdown.phase", name)
+	if err != nil {
+		entry.Warnf("%s failed after %v: %v", name, elapsed, err)
+		return
+	}
+	entry.Infof("%s done in %v", name, elapsed)
+}
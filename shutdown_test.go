@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestDrainRecordsShutdownSpan(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		server   error
+		exitCode int64
+	}{
+		{"clean", nil, 0},
+		{"server fails", errors.New("connections still open"), 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := tracetest.NewSpanRecorder()
+			previous := otel.GetTracerProvider()
+			otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+			defer otel.SetTracerProvider(previous)
+
+			err := drain(context.Background(), []func(context.Context) error{
+				func(context.Context) error { return test.server },
+			})
+			if (err != nil) != (test.server != nil) {
+				t.Fatalf("drain returned %v", err)
+			}
+
+			var shutdown sdktrace.ReadOnlySpan
+			for _, span := range recorder.Ended() {
+				if span.Name() == "shutdown" {
+					shutdown = span
+				}
+			}
+			if shutdown == nil {
+				t.Fatal("no shutdown span")
+			}
+			attrs := attribute.NewSet(shutdown.Attributes()...)
+			if hooks, _ := attrs.Value(shutdownHooksKey); len(hooks.AsStringSlice()) != 4 {
+				t.Errorf("recorded hooks %v, want the 4 phases", hooks.AsStringSlice())
+			}
+			if flush, _ := attrs.Value(shutdownFlushKey); flush.AsString() != "ok" {
+				t.Errorf("recorded flush result %q, want ok", flush.AsString())
+			}
+			if code, _ := attrs.Value(shutdownExitCodeKey); code.AsInt64() != test.exitCode {
+				t.Errorf("recorded exit code %d, want %d", code.AsInt64(), test.exitCode)
+			}
+			if !attrs.HasValue(shutdownDrainKey) {
+				t.Error("drain duration not recorded")
+			}
+		})
+	}
+}
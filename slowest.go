@@ -0,0 +1,112 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// slowRequest is one entry of the slowest requests report.
+type slowRequest struct {
+	TraceID    string    `json:"trace_id"`
+	Route      string    `json:"route"`
+	DurationMS float64   `json:"duration_ms"`
+	Time       time.Time `json:"time"`
+}
+
+// slowestRequests keeps the N slowest requests seen since the last
+// summary, so they can be looked up by trace ID even when the tracing
+// backend is unavailable. A min-heap keeps the fastest of them on top,
+// ready to be evicted by a slower newcomer.
+type slowestRequests struct {
+	size int
+
+	mu       sync.Mutex
+	requests slowHeap
+}
+
+func newSlowestRequests(size int) *slowestRequests {
+	return &slowestRequests{size: size}
+}
+
+func (s *slowestRequests) record(request slowRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) < s.size {
+		heap.Push(&s.requests, request)
+		return
+	}
+	if s.size > 0 && request.DurationMS > s.requests[0].DurationMS {
+		s.requests[0] = request
+		heap.Fix(&s.requests, 0)
+	}
+}
+
+// snapshot returns the recorded requests, slowest first.
+func (s *slowestRequests) snapshot() []slowRequest {
+	s.mu.Lock()
+	requests := append([]slowRequest(nil), s.requests...)
+	s.mu.Unlock()
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].DurationMS > requests[j].DurationMS
+	})
+	return requests
+}
+
+func (s *slowestRequests) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := clk.Now()
+		next.ServeHTTP(writer, request)
+		s.record(slowRequest{
+			TraceID:    trace.SpanContextFromContext(request.Context()).TraceID().String(),
+			Route:      routeTemplate(request),
+			DurationMS: float64(clk.Since(start)) / float64(time.Millisecond),
+			Time:       start,
+		})
+	})
+}
+
+func (s *slowestRequests) handler(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(s.snapshot())
+}
+
+// summarize logs the slowest requests every interval and starts over.
+func (s *slowestRequests) summarize(ctx context.Context, interval time.Duration) {
+	ticker := clk.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		requests := s.snapshot()
+		s.mu.Lock()
+		s.requests = s.requests[:0]
+		s.mu.Unlock()
+		if len(requests) > 0 {
+			log.WithField("slowest", requests).Infof("slowest %d requests in the last %v", len(requests), interval)
+		}
+	}
+}
+
+// slowHeap is a min-heap of requests ordered by duration.
+type slowHeap []slowRequest
+
+func (h slowHeap) Len() int            { return len(h) }
+func (h slowHeap) Less(i, j int) bool  { return h[i].DurationMS < h[j].DurationMS }
+func (h slowHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *slowHeap) Push(x interface{}) { *h = append(*h, x.(slowRequest)) }
+func (h *slowHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
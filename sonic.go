@@ -0,0 +1,13 @@
+//go:build sonic
+
+package main
+
+import (
+	"github.com/bytedance/sonic"
+)
+
+// Built with -tags sonic, JSON_ENCODER=sonic encodes responses with sonic,
+// which compiles encoders just in time on amd64 and arm64.
+func init() {
+	jsonEncoders["sonic"] = sonic.ConfigStd.Marshal
+}
@@ -0,0 +1,13 @@
+//go:build cgo
+
+package main
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The SQLite driver is a cgo package; without cgo the service falls back
+// to the in-memory repository.
+func init() {
+	sqliteAvailable = true
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Startup states. The server starts listening immediately but only
+// serves requests once the state reaches stateReady.
+const (
+	stateStarting int32 = iota
+	stateReady
+)
+
+// startupRetryAfter is the Retry-After value, in seconds, sent while
+// the service is still starting.
+const startupRetryAfter = "5"
+
+var startup atomic.Int32
+
+// startupGate answers 503 with a Retry-After header until initialization
+// completes, so load balancers hold off instead of seeing refused
+// connections during a slow startup.
+func startupGate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if startup.Load() != stateReady {
+			writer.Header().Set("Retry-After", startupRetryAfter)
+			http.Error(writer, "service is starting", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+
+	"otel-with-golang/metrics"
+	"otel-with-golang/requestcontext"
+)
+
+var readSharedKey = attribute.Key("app.read.shared")
+
+type statsResponse struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// countStats answers GET /stats/{name} with the current count.
+func countStats(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	name, err := normalizeName(requestcontext.UserName(ctx))
+	if err != nil {
+		failRequest(writer, request, http.StatusBadRequest, err)
+		return
+	}
+	count, err := repository.Count(ctx, name)
+	if err != nil {
+		failRequest(writer, request, http.StatusInternalServerError, err)
+		return
+	}
+	data, err := responseJSON.Marshal(ctx, statsResponse{Name: name, Count: count})
+	if err != nil {
+		failRequest(writer, request, http.StatusInternalServerError, err)
+		return
+	}
+	writer.Header().Add("Content-Type", "application/json")
+	writer.Write(append(data, '\n'))
+}
+
+// singleflightRepository collapses concurrent reads of the same name into
+// one query, so a burst of identical reads costs the database one round
+// trip. The query runs detached from the cancellation of the request that
+// started it, for at most timeout, and every caller still stops waiting
+// when its own context ends.
+type singleflightRepository struct {
+	StatsRepository
+	group     singleflight.Group
+	timeout   time.Duration
+	collapsed metric.Int64Counter
+}
+
+// newSingleflightRepository returns a repository sharing the reads of next.
+// No caller waits longer than the request timeout, so neither does the
+// shared query.
+func newSingleflightRepository(next StatsRepository, timeout time.Duration) (*singleflightRepository, error) {
+	collapsed, err := metrics.CollapsedReads.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	return &singleflightRepository{StatsRepository: next, timeout: timeout, collapsed: collapsed}, nil
+}
+
+func (r *singleflightRepository) Count(ctx context.Context, name string) (int, error) {
+	leader := false
+	results := r.group.DoChan(name, func() (interface{}, error) {
+		leader = true
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), r.timeout)
+		defer cancel()
+		return r.StatsRepository.Count(ctx, name)
+	})
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case result := <-results:
+		trace.SpanFromContext(ctx).SetAttributes(readSharedKey.Bool(!leader))
+		if !leader {
+			r.collapsed.Add(ctx, 1)
+		}
+		if result.Err != nil {
+			return 0, result.Err
+		}
+		return result.Val.(int), nil
+	}
+}
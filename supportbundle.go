@@ -0,0 +1,255 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	"otel-with-golang/logger"
+)
+
+// redactedValue replaces the value of the settings that look secret in a
+// support bundle.
+const redactedValue = "[REDACTED]"
+
+// secretSetting matches the names of the environment variables whose values
+// must not leave the process, such as exporter headers and API keys.
+var secretSetting = regexp.MustCompile(`(?i)HEADERS|TOKEN|SECRET|PASSWORD|PASSWD|KEY|DSN|AUTH|CREDENTIAL`)
+
+var (
+	// recentSpans keeps the last spans exported, after the attribute
+	// filter, for the support bundle.
+	recentSpans = newSpanRing(int(envInt("SUPPORT_BUNDLE_SPANS", 200)))
+	// recentLogs keeps the last log entries, for the support bundle.
+	recentLogs = newLogRing(int(envInt("SUPPORT_BUNDLE_LOGS", 500)))
+)
+
+// bundleSpan is a span as written to a support bundle.
+type bundleSpan struct {
+	TraceID      string            `json:"trace_id"`
+	SpanID       string            `json:"span_id"`
+	ParentSpanID string            `json:"parent_span_id,omitempty"`
+	Name         string            `json:"name"`
+	Kind         string            `json:"kind"`
+	Start        time.Time         `json:"start"`
+	DurationMS   float64           `json:"duration_ms"`
+	Status       string            `json:"status"`
+	Description  string            `json:"status_description,omitempty"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Events       []string          `json:"events,omitempty"`
+}
+
+// spanRing is a span processor keeping the last spans that ended, before
+// passing them on.
+type spanRing struct {
+	sdktrace.SpanProcessor
+
+	mu    sync.Mutex
+	spans []bundleSpan
+	next  int
+	size  int
+}
+
+func newSpanRing(size int) *spanRing {
+	return &spanRing{spans: make([]bundleSpan, 0, size), size: size}
+}
+
+// wrap makes the ring pass the spans on to next.
+func (r *spanRing) wrap(next sdktrace.SpanProcessor) *spanRing {
+	r.SpanProcessor = next
+	return r
+}
+
+func (r *spanRing) OnEnd(s sdktrace.ReadOnlySpan) {
+	r.SpanProcessor.OnEnd(s)
+	if r.size <= 0 {
+		return
+	}
+	span := bundleSpan{
+		TraceID:     s.SpanContext().TraceID().String(),
+		SpanID:      s.SpanContext().SpanID().String(),
+		Name:        s.Name(),
+		Kind:        s.SpanKind().String(),
+		Start:       s.StartTime(),
+		DurationMS:  milliseconds(s.EndTime().Sub(s.StartTime())),
+		Status:      s.Status().Code.String(),
+		Description: s.Status().Description,
+		Attributes:  make(map[string]string, len(s.Attributes())),
+	}
+	if s.Parent().IsValid() {
+		span.ParentSpanID = s.Parent().SpanID().String()
+	}
+	for _, kv := range s.Attributes() {
+		span.Attributes[string(kv.Key)] = kv.Value.Emit()
+	}
+	for _, event := range s.Events() {
+		span.Events = append(span.Events, event.Name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.spans) < r.size {
+		r.spans = append(r.spans, span)
+		return
+	}
+	r.spans[r.next] = span
+	r.next = (r.next + 1) % r.size
+}
+
+// recent returns the spans kept, oldest first.
+func (r *spanRing) recent() []bundleSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append(append([]bundleSpan(nil), r.spans[r.next:]...), r.spans[:r.next]...)
+}
+
+// logRing is a log hook keeping the last entries, in the format of the
+// stderr output, whether or not it is enabled.
+type logRing struct {
+	formatter logrus.Formatter
+
+	mu      sync.Mutex
+	entries [][]byte
+	next    int
+	size    int
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{formatter: newECSFormatter(), entries: make([][]byte, 0, size), size: size}
+}
+
+func (r *logRing) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (r *logRing) Fire(entry *logrus.Entry) error {
+	if r.size <= 0 || entry.Data[sampledOutField] == true {
+		return nil
+	}
+	line, err := r.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) < r.size {
+		r.entries = append(r.entries, line)
+		return nil
+	}
+	r.entries[r.next] = line
+	r.next = (r.next + 1) % r.size
+	return nil
+}
+
+// writeTo writes the entries kept, oldest first.
+func (r *logRing) writeTo(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, entries := range [][][]byte{r.entries[r.next:], r.entries[:r.next]} {
+		for _, line := range entries {
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolvedConfig describes how the service is configured: the settings it
+// derived and its environment, with the values of the secret-looking
+// variables redacted.
+func resolvedConfig() map[string]interface{} {
+	otlpMetrics, prometheusMetrics, _ := metricsExporters()
+	environ := make(map[string]string)
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if secretSetting.MatchString(key) && value != "" {
+			value = redactedValue
+		}
+		environ[key] = value
+	}
+	return map[string]interface{}{
+		"service_name":       serviceName,
+		"service_version":    serviceVersion,
+		"environment":        deploymentEnvironment(),
+		"base_path":          basePath,
+		"exporter_endpoint":  exporterEndpoint(),
+		"exporter_protocol":  exporterProtocol(),
+		"otlp_metrics":       otlpMetrics,
+		"prometheus_metrics": prometheusMetrics,
+		"telemetry_ready":    telemetryReady.Load(),
+		"sqlite_available":   sqliteAvailable,
+		"env":                environ,
+	}
+}
+
+// supportBundleHandler answers POST /admin/support-bundle with a zip of
+// what is needed to file an issue: the resolved configuration, the recent
+// spans and log entries, a goroutine dump, the dependency health and the
+// build report.
+func supportBundleHandler(writer http.ResponseWriter, request *http.Request) {
+	files := map[string]func(w io.Writer) error{
+		"config.json": func(w io.Writer) error {
+			return writeBundleJSON(w, resolvedConfig())
+		},
+		"spans.json": func(w io.Writer) error {
+			return writeBundleJSON(w, recentSpans.recent())
+		},
+		"logs.ndjson": recentLogs.writeTo,
+		"goroutines.txt": func(w io.Writer) error {
+			return pprof.Lookup("goroutine").WriteTo(w, 2)
+		},
+		"dependencies.json": func(w io.Writer) error {
+			if dependencies == nil {
+				return writeBundleJSON(w, map[string]dependencyStatus{})
+			}
+			return writeBundleJSON(w, dependencies.report())
+		},
+	}
+	if report, ok := readBuildReport(); ok {
+		files["build.json"] = func(w io.Writer) error { return writeBundleJSON(w, report) }
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writer.Header().Set("Content-Type", "application/zip")
+	writer.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-support-%s.zip"`,
+		serviceName, clk.Now().UTC().Format("20060102T150405Z")))
+	archive := zip.NewWriter(writer)
+	for _, name := range names {
+		file, err := archive.Create(name)
+		if err == nil {
+			err = files[name](file)
+		}
+		if err != nil {
+			// The headers are sent already, so the truncated zip is
+			// what tells the client
+			logger.FromContext(request.Context()).Warnf("failed to write support bundle: %v", err)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		logger.FromContext(request.Context()).Warnf("failed to write support bundle: %v", err)
+	}
+}
+
+func writeBundleJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
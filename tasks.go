@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/logger"
+	"otel-with-golang/metrics"
+)
+
+var (
+	taskIDKey      = attribute.Key("app.task.id")
+	taskAttemptKey = attribute.Key("app.task.attempt")
+	taskOutcomeKey = attribute.Key("outcome")
+)
+
+// tasks is set once the service is initialized, with the tasks kept next
+// to the counts.
+var tasks *taskScheduler
+
+// task is a hello for Name scheduled to run at Due. A failed run is
+// retried with a growing delay until MaxAttempts runs failed.
+type task struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Status      string     `json:"status"`
+	Due         time.Time  `json:"due"`
+	Attempts    int        `json:"attempts"`
+	MaxAttempts int        `json:"max_attempts"`
+	Message     string     `json:"message,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	Created     time.Time  `json:"created"`
+	Finished    *time.Time `json:"finished,omitempty"`
+
+	// traceparent is the W3C trace context of the request that scheduled
+	// the task, which its runs link to.
+	traceparent string
+}
+
+// taskStore keeps the scheduled tasks.
+type taskStore interface {
+	// Create adds t.
+	Create(ctx context.Context, t task) error
+	// Get returns the task with the given ID.
+	Get(ctx context.Context, id string) (task, bool, error)
+	// Due returns the pending tasks due at or before now, earliest first.
+	Due(ctx context.Context, now time.Time) ([]task, error)
+	// Claim marks a pending task as running and reports whether it was
+	// still pending, so a task runs once.
+	Claim(ctx context.Context, id string) (bool, error)
+	// Update saves the status, attempts, outcome and due time of t.
+	Update(ctx context.Context, t task) error
+	// Overdue counts the pending tasks due before deadline.
+	Overdue(ctx context.Context, deadline time.Time) (int64, error)
+	// Requeue marks the running tasks pending again and returns how many
+	// there were, for the runs a crash cut short.
+	Requeue(ctx context.Context) (int64, error)
+}
+
+type sqlTaskStore struct {
+	db *sql.DB
+}
+
+func newSQLTaskStore(db *sql.DB) *sqlTaskStore {
+	return &sqlTaskStore{db: db}
+}
+
+const taskColumns = "id, name, status, due, attempts, max_attempts, message, error, created, finished, traceparent"
+
+func (s *sqlTaskStore) Create(ctx context.Context, t task) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO tasks ("+taskColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NULL, ?)",
+		t.ID, t.Name, t.Status, t.Due.UnixNano(), t.Attempts, t.MaxAttempts, t.Message, t.Error,
+		t.Created.UnixNano(), t.traceparent)
+	return err
+}
+
+func (s *sqlTaskStore) Get(ctx context.Context, id string) (task, bool, error) {
+	t, err := scanTask(s.db.QueryRowContext(ctx, "SELECT "+taskColumns+" FROM tasks WHERE id=?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return task{}, false, nil
+	}
+	return t, err == nil, err
+}
+
+func (s *sqlTaskStore) Due(ctx context.Context, now time.Time) ([]task, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+taskColumns+" FROM tasks WHERE status='pending' AND due<=? ORDER BY due",
+		now.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var due []task
+	for rows.Next() {
+		t, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		due = append(due, t)
+	}
+	return due, rows.Err()
+}
+
+func (s *sqlTaskStore) Claim(ctx context.Context, id string) (bool, error) {
+	result, err := s.db.ExecContext(ctx, "UPDATE tasks SET status='running' WHERE id=? AND status='pending'", id)
+	if err != nil {
+		return false, err
+	}
+	claimed, err := result.RowsAffected()
+	return claimed > 0, err
+}
+
+func (s *sqlTaskStore) Update(ctx context.Context, t task) error {
+	var finished sql.NullInt64
+	if t.Finished != nil {
+		finished = sql.NullInt64{Int64: t.Finished.UnixNano(), Valid: true}
+	}
+	_, err := s.db.ExecContext(ctx, "UPDATE tasks SET status=?, due=?, attempts=?, message=?, error=?, finished=? WHERE id=?",
+		t.Status, t.Due.UnixNano(), t.Attempts, t.Message, t.Error, finished, t.ID)
+	return err
+}
+
+func (s *sqlTaskStore) Overdue(ctx context.Context, deadline time.Time) (int64, error) {
+	var overdue int64
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM tasks WHERE status='pending' AND due<?",
+		deadline.UnixNano()).Scan(&overdue)
+	return overdue, err
+}
+
+func (s *sqlTaskStore) Requeue(ctx context.Context) (int64, error) {
+	result, err := s.db.ExecContext(ctx, "UPDATE tasks SET status='pending' WHERE status='running'")
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// scanTask reads a row of the taskColumns.
+func scanTask(row interface{ Scan(dest ...any) error }) (task, error) {
+	var t task
+	var due, created int64
+	var finished sql.NullInt64
+	err := row.Scan(&t.ID, &t.Name, &t.Status, &due, &t.Attempts, &t.MaxAttempts, &t.Message, &t.Error,
+		&created, &finished, &t.traceparent)
+	if err != nil {
+		return task{}, err
+	}
+	t.Due, t.Created = time.Unix(0, due), time.Unix(0, created)
+	if finished.Valid {
+		at := time.Unix(0, finished.Int64)
+		t.Finished = &at
+	}
+	return t, nil
+}
+
+// memoryTaskStore backs the in-memory repository.
+type memoryTaskStore struct {
+	mu    sync.Mutex
+	tasks map[string]task
+}
+
+func newMemoryTaskStore() *memoryTaskStore {
+	return &memoryTaskStore{tasks: make(map[string]task)}
+}
+
+func (s *memoryTaskStore) Create(ctx context.Context, t task) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks[t.ID] = t
+	return nil
+}
+
+func (s *memoryTaskStore) Get(ctx context.Context, id string) (task, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[id]
+	return t, ok, nil
+}
+
+func (s *memoryTaskStore) Due(ctx context.Context, now time.Time) ([]task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []task
+	for _, t := range s.tasks {
+		if t.Status == "pending" && !t.Due.After(now) {
+			due = append(due, t)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].Due.Before(due[j].Due) })
+	return due, nil
+}
+
+func (s *memoryTaskStore) Claim(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[id]
+	if !ok || t.Status != "pending" {
+		return false, nil
+	}
+	t.Status = "running"
+	s.tasks[id] = t
+	return true, nil
+}
+
+func (s *memoryTaskStore) Update(ctx context.Context, t task) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks[t.ID] = t
+	return nil
+}
+
+func (s *memoryTaskStore) Overdue(ctx context.Context, deadline time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var overdue int64
+	for _, t := range s.tasks {
+		if t.Status == "pending" && t.Due.Before(deadline) {
+			overdue++
+		}
+	}
+	return overdue, nil
+}
+
+func (s *memoryTaskStore) Requeue(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var requeued int64
+	for id, t := range s.tasks {
+		if t.Status == "running" {
+			t.Status = "pending"
+			s.tasks[id] = t
+			requeued++
+		}
+	}
+	return requeued, nil
+}
+
+// maxTaskAttempts bounds the max_attempts of a task.
+const maxTaskAttempts = 20
+
+// taskScheduler polls the store for due tasks every TASK_POLL_INTERVAL and
+// runs each as a job, linked to the request that scheduled it. A failed run
+// is retried after TASK_RETRY_BACKOFF, doubled after every failure up to
+// TASK_RETRY_MAX_BACKOFF.
+type taskScheduler struct {
+	store      taskStore
+	interval   time.Duration
+	backoff    time.Duration
+	maxBackoff time.Duration
+	lateness   metric.Float64Histogram
+	executions metric.Int64Counter
+
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+func newTaskScheduler(store taskStore) (*taskScheduler, error) {
+	s := &taskScheduler{
+		store:    store,
+		interval: envInterval("TASK_POLL_INTERVAL", time.Second),
+		backoff:  envDuration("TASK_RETRY_BACKOFF", 10*time.Second),
+	}
+	s.maxBackoff = max(envDuration("TASK_RETRY_MAX_BACKOFF", time.Hour), s.backoff)
+	var err error
+	if s.lateness, err = metrics.TaskLateness.New(meter); err != nil {
+		return nil, err
+	}
+	if s.executions, err = metrics.TaskExecutions.New(meter); err != nil {
+		return nil, err
+	}
+	// A task is overdue once a poll should have picked it up
+	_, err = metrics.TasksOverdue.New(meter, func(ctx context.Context, o metric.Int64Observer) error {
+		overdue, err := s.store.Overdue(ctx, clk.Now().Add(-s.interval))
+		if err != nil {
+			return err
+		}
+		o.Observe(overdue)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// schedule stores a task for name due at due, remembering the trace
+// context of ctx for its runs to link to.
+func (s *taskScheduler) schedule(ctx context.Context, name string, due time.Time, maxAttempts int) (task, error) {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	t := task{
+		ID:          newJobID(),
+		Name:        name,
+		Status:      "pending",
+		Due:         due,
+		MaxAttempts: maxAttempts,
+		Created:     clk.Now(),
+		traceparent: carrier.Get("traceparent"),
+	}
+	return t, s.store.Create(ctx, t)
+}
+
+// launch runs the scheduler in the background until stop is called or
+// ctx is done.
+func (s *taskScheduler) launch(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.stopped = make(chan struct{})
+	go func() {
+		defer close(s.stopped)
+		s.run(ctx)
+	}()
+}
+
+// stop cancels the polls of a launched scheduler and returns once the one
+// in progress has started the tasks it claimed, so no job starts after
+// it, or with the error of ctx when it is done first.
+func (s *taskScheduler) stop(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	cancel, stopped := s.cancel, s.stopped
+	s.mu.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *taskScheduler) run(ctx context.Context) {
+	ticker := clk.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		// Due tasks wait while the feature is switched off
+		if !features.enabled("tasks") {
+			continue
+		}
+		due, err := s.store.Due(ctx, clk.Now())
+		if err != nil {
+			log.Warnf("failed to poll scheduled tasks: %v", err)
+			continue
+		}
+		for _, t := range due {
+			// Leave the rest pending once the scheduler is stopped
+			if ctx.Err() != nil {
+				return
+			}
+			claimed, err := s.store.Claim(ctx, t.ID)
+			if err != nil {
+				log.WithField("task", t.ID).Warnf("failed to claim scheduled task: %v", err)
+				continue
+			}
+			if !claimed {
+				continue
+			}
+			if err := s.start(ctx, t); err != nil {
+				log.WithField("task", t.ID).Warnf("failed to start scheduled task: %v", err)
+				break
+			}
+		}
+	}
+}
+
+// retryDelay returns the delay before retrying a task whose attempt
+// failed: the backoff, doubled after every previous failure, up to the
+// maximum backoff. It stops doubling there, so it cannot overflow.
+func (s *taskScheduler) retryDelay(attempt int) time.Duration {
+	delay := s.backoff
+	for i := 1; i < attempt && delay < s.maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, s.maxBackoff)
+}
+
+// start runs t as a job whose trace links to the request that scheduled
+// it, then saves the outcome. It returns errTooManyJobs, leaving t to the
+// next poll, when no job can start.
+func (s *taskScheduler) start(ctx context.Context, t task) error {
+	jobCtx := propagation.TraceContext{}.Extract(context.Background(),
+		propagation.MapCarrier{"traceparent": t.traceparent})
+	_, err := jobs.start(jobCtx, "task", func(ctx context.Context) (string, error) {
+		t.Attempts++
+		span := trace.SpanFromContext(ctx)
+		span.SetAttributes(taskIDKey.String(t.ID), taskAttemptKey.Int(t.Attempts))
+		s.lateness.Record(ctx, milliseconds(clk.Since(t.Due)))
+
+		message, err := runJob(ctx, func(ctx context.Context) (string, error) {
+			rule := greetingRuleSet.match(t.Name)
+			count, err := updateRequestCount(ctx, t.Name, rule.factor)
+			if err != nil {
+				return "", err
+			}
+			return rule.greeting(count), nil
+		})
+		outcome := "done"
+		switch {
+		case err == nil:
+			t.Status, t.Message, t.Error = "done", message, ""
+		case t.Attempts < t.MaxAttempts:
+			outcome = "retried"
+			t.Status, t.Error = "pending", err.Error()
+			t.Due = clk.Now().Add(s.retryDelay(t.Attempts))
+		default:
+			outcome = "failed"
+			t.Status, t.Error = "failed", err.Error()
+		}
+		if t.Status != "pending" {
+			finished := clk.Now()
+			t.Finished = &finished
+		}
+		s.executions.Add(ctx, 1, metric.WithAttributes(taskOutcomeKey.String(outcome)))
+		if updateErr := s.store.Update(ctx, t); updateErr != nil {
+			logger.FromContext(ctx).WithField("task", t.ID).Errorf("failed to save scheduled task: %v", updateErr)
+		}
+		return message, err
+	})
+	if err != nil {
+		t.Status = "pending"
+		if updateErr := s.store.Update(context.WithoutCancel(ctx), t); updateErr != nil {
+			return errors.Join(err, updateErr)
+		}
+	}
+	return err
+}
+
+// taskRequest is the body of a scheduling request. The task runs at RunAt,
+// or Delay from now, or right away when neither is set.
+type taskRequest struct {
+	Name        string     `json:"name"`
+	RunAt       *time.Time `json:"run_at"`
+	Delay       string     `json:"delay"`
+	MaxAttempts int        `json:"max_attempts"`
+}
+
+// scheduleTask answers POST /tasks, scheduling a hello for a future time.
+func scheduleTask(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	var body taskRequest
+	if status, err := decodeBody(request, &body); err != nil {
+		failRequest(writer, request, status, err)
+		return
+	}
+	if body.Name == "" {
+		failRequest(writer, request, http.StatusBadRequest, errors.New("name is required"))
+		return
+	}
+	var err error
+	if body.Name, err = normalizeName(body.Name); err != nil {
+		failRequest(writer, request, http.StatusBadRequest, err)
+		return
+	}
+	if greetingRuleSet.match(body.Name).blocked {
+		http.Error(writer, "name is blocked", http.StatusForbidden)
+		return
+	}
+	due := clk.Now()
+	switch {
+	case body.RunAt != nil && body.Delay != "":
+		failRequest(writer, request, http.StatusBadRequest, errors.New("set run_at or delay, not both"))
+		return
+	case body.RunAt != nil:
+		due = *body.RunAt
+	case body.Delay != "":
+		delay, err := time.ParseDuration(body.Delay)
+		if err != nil || delay < 0 {
+			failRequest(writer, request, http.StatusBadRequest, fmt.Errorf("invalid delay %q", body.Delay))
+			return
+		}
+		due = due.Add(delay)
+	}
+	if body.MaxAttempts == 0 {
+		body.MaxAttempts = min(int(envInt("TASK_MAX_ATTEMPTS", 3)), maxTaskAttempts)
+	}
+	if body.MaxAttempts < 1 || body.MaxAttempts > maxTaskAttempts {
+		failRequest(writer, request, http.StatusBadRequest,
+			fmt.Errorf("max_attempts must be between 1 and %d", maxTaskAttempts))
+		return
+	}
+
+	t, err := tasks.schedule(ctx, body.Name, due, body.MaxAttempts)
+	if err != nil {
+		failRequest(writer, request, http.StatusInternalServerError, err)
+		return
+	}
+	trace.SpanFromContext(ctx).SetAttributes(taskIDKey.String(t.ID))
+	writer.Header().Add("Content-Type", "application/json")
+	writer.Header().Add("Location", basePath+"/tasks/"+t.ID)
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(t)
+}
+
+// taskStatus reports a scheduled task.
+func taskStatus(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	t, ok, err := tasks.store.Get(ctx, mux.Vars(request)["id"])
+	if err != nil {
+		failRequest(writer, request, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		http.Error(writer, "unknown task", http.StatusNotFound)
+		return
+	}
+	trace.SpanFromContext(ctx).SetAttributes(taskIDKey.String(t.ID), attribute.String("app.task.status", t.Status))
+	writer.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(t)
+}
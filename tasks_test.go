@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTaskRetryDelay(t *testing.T) {
+	s := &taskScheduler{backoff: time.Second, maxBackoff: time.Hour}
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{12, 2048 * time.Second},
+		{13, time.Hour},
+		// Shifting by these would overflow, or shift the delay away
+		{35, time.Hour},
+		{64, time.Hour},
+		{1000, time.Hour},
+	}
+	for _, test := range tests {
+		if got := s.retryDelay(test.attempt); got != test.want {
+			t.Errorf("retryDelay(%d) = %v, want %v", test.attempt, got, test.want)
+		}
+	}
+}
+
+func TestTaskStoreRequeuesRunningTasks(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryTaskStore()
+	for _, created := range []task{{ID: "a", Status: "running"}, {ID: "b", Status: "done"}, {ID: "c", Status: "pending"}} {
+		if err := store.Create(ctx, created); err != nil {
+			t.Fatal(err)
+		}
+	}
+	requeued, err := store.Requeue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requeued != 1 {
+		t.Errorf("requeued %d tasks, want 1", requeued)
+	}
+	due, err := store.Due(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 2 {
+		t.Errorf("%d tasks due after requeueing, want the running and the pending one", len(due))
+	}
+}
+
+func TestTaskCountsWithTheMultiplierOfItsName(t *testing.T) {
+	previousRepository, previousRules := repository, greetingRuleSet
+	t.Cleanup(func() { repository, greetingRuleSet = previousRepository, previousRules })
+	repository = newMemoryStatsRepository()
+	greetingRuleSet = &greetingRules{Multipliers: []multiplierRule{{Name: "bob", Factor: 10}}}
+
+	ctx := context.Background()
+	store := newMemoryTaskStore()
+	scheduler, err := newTaskScheduler(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduled, err := scheduler.schedule(ctx, "bob", time.Now(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := scheduler.start(ctx, scheduled); err != nil {
+		t.Fatal(err)
+	}
+	if err := jobs.wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := repository.Count(ctx, "bob"); count != 10 {
+		t.Errorf("count after the task = %d, want 10", count)
+	}
+	if finished, _, err := store.Get(ctx, scheduled.ID); err != nil || finished.Message != "Hello World 10" {
+		t.Errorf("task %+v, %v, want it greeting the tenth request", finished, err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceResponseHeaders returns a middleware that tells the client which
+// trace served its request, so browsers and upstream proxies can correlate
+// their own telemetry with ours. formats is a comma-separated list of:
+//
+//   - traceresponse: the W3C Trace Context Level 2 traceresponse header
+//   - server-timing: a Server-Timing traceparent entry, which browsers
+//     expose to scripts through the Resource Timing API
+//
+// An empty list leaves responses unchanged.
+func traceResponseHeaders(formats string) (func(http.Handler) http.Handler, error) {
+	var withTraceResponse, withServerTiming bool
+	for _, format := range strings.Split(formats, ",") {
+		switch strings.TrimSpace(format) {
+		case "":
+		case "traceresponse":
+			withTraceResponse = true
+		case "server-timing":
+			withServerTiming = true
+		default:
+			return nil, fmt.Errorf("unknown trace response header %q", format)
+		}
+	}
+	if !withTraceResponse && !withServerTiming {
+		return identity, nil
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			spanContext := trace.SpanContextFromContext(request.Context())
+			if spanContext.IsValid() {
+				value := fmt.Sprintf("00-%s-%s-%s", spanContext.TraceID(),
+					spanContext.SpanID(), spanContext.TraceFlags())
+				if withTraceResponse {
+					writer.Header().Set("traceresponse", value)
+				}
+				if withServerTiming {
+					writer.Header().Add("Server-Timing", fmt.Sprintf("traceparent;desc=%q", value))
+				}
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+	"go.opentelemetry.io/otel"
+)
+
+// The policies of TRACE_CONTEXT_POLICY for the trace context sent by
+// clients.
+const (
+	// traceContextContinue makes the server span a child of the caller's.
+	traceContextContinue = "continue"
+	// traceContextLink starts a new trace linked to the caller's.
+	traceContextLink = "link"
+	// traceContextIgnore starts a new trace as if none was sent.
+	traceContextIgnore = "ignore"
+)
+
+// traceContextPolicy decides how much to trust the trace context of
+// incoming requests, for services at the public edge that should not let
+// arbitrary clients pick their trace IDs or sampling decisions. Callers in
+// TRACE_CONTEXT_TRUSTED_CIDRS, such as other services of the mesh, are
+// always continued.
+type traceContextPolicy struct {
+	mode    string
+	trusted []*net.IPNet
+}
+
+func newTraceContextPolicy() (*traceContextPolicy, error) {
+	policy := &traceContextPolicy{mode: os.Getenv("TRACE_CONTEXT_POLICY")}
+	switch policy.mode {
+	case "":
+		policy.mode = traceContextContinue
+	case traceContextContinue, traceContextLink, traceContextIgnore:
+	default:
+		return nil, fmt.Errorf("unknown TRACE_CONTEXT_POLICY %q, want continue, link or ignore", policy.mode)
+	}
+	if cidrs := os.Getenv("TRACE_CONTEXT_TRUSTED_CIDRS"); cidrs != "" {
+		for _, cidr := range strings.Split(cidrs, ",") {
+			_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				return nil, err
+			}
+			policy.trusted = append(policy.trusted, network)
+		}
+	}
+	return policy, nil
+}
+
+// isTrusted reports whether the trace context of request is continued.
+func (p *traceContextPolicy) isTrusted(request *http.Request) bool {
+	if p.mode == traceContextContinue {
+		return true
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, network := range p.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// otelmuxOptions makes the server spans of untrusted requests new roots
+// linked to the caller's span in link mode.
+func (p *traceContextPolicy) otelmuxOptions() []otelmux.Option {
+	if p.mode != traceContextLink {
+		return nil
+	}
+	return []otelmux.Option{otelmux.WithPublicEndpointFn(func(request *http.Request) bool {
+		return !p.isTrusted(request)
+	})}
+}
+
+// middleware drops the trace context headers of untrusted requests in
+// ignore mode. It must run before the otelmux middleware. Baggage is kept.
+func (p *traceContextPolicy) middleware(next http.Handler) http.Handler {
+	if p.mode != traceContextIgnore {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !p.isTrusted(request) {
+			request = request.Clone(request.Context())
+			for _, field := range otel.GetTextMapPropagator().Fields() {
+				if field != "baggage" {
+					request.Header.Del(field)
+				}
+			}
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const (
+	callerTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	callerTraceparent = "00-" + callerTraceID + "-00f067aa0ba902b7-01"
+)
+
+// serveWithPolicy serves a request sent with a trace context from
+// remoteAddr behind the middlewares of policy, and returns the server span.
+func serveWithPolicy(t *testing.T, policy *traceContextPolicy, remoteAddr string) sdktrace.ReadOnlySpan {
+	t.Helper()
+	previous := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	t.Cleanup(func() { otel.SetTextMapPropagator(previous) })
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	router := mux.NewRouter()
+	router.Use(policy.middleware)
+	router.Use(otelmux.Middleware(serviceName,
+		append(policy.otelmuxOptions(), otelmux.WithTracerProvider(provider))...))
+	router.HandleFunc("/hello/{name}", func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("baggage") == "" {
+			t.Error("the baggage was dropped")
+		}
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/hello/zoe", nil)
+	request.RemoteAddr = remoteAddr
+	request.Header.Set("traceparent", callerTraceparent)
+	request.Header.Set("baggage", "tenant=acme")
+	router.ServeHTTP(httptest.NewRecorder(), request)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want the server span", len(spans))
+	}
+	return spans[0]
+}
+
+func TestTraceContextPolicy(t *testing.T) {
+	t.Setenv("TRACE_CONTEXT_TRUSTED_CIDRS", "10.0.0.0/8, 192.168.1.0/24")
+	tests := []struct {
+		mode       string
+		remoteAddr string
+		continued  bool
+		linked     bool
+	}{
+		{"", "203.0.113.7:5000", true, false},
+		{"continue", "203.0.113.7:5000", true, false},
+		{"link", "203.0.113.7:5000", false, true},
+		{"link", "10.1.2.3:5000", true, false},
+		{"ignore", "203.0.113.7:5000", false, false},
+		{"ignore", "192.168.1.20:5000", true, false},
+	}
+	for _, test := range tests {
+		t.Setenv("TRACE_CONTEXT_POLICY", test.mode)
+		policy, err := newTraceContextPolicy()
+		if err != nil {
+			t.Fatal(err)
+		}
+		span := serveWithPolicy(t, policy, test.remoteAddr)
+		continued := span.Parent().TraceID().String() == callerTraceID &&
+			span.SpanContext().TraceID().String() == callerTraceID
+		if continued != test.continued {
+			t.Errorf("policy %q from %s: continued = %v, want %v", test.mode, test.remoteAddr, continued, test.continued)
+		}
+		linked := len(span.Links()) == 1 && span.Links()[0].SpanContext.TraceID().String() == callerTraceID
+		if linked != test.linked {
+			t.Errorf("policy %q from %s: linked = %v, want %v", test.mode, test.remoteAddr, linked, test.linked)
+		}
+	}
+}
+
+func TestTraceContextPolicyRejectsInvalidSettings(t *testing.T) {
+	t.Setenv("TRACE_CONTEXT_POLICY", "trust-everyone")
+	if _, err := newTraceContextPolicy(); err == nil {
+		t.Error("an unknown policy was accepted")
+	}
+	t.Setenv("TRACE_CONTEXT_POLICY", "link")
+	t.Setenv("TRACE_CONTEXT_TRUSTED_CIDRS", "10.0.0.0/33")
+	if _, err := newTraceContextPolicy(); err == nil {
+		t.Error("an invalid CIDR was accepted")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/metrics"
+)
+
+const (
+	// spanOverheadBytes approximates the fixed part of an OTLP span: the
+	// trace, span and parent IDs, timestamps, kind and status.
+	spanOverheadBytes = 64
+	usageRetention    = 24
+	unknownRoute      = "unknown"
+)
+
+// telemetryUsage is set once tracing is initialized and backs the
+// /admin/telemetry/usage report.
+var telemetryUsage *usageProcessor
+
+// routeUsage is the telemetry volume attributed to one route.
+type routeUsage struct {
+	Spans int64 `json:"spans"`
+	Bytes int64 `json:"bytes"`
+}
+
+// hourUsage is the telemetry volume of one hour, by route.
+type hourUsage struct {
+	Hour   time.Time              `json:"hour"`
+	Routes map[string]*routeUsage `json:"routes"`
+}
+
+// usageProcessor estimates how much span data leaves the process, per
+// route and per hour, to help forecast ingest costs. Every span of a trace
+// is attributed to the route of the server span that started it.
+type usageProcessor struct {
+	sdktrace.SpanProcessor
+	spans metric.Int64Counter
+	bytes metric.Int64Counter
+
+	mu     sync.Mutex
+	routes map[trace.TraceID]string
+	hours  []*hourUsage
+}
+
+func newUsageProcessor(next sdktrace.SpanProcessor) (*usageProcessor, error) {
+	spans, err := metrics.ExportedSpans.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := metrics.ExportedBytes.New(meter)
+	if err != nil {
+		return nil, err
+	}
+	return &usageProcessor{
+		SpanProcessor: next,
+		spans:         spans,
+		bytes:         bytes,
+		routes:        make(map[trace.TraceID]string),
+	}, nil
+}
+
+func (p *usageProcessor) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {
+	p.SpanProcessor.OnStart(parent, s)
+	if route, ok := spanRoute(s); ok {
+		p.mu.Lock()
+		p.routes[s.SpanContext().TraceID()] = route
+		p.mu.Unlock()
+	}
+}
+
+func (p *usageProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	size := estimateSpanSize(s)
+	traceID := s.SpanContext().TraceID()
+
+	p.mu.Lock()
+	route, ok := p.routes[traceID]
+	if !ok {
+		route = unknownRoute
+	}
+	// The local root span ends after its children, so the trace is done
+	// here whether or not its route was known
+	if parent := s.Parent(); !parent.IsValid() || parent.IsRemote() {
+		delete(p.routes, traceID)
+	}
+	usage := p.current(s.EndTime()).route(route)
+	usage.Spans++
+	usage.Bytes += size
+	p.mu.Unlock()
+
+	routeAttr := metric.WithAttributes(semconv.HTTPRouteKey.String(route))
+	p.spans.Add(context.Background(), 1, routeAttr)
+	p.bytes.Add(context.Background(), size, routeAttr)
+	p.SpanProcessor.OnEnd(s)
+}
+
+// current returns the bucket for the hour of t, dropping buckets older
+// than the retention. Callers must hold p.mu.
+func (p *usageProcessor) current(t time.Time) *hourUsage {
+	hour := t.Truncate(time.Hour)
+	if n := len(p.hours); n > 0 && p.hours[n-1].Hour.Equal(hour) {
+		return p.hours[n-1]
+	}
+	bucket := &hourUsage{Hour: hour, Routes: make(map[string]*routeUsage)}
+	p.hours = append(p.hours, bucket)
+	if len(p.hours) > usageRetention {
+		p.hours = p.hours[len(p.hours)-usageRetention:]
+	}
+	return bucket
+}
+
+func (h *hourUsage) route(route string) *routeUsage {
+	usage, ok := h.Routes[route]
+	if !ok {
+		usage = &routeUsage{}
+		h.Routes[route] = usage
+	}
+	return usage
+}
+
+// report returns a copy of the hourly usage, most recent hour first.
+func (p *usageProcessor) report() []hourUsage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	hours := make([]hourUsage, 0, len(p.hours))
+	for _, bucket := range p.hours {
+		routes := make(map[string]*routeUsage, len(bucket.Routes))
+		for route, usage := range bucket.Routes {
+			copied := *usage
+			routes[route] = &copied
+		}
+		hours = append(hours, hourUsage{Hour: bucket.Hour, Routes: routes})
+	}
+	sort.Slice(hours, func(i, j int) bool { return hours[i].Hour.After(hours[j].Hour) })
+	return hours
+}
+
+func telemetryUsageHandler(writer http.ResponseWriter, request *http.Request) {
+	if telemetryUsage == nil {
+		http.Error(writer, "tracing is not initialized", http.StatusServiceUnavailable)
+		return
+	}
+	writer.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(telemetryUsage.report())
+}
+
+// spanRoute returns the http.route attribute of a span, if it has one.
+func spanRoute(s sdktrace.ReadOnlySpan) (string, bool) {
+	for _, kv := range s.Attributes() {
+		if kv.Key == semconv.HTTPRouteKey {
+			return kv.Value.AsString(), true
+		}
+	}
+	return "", false
+}
+
+// estimateSpanSize approximates the OTLP encoded size of a span without
+// serializing it: the fixed fields plus the name, attributes and events.
+func estimateSpanSize(s sdktrace.ReadOnlySpan) int64 {
+	size := int64(spanOverheadBytes + len(s.Name()) + len(s.Status().Description))
+	size += attributesSize(s.Attributes())
+	for _, event := range s.Events() {
+		size += int64(16+len(event.Name)) + attributesSize(event.Attributes)
+	}
+	for _, link := range s.Links() {
+		size += 24 + attributesSize(link.Attributes)
+	}
+	return size
+}
+
+func attributesSize(attrs []attribute.KeyValue) int64 {
+	var size int64
+	for _, kv := range attrs {
+		size += int64(4 + len(kv.Key) + len(kv.Value.Emit()))
+	}
+	return size
+}
+
+// flushTelemetryHandler exports the pending spans and metrics right away,
+// so a short load test can be followed by a flush instead of waiting for
+// the next METRIC_EXPORT_INTERVAL.
+func flushTelemetryHandler(writer http.ResponseWriter, request *http.Request) {
+	if err := forceFlushTelemetry(request.Context()); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// forceFlushTelemetry exports the pending spans and metrics of the global
+// providers.
+func forceFlushTelemetry(ctx context.Context) error {
+	type flusher interface {
+		ForceFlush(ctx context.Context) error
+	}
+	var errs []error
+	for _, provider := range []interface{}{otel.GetTracerProvider(), otel.GetMeterProvider()} {
+		if f, ok := provider.(flusher); ok {
+			errs = append(errs, f.ForceFlush(ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
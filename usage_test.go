@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestUsageProcessorForgetsEndedTraces(t *testing.T) {
+	usage, err := newUsageProcessor(tracetest.NewSpanRecorder())
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(usage))
+	defer provider.Shutdown(context.Background())
+	tracer := provider.Tracer("test")
+
+	// A root span without a route, with a child that has one
+	ctx, root := tracer.Start(context.Background(), "root")
+	_, child := tracer.Start(ctx, "child", trace.WithAttributes(semconv.HTTPRouteKey.String("/hello/{name}")))
+	child.End()
+	root.End()
+
+	// A server span that continues a remote trace and carries the route
+	remote := trace.ContextWithRemoteSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{1},
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	}))
+	_, server := tracer.Start(remote, "server", trace.WithAttributes(semconv.HTTPRouteKey.String("/hello/{name}")))
+	server.End()
+
+	if len(usage.routes) != 0 {
+		t.Errorf("usage processor still tracks %d ended traces", len(usage.routes))
+	}
+	report := usage.report()
+	if len(report) != 1 {
+		t.Fatalf("got %d hours of usage, want 1", len(report))
+	}
+	if spans := report[0].Routes["/hello/{name}"].Spans; spans != 3 {
+		t.Errorf("attributed %d spans to the route, want 3", spans)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const verbosityHeader = "X-Trace-Verbosity"
+
+var verbosityKey = attribute.Key("app.trace.verbosity")
+
+// verbosity sets how detailed the trace of a request is: minimal keeps
+// only the server span, normal adds the spans of the main steps, and
+// verbose adds validation, serialization and cache spans too.
+type verbosity int
+
+const (
+	verbosityMinimal verbosity = iota
+	verbosityNormal
+	verbosityVerbose
+)
+
+var verbosityNames = []string{"minimal", "normal", "verbose"}
+
+type verbosityContextKey struct{}
+
+func parseVerbosity(name string) (verbosity, bool) {
+	for level, candidate := range verbosityNames {
+		if name == candidate {
+			return verbosity(level), true
+		}
+	}
+	return verbosityNormal, false
+}
+
+// defaultVerbosity is read from TRACE_VERBOSITY, normal when unset.
+func defaultVerbosity() verbosity {
+	level, ok := parseVerbosity(os.Getenv("TRACE_VERBOSITY"))
+	if !ok && os.Getenv("TRACE_VERBOSITY") != "" {
+		log.Warnf("invalid TRACE_VERBOSITY %q, using normal", os.Getenv("TRACE_VERBOSITY"))
+	}
+	return level
+}
+
+// traceVerbosity lets a request pick its verbosity with the
+// X-Trace-Verbosity header, falling back to def.
+func traceVerbosity(def verbosity) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			level := def
+			if header, ok := parseVerbosity(request.Header.Get(verbosityHeader)); ok {
+				level = header
+			}
+			ctx := context.WithValue(request.Context(), verbosityContextKey{}, level)
+			trace.SpanFromContext(ctx).SetAttributes(verbosityKey.String(verbosityNames[level]))
+			next.ServeHTTP(writer, request.WithContext(ctx))
+		})
+	}
+}
+
+// startSpan starts a span when the verbosity of the request is at least
+// level. Otherwise it returns ctx unchanged and a span that records
+// nothing, so callers need not care whether the span exists.
+func startSpan(ctx context.Context, level verbosity, name string,
+	opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+
+	if !verbosityAtLeast(ctx, level) {
+		return ctx, trace.SpanFromContext(context.Background())
+	}
+	return tracer.Start(ctx, name, opts...)
+}
+
+// verbosityAtLeast reports whether the request in ctx is traced at level
+// or above, normal for requests that did not pick one.
+func verbosityAtLeast(ctx context.Context, level verbosity) bool {
+	current, ok := ctx.Value(verbosityContextKey{}).(verbosity)
+	if !ok {
+		current = verbosityNormal
+	}
+	return current >= level
+}
+
+// verbosityTransport traces the requests made at normal verbosity or above
+// with a client span, and only propagates the trace context of the others,
+// so downstream services still join the trace of a minimal request.
+type verbosityTransport struct {
+	traced http.RoundTripper
+	base   http.RoundTripper
+}
+
+func newVerbosityTransport(base http.RoundTripper) verbosityTransport {
+	return verbosityTransport{traced: otelhttp.NewTransport(base), base: base}
+}
+
+func (t verbosityTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if verbosityAtLeast(request.Context(), verbosityNormal) {
+		return t.traced.RoundTrip(request)
+	}
+	request = request.Clone(request.Context())
+	otel.GetTextMapPropagator().Inject(request.Context(), propagation.HeaderCarrier(request.Header))
+	return t.base.RoundTrip(request)
+}
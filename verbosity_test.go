@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+func TestDatabaseSpansFollowVerbosity(t *testing.T) {
+	if !sqliteAvailable {
+		t.Skip("built without the SQLite driver")
+	}
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+	db := openDB("sqlite3", ":memory:", semconv.DBSystemSqlite)
+	defer db.Close()
+
+	for _, test := range []struct {
+		level   verbosity
+		dbSpans bool
+	}{
+		{verbosityMinimal, false},
+		{verbosityNormal, true},
+		{verbosityVerbose, true},
+	} {
+		ended := len(recorder.Ended())
+		ctx := context.WithValue(context.Background(), verbosityContextKey{}, test.level)
+		ctx, span := provider.Tracer("test").Start(ctx, "server")
+		var one int
+		if err := db.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+			t.Fatal(err)
+		}
+		span.End()
+		if dbSpans := len(recorder.Ended())-ended > 1; dbSpans != test.dbSpans {
+			t.Errorf("%s verbosity: database spans recorded = %v, want %v",
+				verbosityNames[test.level], dbSpans, test.dbSpans)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/requestcontext"
+)
+
+var (
+	watchSinceKey   = attribute.Key("app.watch.since")
+	watchTimeoutKey = attribute.Key("app.watch.timeout_ms")
+	watchWaitedKey  = attribute.Key("app.watch.waited_ms")
+	watchCountKey   = attribute.Key("app.watch.count")
+)
+
+// watchDeadlineMargin is kept from the request deadline to answer a watch
+// that timed out.
+const watchDeadlineMargin = 100 * time.Millisecond
+
+// watchHeartbeat is how often a waiting watch records that it is still
+// waiting, read once rather than for every watch.
+var watchHeartbeat = envInterval("WATCH_HEARTBEAT", 5*time.Second)
+
+// watchers wakes up long-polling clients when a count changes.
+var watchers = newCountWatchers()
+
+// countWatchers keeps the channels of the clients waiting for the count of
+// a name to change. A name is forgotten as soon as nobody waits for it, so
+// only the waiting clients take memory.
+type countWatchers struct {
+	mu      sync.Mutex
+	waiters map[string][]chan int
+}
+
+func newCountWatchers() *countWatchers {
+	return &countWatchers{waiters: make(map[string][]chan int)}
+}
+
+// notify wakes up the waiters of name with its new count.
+func (w *countWatchers) notify(name string, count int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, waiter := range w.waiters[name] {
+		waiter <- count
+	}
+	delete(w.waiters, name)
+}
+
+// watch returns a channel that receives the next count of name.
+func (w *countWatchers) watch(name string) chan int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	waiter := make(chan int, 1)
+	w.waiters[name] = append(w.waiters[name], waiter)
+	return waiter
+}
+
+// unwatch removes a waiter that gave up before being notified.
+func (w *countWatchers) unwatch(name string, waiter chan int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	waiters := w.waiters[name]
+	for i, candidate := range waiters {
+		if candidate == waiter {
+			w.waiters[name] = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(w.waiters[name]) == 0 {
+		delete(w.waiters, name)
+	}
+}
+
+// watchStats long-polls for a change of the count of a name. It answers as
+// soon as the count differs from the since parameter, or with 204 once the
+// timeout runs out. The timeout is cut to what is left of the request
+// deadline, so the 204 goes out before the deadline ends the request. The
+// wait shows up as events on the server span, one every WATCH_HEARTBEAT,
+// rather than as spans of its own.
+func watchStats(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	span := trace.SpanFromContext(ctx)
+	name, err := normalizeName(requestcontext.UserName(ctx))
+	if err != nil {
+		failRequest(writer, request, http.StatusBadRequest, err)
+		return
+	}
+
+	timeout := 30 * time.Second
+	if value := request.URL.Query().Get("timeout"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			failRequest(writer, request, http.StatusBadRequest, errors.New("invalid timeout"))
+			return
+		}
+		timeout = parsed
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := deadline.Sub(clk.Now()) - watchDeadlineMargin; remaining < timeout {
+			timeout = max(remaining, 0)
+		}
+	}
+	since := -1
+	if value := request.URL.Query().Get("since"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			failRequest(writer, request, http.StatusBadRequest, errors.New("invalid since"))
+			return
+		}
+		since = parsed
+	}
+	span.SetAttributes(watchSinceKey.Int(since), watchTimeoutKey.Int64(timeout.Milliseconds()))
+
+	// Wait before reading the count, so a change in between is not missed
+	waiter := watchers.watch(name)
+	count, err := repository.Count(ctx, name)
+	if err != nil {
+		watchers.unwatch(name, waiter)
+		failRequest(writer, request, http.StatusInternalServerError, err)
+		return
+	}
+	if count != since {
+		watchers.unwatch(name, waiter)
+	} else {
+		start := clk.Now()
+		timer := clk.NewTimer(timeout)
+		defer timer.Stop()
+		heartbeat := clk.NewTicker(watchHeartbeat)
+		defer heartbeat.Stop()
+
+		span.AddEvent("watch.waiting")
+		changed := false
+	wait:
+		for {
+			select {
+			case count = <-waiter:
+				changed = true
+				break wait
+			case <-heartbeat.C():
+				span.AddEvent("watch.heartbeat",
+					trace.WithAttributes(watchWaitedKey.Int64(clk.Since(start).Milliseconds())))
+			case <-timer.C():
+				break wait
+			case <-ctx.Done():
+				break wait
+			}
+		}
+		if !changed {
+			watchers.unwatch(name, waiter)
+			span.AddEvent("watch.timeout",
+				trace.WithAttributes(watchWaitedKey.Int64(clk.Since(start).Milliseconds())))
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+		span.AddEvent("watch.changed", trace.WithAttributes(
+			watchWaitedKey.Int64(clk.Since(start).Milliseconds()),
+			watchCountKey.Int(count)))
+	}
+
+	data, err := responseJSON.Marshal(ctx, statsResponse{Name: name, Count: count})
+	if err != nil {
+		failRequest(writer, request, http.StatusInternalServerError, err)
+		return
+	}
+	writer.Header().Add("Content-Type", "application/json")
+	writer.Write(append(data, '\n'))
+}
@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestCountWatchersForgetNamesWithoutWaiters(t *testing.T) {
+	w := newCountWatchers()
+	notified := w.watch("alice")
+	gaveUp := w.watch("bob")
+
+	w.notify("alice", 3)
+	if count := <-notified; count != 3 {
+		t.Errorf("notified count = %d, want 3", count)
+	}
+	w.unwatch("bob", gaveUp)
+	w.notify("carol", 1)
+	if len(w.waiters) != 0 {
+		t.Errorf("waiters kept for %d names, want none", len(w.waiters))
+	}
+}
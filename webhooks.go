@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"otel-with-golang/logger"
+	"otel-with-golang/requestcontext"
+)
+
+var (
+	webhookURLKey         = attribute.Key("app.webhook.url")
+	webhookSubscribersKey = attribute.Key("app.webhook.subscribers")
+)
+
+// webhooks is set once the service is initialized, with the subscriptions
+// kept next to the counts.
+var webhooks *webhookDispatcher
+
+// errTooManySubscribers is returned when subscribing to a name that has as
+// many subscribers as allowed. It leaves the name out, which telemetry
+// only records obfuscated.
+var errTooManySubscribers = errors.New("the name has too many subscribers")
+
+// subscriptionStore keeps the webhook URLs subscribed to each name.
+type subscriptionStore interface {
+	// Subscribe adds url to the subscribers of name, unless name already
+	// has limit others, checked along with the insert so concurrent
+	// subscriptions cannot go over it. Subscribing twice is not an error.
+	Subscribe(ctx context.Context, name, url string, limit int) error
+	// Unsubscribe removes url from the subscribers of name and reports
+	// whether it was subscribed.
+	Unsubscribe(ctx context.Context, name, url string) (bool, error)
+	// Subscribers returns the URLs subscribed to name.
+	Subscribers(ctx context.Context, name string) ([]string, error)
+}
+
+type sqlSubscriptionStore struct {
+	db *sql.DB
+}
+
+func newSQLSubscriptionStore(db *sql.DB) *sqlSubscriptionStore {
+	return &sqlSubscriptionStore{db: db}
+}
+
+func (s *sqlSubscriptionStore) Subscribe(ctx context.Context, name, url string, limit int) error {
+	result, err := s.db.ExecContext(ctx, "INSERT OR IGNORE INTO webhooks (name, url) SELECT ?, ? "+
+		"WHERE (SELECT COUNT(*) FROM webhooks WHERE name=?) < ?", name, url, name, limit)
+	if err != nil {
+		return err
+	}
+	if inserted, err := result.RowsAffected(); err != nil || inserted > 0 {
+		return err
+	}
+	// Nothing inserted: either subscribed already, or at the limit
+	var subscribed bool
+	err = s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM webhooks WHERE name=? AND url=?)", name, url).
+		Scan(&subscribed)
+	if err == nil && !subscribed {
+		err = errTooManySubscribers
+	}
+	return err
+}
+
+func (s *sqlSubscriptionStore) Unsubscribe(ctx context.Context, name, url string) (bool, error) {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM webhooks WHERE name=? AND url=?", name, url)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func (s *sqlSubscriptionStore) Subscribers(ctx context.Context, name string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT url FROM webhooks WHERE name=? ORDER BY url", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var urls []string
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+	return urls, rows.Err()
+}
+
+// memorySubscriptionStore backs the in-memory repository.
+type memorySubscriptionStore struct {
+	mu   sync.Mutex
+	urls map[string]map[string]bool
+}
+
+func newMemorySubscriptionStore() *memorySubscriptionStore {
+	return &memorySubscriptionStore{urls: make(map[string]map[string]bool)}
+}
+
+func (s *memorySubscriptionStore) Subscribe(ctx context.Context, name, url string, limit int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.urls[name] == nil {
+		s.urls[name] = make(map[string]bool)
+	}
+	if !s.urls[name][url] && len(s.urls[name]) >= limit {
+		return errTooManySubscribers
+	}
+	s.urls[name][url] = true
+	return nil
+}
+
+func (s *memorySubscriptionStore) Unsubscribe(ctx context.Context, name, url string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subscribed := s.urls[name][url]
+	delete(s.urls[name], url)
+	return subscribed, nil
+}
+
+func (s *memorySubscriptionStore) Subscribers(ctx context.Context, name string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var urls []string
+	for url := range s.urls[name] {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	return urls, nil
+}
+
+// errWebhookTarget is returned for webhook URLs that resolve to addresses
+// of the internal network, so subscribers cannot make the service call
+// its own admin endpoints or the cloud metadata service.
+var errWebhookTarget = errors.New("webhook URL must resolve to a public address")
+
+// webhookDispatcher posts the new count of a name to its subscribers in
+// the background, once the request that changed it has the count. The
+// deliveries are children of the span that changed the count, and carry
+// its trace context to the subscribers. A fixed number of workers take
+// them from a bounded queue, and the deliveries that do not fit are
+// dropped, so a burst of changes cannot pile up goroutines.
+type webhookDispatcher struct {
+	store          subscriptionStore
+	client         *http.Client
+	allowPrivate   bool
+	maxSubscribers int
+	queue          chan webhookDelivery
+	running        sync.WaitGroup
+
+	// mu guards closed, set once the shutdown waits for the deliveries,
+	// so none is added to running while it does
+	mu     sync.Mutex
+	closed bool
+}
+
+// webhookDelivery is a change of count waiting for a worker.
+type webhookDelivery struct {
+	ctx   context.Context
+	name  string
+	count int
+}
+
+func newWebhookDispatcher(store subscriptionStore) *webhookDispatcher {
+	d := &webhookDispatcher{
+		store: store,
+		// Local setups deliver to services on the same host or network
+		allowPrivate:   envBool("WEBHOOK_ALLOW_PRIVATE", false),
+		maxSubscribers: int(envInt("WEBHOOK_MAX_SUBSCRIBERS", 10)),
+		queue:          make(chan webhookDelivery, max(int(envInt("WEBHOOK_QUEUE_SIZE", 1000)), 1)),
+	}
+	// The addresses are checked once resolved, right before connecting,
+	// so a name cannot pass the check and then resolve elsewhere
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: d.checkAddress}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	d.client = &http.Client{
+		Transport: newVerbosityTransport(transport),
+		Timeout:   envDuration("WEBHOOK_TIMEOUT", 5*time.Second),
+	}
+	for i := 0; i < max(int(envInt("WEBHOOK_WORKERS", 4)), 1); i++ {
+		go d.work()
+	}
+	return d
+}
+
+// checkAddress refuses connections to the internal network, unless
+// WEBHOOK_ALLOW_PRIVATE is set.
+func (d *webhookDispatcher) checkAddress(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !d.publicAddress(ip) {
+		return errWebhookTarget
+	}
+	return nil
+}
+
+func (d *webhookDispatcher) publicAddress(ip net.IP) bool {
+	if d.allowPrivate {
+		return true
+	}
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() &&
+		!ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// checkTarget resolves the host of target and refuses it when one of its
+// addresses is internal, to reject such subscriptions up front. The
+// deliveries check again when connecting.
+func (d *webhookDispatcher) checkTarget(ctx context.Context, target *url.URL) error {
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, target.Hostname())
+	if err != nil {
+		return err
+	}
+	for _, address := range addresses {
+		if !d.publicAddress(address.IP) {
+			return errWebhookTarget
+		}
+	}
+	return nil
+}
+
+// webhookPayload is the body posted to the subscribers.
+type webhookPayload struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// deliver queues the posting of count to the subscribers of name. A nil
+// receiver, the webhooks feature switched off, or a dispatcher the
+// shutdown is waiting for, delivers nothing.
+func (d *webhookDispatcher) deliver(ctx context.Context, name string, count int) {
+	if d == nil || !features.enabled("webhooks") {
+		return
+	}
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		trace.SpanFromContext(ctx).AddEvent("webhook delivery dropped")
+		logger.FromContext(ctx).Warn("shutting down, dropping the webhook delivery")
+		return
+	}
+	d.running.Add(1)
+	d.mu.Unlock()
+	select {
+	case d.queue <- webhookDelivery{ctx: context.WithoutCancel(ctx), name: name, count: count}:
+	default:
+		d.running.Done()
+		trace.SpanFromContext(ctx).AddEvent("webhook delivery dropped")
+		logger.FromContext(ctx).Warn("webhook queue full, dropping the delivery")
+	}
+}
+
+// work delivers the queued changes, one at a time.
+func (d *webhookDispatcher) work() {
+	for delivery := range d.queue {
+		d.post(delivery)
+		d.running.Done()
+	}
+}
+
+// post posts a change to each subscriber of its name.
+func (d *webhookDispatcher) post(delivery webhookDelivery) {
+	ctx, span := startSpan(delivery.ctx, verbosityNormal, "deliver webhooks",
+		trace.WithAttributes(requestcontext.Attributes(delivery.ctx)...))
+	defer span.End()
+	urls, err := d.store.Subscribers(ctx, delivery.name)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+	span.SetAttributes(webhookSubscribersKey.Int(len(urls)))
+	body, _ := json.Marshal(webhookPayload{Name: delivery.name, Count: delivery.count})
+	for _, target := range urls {
+		start := clk.Now()
+		err := d.postTo(ctx, target, body)
+		chargeback.addDownstream(ctx, clk.Since(start))
+		if err != nil {
+			span.RecordError(err, trace.WithAttributes(webhookURLKey.String(target)))
+			span.SetStatus(codes.Error, "webhook delivery failed")
+			logger.FromContext(ctx).WithField("webhook", target).Warnf("failed to deliver webhook: %v", err)
+		}
+	}
+}
+
+func (d *webhookDispatcher) postTo(ctx context.Context, target string, body []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := d.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", response.Status)
+	}
+	return nil
+}
+
+// wait blocks until the deliveries in flight are done or ctx ends, and
+// makes deliver drop the changes from then on. A nil receiver has nothing
+// to wait for.
+func (d *webhookDispatcher) wait(ctx context.Context) error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		d.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// webhookSubscription is the body of a subscription request.
+type webhookSubscription struct {
+	URL string `json:"url"`
+}
+
+// webhookSubscriptions manages the subscribers of a name: GET lists them,
+// POST subscribes the URL of the JSON body and DELETE unsubscribes the url
+// query parameter.
+func webhookSubscriptions(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	name, err := normalizeName(requestcontext.UserName(ctx))
+	if err != nil {
+		failRequest(writer, request, http.StatusBadRequest, err)
+		return
+	}
+	switch request.Method {
+	case http.MethodPost:
+		var subscription webhookSubscription
+		if status, err := decodeBody(request, &subscription); err != nil {
+			failRequest(writer, request, status, err)
+			return
+		}
+		target, err := url.Parse(subscription.URL)
+		if err != nil || !target.IsAbs() || target.Scheme != "http" && target.Scheme != "https" {
+			failRequest(writer, request, http.StatusBadRequest, errors.New("url must be an absolute http or https URL"))
+			return
+		}
+		trace.SpanFromContext(ctx).SetAttributes(webhookURLKey.String(subscription.URL))
+		if err := webhooks.checkTarget(ctx, target); err != nil {
+			failRequest(writer, request, http.StatusBadRequest, err)
+			return
+		}
+		err = webhooks.store.Subscribe(ctx, name, subscription.URL, webhooks.maxSubscribers)
+		if errors.Is(err, errTooManySubscribers) {
+			failRequest(writer, request, http.StatusConflict, err)
+			return
+		}
+		if err != nil {
+			failRequest(writer, request, http.StatusInternalServerError, err)
+			return
+		}
+		writer.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		target := request.URL.Query().Get("url")
+		trace.SpanFromContext(ctx).SetAttributes(webhookURLKey.String(target))
+		subscribed, err := webhooks.store.Unsubscribe(ctx, name, target)
+		if err != nil {
+			failRequest(writer, request, http.StatusInternalServerError, err)
+			return
+		}
+		if !subscribed {
+			http.Error(writer, "not subscribed", http.StatusNotFound)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	default:
+		urls, err := webhooks.store.Subscribers(ctx, name)
+		if err != nil {
+			failRequest(writer, request, http.StatusInternalServerError, err)
+			return
+		}
+		if urls == nil {
+			urls = []string{}
+		}
+		writer.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(urls)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestWebhookDeliveryPropagatesTraceContext(t *testing.T) {
+	previous := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(previous) })
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer provider.Shutdown(context.Background())
+	previousTracer := tracer
+	tracer = provider.Tracer("test")
+	t.Cleanup(func() { tracer = previousTracer })
+
+	type delivery struct {
+		traceparent string
+		payload     webhookPayload
+	}
+	delivered := make(chan delivery, 1)
+	subscriber := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var payload webhookPayload
+		body, _ := io.ReadAll(request.Body)
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("webhook body %q: %v", body, err)
+		}
+		delivered <- delivery{request.Header.Get("traceparent"), payload}
+	}))
+	defer subscriber.Close()
+
+	// The subscriber listens on the loopback interface
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE", "true")
+	store := newMemorySubscriptionStore()
+	if err := store.Subscribe(context.Background(), "zoe", subscriber.URL, 10); err != nil {
+		t.Fatal(err)
+	}
+	dispatcher := newWebhookDispatcher(store)
+
+	ctx, parent := tracer.Start(context.Background(), "increment")
+	dispatcher.deliver(ctx, "zoe", 3)
+	parent.End()
+	if err := dispatcher.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := <-delivered
+	if got.payload != (webhookPayload{Name: "zoe", Count: 3}) {
+		t.Errorf("delivered %+v", got.payload)
+	}
+	carrier := propagation.MapCarrier{"traceparent": got.traceparent}
+	sent := trace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(), carrier))
+	if sent.TraceID() != parent.SpanContext().TraceID() {
+		t.Errorf("traceparent %q is not in the trace %s", got.traceparent, parent.SpanContext().TraceID())
+	}
+	var spans int
+	for _, span := range recorder.Ended() {
+		if span.Name() == "deliver webhooks" {
+			spans++
+			if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+				t.Error("the deliver webhooks span is not a child of the increment")
+			}
+		}
+	}
+	if spans != 1 {
+		t.Errorf("got %d deliver webhooks spans, want 1", spans)
+	}
+
+	// The shutdown waited for the deliveries, so later changes are dropped
+	ctx, late := tracer.Start(context.Background(), "late increment")
+	dispatcher.deliver(ctx, "zoe", 4)
+	late.End()
+	if events := late.(sdktrace.ReadOnlySpan).Events(); len(events) != 1 || events[0].Name != "webhook delivery dropped" {
+		t.Errorf("a change after the wait was not dropped, events %v", events)
+	}
+}
+
+func TestWebhookDeliveryFollowsVerbosity(t *testing.T) {
+	previous := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(previous) })
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer provider.Shutdown(context.Background())
+	previousTracer, previousProvider := tracer, otel.GetTracerProvider()
+	tracer = provider.Tracer("test")
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		tracer = previousTracer
+		otel.SetTracerProvider(previousProvider)
+	})
+
+	traceparents := make(chan string, 1)
+	subscriber := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		traceparents <- request.Header.Get("traceparent")
+	}))
+	defer subscriber.Close()
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE", "true")
+	store := newMemorySubscriptionStore()
+	if err := store.Subscribe(context.Background(), "zoe", subscriber.URL, 10); err != nil {
+		t.Fatal(err)
+	}
+	dispatcher := newWebhookDispatcher(store)
+
+	ctx := context.WithValue(context.Background(), verbosityContextKey{}, verbosityMinimal)
+	ctx, parent := tracer.Start(ctx, "increment")
+	dispatcher.deliver(ctx, "zoe", 3)
+	parent.End()
+	if err := dispatcher.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the server span is kept, but the subscriber still joins its trace
+	carrier := propagation.MapCarrier{"traceparent": <-traceparents}
+	sent := trace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(), carrier))
+	if sent.SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("traceparent %q does not point to the increment %s", carrier["traceparent"], parent.SpanContext().SpanID())
+	}
+	if spans := recorder.Ended(); len(spans) != 1 {
+		t.Errorf("got %d spans at minimal verbosity, want only the increment", len(spans))
+	}
+}
+
+func TestWebhookTargetsMustBePublic(t *testing.T) {
+	subscriber := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		t.Error("the webhook reached a loopback address")
+	}))
+	defer subscriber.Close()
+	dispatcher := newWebhookDispatcher(newMemorySubscriptionStore())
+
+	for _, target := range []string{subscriber.URL, "http://169.254.169.254/latest/meta-data/", "http://10.0.0.1/", "http://[::1]/"} {
+		t.Run(target, func(t *testing.T) {
+			parsed, err := url.Parse(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := dispatcher.checkTarget(context.Background(), parsed); !errors.Is(err, errWebhookTarget) {
+				t.Errorf("subscribing got %v, want %v", err, errWebhookTarget)
+			}
+			if err := dispatcher.postTo(context.Background(), target, []byte("{}")); !errors.Is(err, errWebhookTarget) {
+				t.Errorf("posting got %v, want %v", err, errWebhookTarget)
+			}
+		})
+	}
+}
+
+func TestSubscriptionStoresCapSubscribers(t *testing.T) {
+	const limit, subscribers = 3, 10
+	stores := map[string]func(t *testing.T) subscriptionStore{
+		"memory": func(t *testing.T) subscriptionStore { return newMemorySubscriptionStore() },
+		"sql":    func(t *testing.T) subscriptionStore { return newSQLSubscriptionStore(openTestSQLite(t)) },
+	}
+	for kind, newStore := range stores {
+		t.Run(kind, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			var wg sync.WaitGroup
+			for i := 0; i < subscribers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					err := store.Subscribe(ctx, "zoe", fmt.Sprintf("https://example.com/%d", i), limit)
+					if err != nil && !errors.Is(err, errTooManySubscribers) {
+						t.Error(err)
+					}
+				}(i)
+			}
+			wg.Wait()
+			urls, err := store.Subscribers(ctx, "zoe")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(urls) != limit {
+				t.Fatalf("got %d subscribers, want %d", len(urls), limit)
+			}
+			// Subscribing again at the limit is not an error
+			if err := store.Subscribe(ctx, "zoe", urls[0], limit); err != nil {
+				t.Errorf("subscribing %s again: %v", urls[0], err)
+			}
+		})
+	}
+}